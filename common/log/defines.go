@@ -1,5 +1,10 @@
 package log
 
+import (
+	"fmt"
+	"strings"
+)
+
 type LogLevel int64
 
 const (
@@ -24,6 +29,22 @@ func (l LogLevel) String() string {
 	}
 }
 
+// 解析配置中的日志等级, 如: debug, info, warning, error (不区分大小写)
+func ParseLevel(s string) (LogLevel, error) {
+	switch strings.ToUpper(s) {
+	case "DEBUG":
+		return LevelDebug, nil
+	case "INFO":
+		return LevelInfo, nil
+	case "WARNING", "WARN":
+		return LevelWarning, nil
+	case "ERROR":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q", s)
+	}
+}
+
 type Logger interface {
 	Log(lv LogLevel, args ...interface{})
 	Logf(lv LogLevel, format string, args ...interface{})
@@ -0,0 +1,440 @@
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xingshuo/saber/common/lib"
+)
+
+const (
+	DEFAULT_FILE_MAX_SIZE       = 100 << 20
+	DEFAULT_FILE_BUFFER_SIZE    = 64 << 10
+	DEFAULT_FILE_FLUSH_INTERVAL = time.Second
+	LOG_TIME_FORMAT             = "2006/01/02 15:04:05.000000 "
+	BACKUP_TIME_FORMAT          = "20060102-150405.000"
+)
+
+// Provide file logger Optional Config Parameters
+
+type fileOptions struct {
+	maxSize        int64         // 单个文件大小上限:字节, <= 0不按大小轮转
+	rotateInterval time.Duration // 按时间轮转的间隔, <= 0不按时间轮转
+	maxBackups     int           // 保留的历史文件数, <= 0全部保留
+	compress       bool          // 历史文件由后台goroutine gzip压缩
+	bufferSize     int           // 缓冲达到该大小时立即写文件
+	flushInterval  time.Duration // 定时写文件的间隔
+}
+
+type FileOption interface {
+	apply(*fileOptions)
+}
+
+type funcFileOption struct {
+	f func(*fileOptions)
+}
+
+func (ffo *funcFileOption) apply(fo *fileOptions) {
+	ffo.f(fo)
+}
+
+func newFuncFileOption(f func(*fileOptions)) *funcFileOption {
+	return &funcFileOption{
+		f: f,
+	}
+}
+
+// 文件超过n字节后轮转, 单次批量写入可能略微超出
+func WithMaxSize(n int64) FileOption {
+	return newFuncFileOption(func(fo *fileOptions) {
+		fo.maxSize = n
+	})
+}
+
+// 按固定间隔轮转, 以UTC时间对齐, 如: 24 * time.Hour 每天0点(UTC)
+func WithRotateInterval(d time.Duration) FileOption {
+	return newFuncFileOption(func(fo *fileOptions) {
+		fo.rotateInterval = d
+	})
+}
+
+func WithMaxBackups(n int) FileOption {
+	return newFuncFileOption(func(fo *fileOptions) {
+		fo.maxBackups = n
+	})
+}
+
+func WithCompress(compress bool) FileOption {
+	return newFuncFileOption(func(fo *fileOptions) {
+		fo.compress = compress
+	})
+}
+
+func WithBufferSize(n int) FileOption {
+	return newFuncFileOption(func(fo *fileOptions) {
+		fo.bufferSize = n
+	})
+}
+
+func WithFlushInterval(d time.Duration) FileOption {
+	return newFuncFileOption(func(fo *fileOptions) {
+		fo.flushInterval = d
+	})
+}
+
+func defaultFileOptions() fileOptions {
+	return fileOptions{
+		maxSize:       DEFAULT_FILE_MAX_SIZE,
+		bufferSize:    DEFAULT_FILE_BUFFER_SIZE,
+		flushInterval: DEFAULT_FILE_FLUSH_INTERVAL,
+	}
+}
+
+// 异步写文件的logger: 日志先写入内存缓冲, 由后台goroutine定时或缓冲满时批量落盘.
+// 历史文件命名: 文件名.创建时间[.gz], 如: saber.log.20210119-150727.000.gz
+type FileLogger struct {
+	opts     fileOptions
+	filename string
+	mu       sync.Mutex // 保护pending, closed
+	pending  []byte
+	closed   bool
+	writeMu  sync.Mutex // 保护文件写入及轮转
+	spare    []byte
+	file     *os.File
+	size     int64
+	openTime time.Time
+	notify   chan struct{}
+	quit     *lib.SyncEvent
+	done     *lib.SyncEvent
+	millCh   chan struct{} // 轮转后通知后台压缩及清理历史文件, 不阻塞写日志
+	millDone *lib.SyncEvent
+}
+
+func NewFileLogger(filename string, opts ...FileOption) (*FileLogger, error) {
+	l := &FileLogger{
+		opts:     defaultFileOptions(),
+		filename: filename,
+		notify:   make(chan struct{}, 1),
+		quit:     lib.NewSyncEvent(),
+		done:     lib.NewSyncEvent(),
+		millCh:   make(chan struct{}, 1),
+		millDone: lib.NewSyncEvent(),
+	}
+	for _, opt := range opts {
+		opt.apply(&l.opts)
+	}
+	if l.opts.bufferSize <= 0 {
+		l.opts.bufferSize = DEFAULT_FILE_BUFFER_SIZE
+	}
+	if l.opts.flushInterval <= 0 {
+		l.opts.flushInterval = DEFAULT_FILE_FLUSH_INTERVAL
+	}
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = l.openFile()
+	if err != nil {
+		return nil, err
+	}
+	go l.loop()
+	go l.mill(l.millCh)
+	return l, nil
+}
+
+func (l *FileLogger) Log(lv LogLevel, args ...interface{}) {
+	l.output(lv, fmt.Sprint(args...))
+}
+
+func (l *FileLogger) Logf(lv LogLevel, format string, args ...interface{}) {
+	l.output(lv, fmt.Sprintf(format, args...))
+}
+
+func (l *FileLogger) output(lv LogLevel, msg string) {
+	now := time.Now()
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.pending = now.AppendFormat(l.pending, LOG_TIME_FORMAT)
+	l.pending = append(l.pending, '[')
+	l.pending = append(l.pending, lv.String()...)
+	l.pending = append(l.pending, ']')
+	l.pending = append(l.pending, msg...)
+	if len(msg) == 0 || msg[len(msg)-1] != '\n' {
+		l.pending = append(l.pending, '\n')
+	}
+	n := len(l.pending)
+	l.mu.Unlock()
+	if n >= 8*l.opts.bufferSize {
+		// 落盘跟不上时由调用方同步写入, 避免缓冲无限增长
+		l.Flush()
+	} else if n >= l.opts.bufferSize {
+		select {
+		case l.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// 将缓冲中的日志写入文件
+func (l *FileLogger) Flush() error {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	l.mu.Lock()
+	data := l.pending
+	l.pending = l.spare[:0]
+	l.mu.Unlock()
+	err := l.write(data)
+	l.spare = data[:0]
+	return err
+}
+
+// 落盘剩余日志并关闭文件, 等待历史文件压缩完成, 之后的日志被丢弃
+func (l *FileLogger) Close() error {
+	if !l.quit.Fire() {
+		return nil
+	}
+	<-l.done.Done()
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	err := l.Flush()
+	l.writeMu.Lock()
+	if l.file != nil {
+		if cerr := l.file.Close(); err == nil {
+			err = cerr
+		}
+		l.file = nil
+	}
+	close(l.millCh)
+	l.millCh = nil
+	l.writeMu.Unlock()
+	<-l.millDone.Done()
+	return err
+}
+
+func (l *FileLogger) loop() {
+	defer l.done.Fire()
+	ticker := time.NewTicker(l.opts.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.notify:
+		case <-ticker.C:
+		case <-l.quit.Done():
+			return
+		}
+		if err := l.Flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "file logger %s flush err:%v\n", l.filename, err)
+		}
+	}
+}
+
+func (l *FileLogger) mill(c chan struct{}) {
+	defer l.millDone.Fire()
+	for range c {
+		if err := l.millRunOnce(); err != nil {
+			fmt.Fprintf(os.Stderr, "file logger %s mill backups err:%v\n", l.filename, err)
+		}
+	}
+}
+
+// 调用时持有writeMu, Close之后不再通知
+func (l *FileLogger) millAsync() {
+	select {
+	case l.millCh <- struct{}{}:
+	default: // 后台尚未处理的通知会一并处理本次轮转的文件
+	}
+}
+
+func (l *FileLogger) openFile() error {
+	f, err := os.OpenFile(l.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	l.openTime = time.Now()
+	if l.size > 0 {
+		// 沿用已有文件, 按最后写入时间判断是否需要按时间轮转
+		l.openTime = info.ModTime()
+	}
+	return nil
+}
+
+func (l *FileLogger) shouldRotate(now time.Time, n int) bool {
+	if l.size == 0 {
+		return false
+	}
+	if l.opts.maxSize > 0 && l.size+int64(n) > l.opts.maxSize {
+		return true
+	}
+	interval := l.opts.rotateInterval
+	return interval > 0 && !now.Truncate(interval).Equal(l.openTime.Truncate(interval))
+}
+
+func (l *FileLogger) write(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if l.file != nil && l.shouldRotate(time.Now(), len(data)) {
+		if err := l.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "file logger %s rotate err:%v\n", l.filename, err)
+		}
+	}
+	if l.file == nil {
+		if err := l.openFile(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+func (l *FileLogger) backupName() string {
+	name := l.filename + "." + l.openTime.Format(BACKUP_TIME_FORMAT)
+	backup := name
+	for i := 1; ; i++ {
+		if !fileExists(backup) && !fileExists(backup+".gz") {
+			return backup
+		}
+		backup = fmt.Sprintf("%s.%d", name, i)
+	}
+}
+
+func (l *FileLogger) rotate() error {
+	backup := l.backupName()
+	err := l.file.Close()
+	l.file = nil
+	if err != nil {
+		return err
+	}
+	renameErr := os.Rename(l.filename, backup)
+	if err := l.openFile(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	l.millAsync()
+	return nil
+}
+
+// 按修改时间保留最新的maxBackups个历史文件, 再压缩剩余未压缩的历史文件
+func (l *FileLogger) millRunOnce() error {
+	dir, base := filepath.Split(l.filename)
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var backups []os.FileInfo
+	for _, info := range infos {
+		if !info.IsDir() && isBackupName(base, info.Name()) {
+			backups = append(backups, info)
+		}
+	}
+	if l.opts.maxBackups > 0 && len(backups) > l.opts.maxBackups {
+		sort.Slice(backups, func(i, j int) bool {
+			if backups[i].ModTime().Equal(backups[j].ModTime()) {
+				return backups[i].Name() < backups[j].Name()
+			}
+			return backups[i].ModTime().Before(backups[j].ModTime())
+		})
+		expired := len(backups) - l.opts.maxBackups
+		for _, info := range backups[:expired] {
+			if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+				return err
+			}
+		}
+		backups = backups[expired:]
+	}
+	if !l.opts.compress {
+		return nil
+	}
+	for _, info := range backups {
+		if strings.HasSuffix(info.Name(), ".gz") {
+			continue
+		}
+		if err := compressFile(filepath.Join(dir, info.Name()), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 历史文件名格式: base.BACKUP_TIME_FORMAT[.N][.gz], 同目录下其他以base.开头的文件不受影响
+func isBackupName(base, name string) bool {
+	if !strings.HasPrefix(name, base+".") {
+		return false
+	}
+	name = strings.TrimSuffix(name[len(base)+1:], ".gz")
+	if len(name) < len(BACKUP_TIME_FORMAT) {
+		return false
+	}
+	if _, err := time.Parse(BACKUP_TIME_FORMAT, name[:len(BACKUP_TIME_FORMAT)]); err != nil {
+		return false
+	}
+	seq := name[len(BACKUP_TIME_FORMAT):]
+	if seq == "" {
+		return true
+	}
+	if len(seq) < 2 || seq[0] != '.' {
+		return false
+	}
+	_, err := strconv.ParseUint(seq[1:], 10, 32)
+	return err == nil
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// 压缩文件沿用原文件的修改时间, 保证按修改时间清理的顺序不变
+func compressFile(name string, modTime time.Time) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(name+".gz", modTime, modTime)
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
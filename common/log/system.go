@@ -1,93 +1,204 @@
 package log
 
-type LogSystem struct {
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// 可刷新缓冲的logger, 如FileLogger
+type Flusher interface {
+	Flush() error
+}
+
+// 未单独设置等级, 沿用父LogSystem
+const levelInherit = -1
+
+// 同一LogSystem派生出的子LogSystem共享logger
+type logCore struct {
 	logger Logger
-	level  LogLevel
+}
+
+type levelRef struct {
+	level  int64 // 原子读写, levelInherit表示沿用parent
+	parent *levelRef
+}
+
+func (r *levelRef) get() LogLevel {
+	for ; r != nil; r = r.parent {
+		lv := atomic.LoadInt64(&r.level)
+		if lv != levelInherit {
+			return LogLevel(lv)
+		}
+	}
+	return LevelInfo
+}
+
+type LogSystem struct {
+	core   *logCore
+	level  *levelRef // With派生时共享, Fork派生时新建
+	fields string    // With附加的key=value, 追加在每行日志末尾
 }
 
 // SetLogger 设置默认logger
 func (s *LogSystem) SetLogger(logger Logger) {
-	s.logger = logger
+	s.core.logger = logger
 }
 
 func (s *LogSystem) GetLogger() Logger {
-	return s.logger
+	return s.core.logger
 }
 
+// 支持运行时并发修改. 对Fork派生的LogSystem只影响自身及其派生
 func (s *LogSystem) SetLevel(level LogLevel) {
-	s.level = level
+	atomic.StoreInt64(&s.level.level, int64(level))
 }
 
 func (s *LogSystem) GetLevel() LogLevel {
-	return s.level
+	return s.level.get()
+}
+
+// 取消SetLevel设置的独立等级, 恢复沿用父LogSystem的等级. 对根LogSystem无效
+func (s *LogSystem) ResetLevel() {
+	if s.level.parent != nil {
+		atomic.StoreInt64(&s.level.level, levelInherit)
+	}
+}
+
+// 是否沿用父LogSystem的等级
+func (s *LogSystem) LevelInherited() bool {
+	return s.level.parent != nil && atomic.LoadInt64(&s.level.level) == levelInherit
+}
+
+// 派生可独立设置等级的LogSystem, 共享logger和字段, 未调用SetLevel前沿用当前等级(随之变化)
+func (s *LogSystem) Fork() *LogSystem {
+	return &LogSystem{
+		core:   s.core,
+		level:  &levelRef{level: levelInherit, parent: s.level},
+		fields: s.fields,
+	}
+}
+
+// 派生附带结构化字段的LogSystem, 与当前LogSystem共享等级. kv为交替的key, value, 如: With("service", "lobby", "id", 1).
+// 输出格式: msg key1=value1 key2=value2
+func (s *LogSystem) With(kv ...interface{}) *LogSystem {
+	var b strings.Builder
+	b.WriteString(s.fields)
+	for i := 0; i < len(kv); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(kv[i]))
+		b.WriteByte('=')
+		if i+1 < len(kv) {
+			b.WriteString(formatValue(kv[i+1]))
+		} else {
+			b.WriteString(`""`)
+		}
+	}
+	return &LogSystem{
+		core:   s.core,
+		level:  s.level,
+		fields: b.String(),
+	}
+}
+
+// 刷新logger缓冲, logger未实现Flusher时直接返回
+func (s *LogSystem) Flush() error {
+	if f, ok := s.core.logger.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func formatValue(v interface{}) string {
+	str := fmt.Sprint(v)
+	if str == "" || strings.ContainsAny(str, " =\"\t\r\n") {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+func (s *LogSystem) output(lv LogLevel, args ...interface{}) {
+	if s.fields == "" {
+		s.core.logger.Log(lv, args...)
+		return
+	}
+	s.core.logger.Logf(lv, "%s%s", fmt.Sprint(args...), s.fields)
+}
+
+func (s *LogSystem) outputf(lv LogLevel, format string, args ...interface{}) {
+	if s.fields == "" {
+		s.core.logger.Logf(lv, format, args...)
+		return
+	}
+	s.core.logger.Logf(lv, "%s%s", fmt.Sprintf(format, args...), s.fields)
 }
 
 func (s *LogSystem) Debug(args ...interface{}) {
-	if s.level > LevelDebug {
+	if s.GetLevel() > LevelDebug {
 		return
 	}
-	s.logger.Log(LevelDebug, args...)
+	s.output(LevelDebug, args...)
 }
 
 func (s *LogSystem) Debugf(format string, args ...interface{}) {
-	if s.level > LevelDebug {
+	if s.GetLevel() > LevelDebug {
 		return
 	}
-	s.logger.Logf(LevelDebug, format, args...)
+	s.outputf(LevelDebug, format, args...)
 }
 
 func (s *LogSystem) Info(args ...interface{}) {
-	if s.level > LevelInfo {
+	if s.GetLevel() > LevelInfo {
 		return
 	}
-	s.logger.Log(LevelInfo, args...)
+	s.output(LevelInfo, args...)
 }
 
 func (s *LogSystem) Infof(format string, args ...interface{}) {
-	if s.level > LevelInfo {
+	if s.GetLevel() > LevelInfo {
 		return
 	}
-	s.logger.Logf(LevelInfo, format, args...)
+	s.outputf(LevelInfo, format, args...)
 }
 
 func (s *LogSystem) Warning(args ...interface{}) {
-	if s.level > LevelWarning {
+	if s.GetLevel() > LevelWarning {
 		return
 	}
-	s.logger.Log(LevelWarning, args...)
+	s.output(LevelWarning, args...)
 }
 
 func (s *LogSystem) Warningf(format string, args ...interface{}) {
-	if s.level > LevelWarning {
+	if s.GetLevel() > LevelWarning {
 		return
 	}
-	s.logger.Logf(LevelWarning, format, args...)
+	s.outputf(LevelWarning, format, args...)
 }
 
 func (s *LogSystem) Error(args ...interface{}) {
-	if s.level > LevelError {
+	if s.GetLevel() > LevelError {
 		return
 	}
-	s.logger.Log(LevelError, args...)
+	s.output(LevelError, args...)
 }
 
 func (s *LogSystem) Errorf(format string, args ...interface{}) {
-	if s.level > LevelError {
+	if s.GetLevel() > LevelError {
 		return
 	}
-	s.logger.Logf(LevelError, format, args...)
+	s.outputf(LevelError, format, args...)
 }
 
 func NewLogSystem(logger Logger, level LogLevel) *LogSystem {
 	return &LogSystem{
-		logger: logger,
-		level:  level,
+		core: &logCore{
+			logger: logger,
+		},
+		level: &levelRef{level: int64(level)},
 	}
 }
 
 func NewStdLogSystem(level LogLevel) *LogSystem {
-	return &LogSystem{
-		logger: &LoggerStd{},
-		level:  level,
-	}
+	return NewLogSystem(&LoggerStd{}, level)
 }
@@ -18,7 +18,7 @@ func NewDialer(address string, newReceiver func() Receiver, opts ...DialOption)
 		opts:        defaultDialOptions(),
 		address:     address,
 		newReceiver: newReceiver,
-		transport:   &Transport{state: Idle},
+		transport:   &Transport{state: int32(Idle)},
 	}
 	//处理参数
 	for _, opt := range opts {
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/xingshuo/saber/common/lib"
 )
@@ -21,6 +22,7 @@ type Conn struct {
 	waiting         chan struct{}
 	close           *lib.SyncEvent
 	consumerWaiting bool
+	closing         bool // 写缓冲发送完后关闭
 }
 
 func (c *Conn) Init(conn net.Conn, r Receiver) error {
@@ -58,7 +60,11 @@ func (c *Conn) loopRead() error {
 		}
 		for {
 			rn, err := c.receiver.OnMessage(c, c.rbuff.Bytes())
-			if err != nil { //业务层消息异常不应该引起网络连接断开
+			if err != nil {
+				if rn <= 0 { //字节流无法继续解析, 断开连接
+					return err
+				}
+				//业务层消息异常不应该引起网络连接断开
 				log.Printf("tcp conn %p on message err:%v\n", c, err)
 			}
 			if rn > 0 {
@@ -105,6 +111,11 @@ func (c *Conn) loopWrite() error {
 		}
 	waitdata:
 		c.mu.Lock()
+		if c.closing {
+			c.mu.Unlock()
+			c.Close()
+			return nil
+		}
 		c.consumerWaiting = true
 		c.mu.Unlock()
 		select {
@@ -142,6 +153,24 @@ func (c *Conn) Close() error { //主动关闭调用
 	return fmt.Errorf("repeat close")
 }
 
+// 等待写缓冲发送完后关闭, 超时后直接关闭
+func (c *Conn) GracefulClose(timeout time.Duration) {
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+	select {
+	case c.waiting <- struct{}{}:
+	default:
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.close.Done():
+	case <-timer.C:
+		c.Close()
+	}
+}
+
 func (c *Conn) Done() <-chan struct{} {
 	return c.close.Done()
 }
@@ -16,8 +16,9 @@ type Receiver interface {
 	//连接建立后
 	OnConnected(s Sender) error
 
-	//接收流消息,返回已经处理的n个字节流和异常信息,发生异常会关闭连接
+	//接收流消息,返回已经处理的n个字节流和异常信息
 	//当返回n > 0,Conn会主动Pop掉n字节的缓存,接口内部无需处理
+	//返回异常且n == 0时表示字节流已无法继续解析(如包长超限),Conn会关闭连接
 	OnMessage(s Sender, b []byte) (n int, err error)
 
 	//连接断开前
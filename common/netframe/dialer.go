@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,6 +15,7 @@ var (
 
 const (
 	MAX_DIAL_TIMEOUT_SEC = 20
+	SHUTDOWN_FLUSH_MS    = 1000 // 关闭时等待已发出的包写完的最长时间
 )
 
 // 基于Tcp向指定目标地址发包流程封装
@@ -52,42 +54,50 @@ const (
 
 type Transport struct {
 	conn  *Conn
-	state State
+	state int32 // State, rwMu保护下修改, 可无锁读取
 	rwMu  sync.Mutex
 }
 
+func (t *Transport) setState(state State) {
+	atomic.StoreInt32(&t.state, int32(state))
+}
+
+func (t *Transport) getState() State {
+	return State(atomic.LoadInt32(&t.state))
+}
+
 func (t *Transport) get_connection(d *Dialer) (*Conn, error) {
 	t.rwMu.Lock()
 	defer t.rwMu.Unlock()
-	if t.state == Ready {
+	if t.getState() == Ready {
 		return t.conn, nil
 	}
-	if t.state == Shutdown {
+	if t.getState() == Shutdown {
 		return nil, ErrClosed
 	}
 	timeoutSec := d.opts.dialTimeout
 	if timeoutSec <= 0 {
 		timeoutSec = MAX_DIAL_TIMEOUT_SEC
 	}
-	t.state = Connecting
+	t.setState(Connecting)
 	rawConn, err := net.DialTimeout("tcp", d.address, time.Duration(timeoutSec)*time.Second)
 	if err != nil {
-		t.state = TransientFailure
+		t.setState(TransientFailure)
 		return nil, err
 	}
 	t.conn = &Conn{rawConn: rawConn}
 	err = t.conn.Init(rawConn, d.newReceiver())
 	if err != nil {
-		t.state = TransientFailure
+		t.setState(TransientFailure)
 		return nil, err
 	}
-	t.state = Ready
+	t.setState(Ready)
 	go func() {
 		err := t.conn.loopRead()
 		if err != nil {
 			t.rwMu.Lock()
 			t.conn.Close()
-			t.state = TransientFailure
+			t.setState(TransientFailure)
 			t.rwMu.Unlock()
 			log.Printf("loop read err:%v", err)
 		}
@@ -97,7 +107,7 @@ func (t *Transport) get_connection(d *Dialer) (*Conn, error) {
 		if err != nil {
 			t.rwMu.Lock()
 			t.conn.Close()
-			t.state = TransientFailure
+			t.setState(TransientFailure)
 			t.rwMu.Unlock()
 			log.Printf("loop write err:%v", err)
 		}
@@ -105,15 +115,18 @@ func (t *Transport) get_connection(d *Dialer) (*Conn, error) {
 	return t.conn, nil
 }
 
+// 不再接受新的发包, 已发出的包写完后关闭连接
 func (t *Transport) shutdown() error {
 	t.rwMu.Lock()
-	defer t.rwMu.Unlock()
-	if t.state == Shutdown {
+	if t.getState() == Shutdown {
+		t.rwMu.Unlock()
 		return fmt.Errorf("already shutdown")
 	}
-	t.state = Shutdown
-	if t.conn != nil {
-		t.conn.Close()
+	t.setState(Shutdown)
+	conn := t.conn
+	t.rwMu.Unlock()
+	if conn != nil {
+		conn.GracefulClose(SHUTDOWN_FLUSH_MS * time.Millisecond)
 	}
 	return nil
 }
@@ -125,7 +138,7 @@ type Dialer struct {
 	transport   *Transport
 }
 
-//外部调用接口
+// 外部调用接口
 func (d *Dialer) Start() error {
 	_, err := d.transport.get_connection(d)
 	return err
@@ -135,6 +148,15 @@ func (d *Dialer) Shutdown() error {
 	return d.transport.shutdown()
 }
 
+// 当前连接状态, 拨号过程中不阻塞
+func (d *Dialer) State() State {
+	return d.transport.getState()
+}
+
+func (d *Dialer) Address() string {
+	return d.address
+}
+
 func (d *Dialer) Send(b []byte) error {
 	conn, err := d.transport.get_connection(d)
 	if err != nil {
@@ -88,11 +88,12 @@ func (l *Listener) handleRawConn(rawConn net.Conn) {
 
 //以下为对外提供接口
 func (l *Listener) Serve() error {
+	l.mu.Lock()
+	// 已调用GracefulStop, 不再监听. 需在锁内判断, 避免与GracefulStop交错导致监听无法关闭
 	if l.quit.HasFired() {
-		err := fmt.Errorf("serve repeated.")
-		return err
+		l.mu.Unlock()
+		return nil
 	}
-	l.mu.Lock()
 	if l.lis != nil {
 		l.mu.Unlock()
 		err := fmt.Errorf("serve repeated.")
@@ -0,0 +1,123 @@
+// OpenTelemetry适配: 将OpenTelemetry的trace.Tracer包装为saber.Tracer, 通过Server.SetTracer接入,
+// span由业务方配置的TracerProvider创建和导出. 独立module, 不接入时saber不依赖OpenTelemetry
+package saberotel
+
+import (
+	"context"
+	"fmt"
+
+	saber "github.com/xingshuo/saber/pkg"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// 如: saberotel.NewTracer(otel.Tracer("saber")), 跨节点使用W3C traceparent传播
+func NewTracer(t trace.Tracer) *Tracer {
+	return &Tracer{tracer: t}
+}
+
+// 父节点取ctx中的OpenTelemetry span, handler中通过OpenTelemetry API创建的span同样可作为父节点
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind saber.SpanKind) (context.Context, saber.Span) {
+	ctx, span := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKind(kind)))
+	s := &otelSpan{span: span}
+	return saber.ContextWithSpan(ctx, s), s
+}
+
+func (t *Tracer) Inject(ctx context.Context, md saber.Metadata) saber.Metadata {
+	sc := fromOtel(trace.SpanContextFromContext(ctx))
+	if !sc.IsValid() {
+		return md
+	}
+	c := md.Copy()
+	c[saber.TRACEPARENT_KEY] = saber.FormatTraceparent(sc)
+	return c
+}
+
+func (t *Tracer) Extract(ctx context.Context, md saber.Metadata) context.Context {
+	sc, ok := saber.ParseTraceparent(md[saber.TRACEPARENT_KEY])
+	if !ok {
+		return ctx
+	}
+	ctx = trace.ContextWithRemoteSpanContext(ctx, toOtel(sc))
+	return saber.ContextWithSpan(ctx, remoteSpan{sc: sc})
+}
+
+func fromOtel(sc trace.SpanContext) saber.SpanContext {
+	return saber.SpanContext{
+		TraceID: saber.TraceID(sc.TraceID()),
+		SpanID:  saber.SpanID(sc.SpanID()),
+		Flags:   byte(sc.TraceFlags()),
+		Remote:  sc.IsRemote(),
+	}
+}
+
+func toOtel(sc saber.SpanContext) trace.SpanContext {
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID(sc.TraceID),
+		SpanID:     trace.SpanID(sc.SpanID),
+		TraceFlags: trace.TraceFlags(sc.Flags),
+		Remote:     sc.Remote,
+	})
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s *otelSpan) SpanContext() saber.SpanContext {
+	return fromOtel(s.span.SpanContext())
+}
+
+func (s *otelSpan) SetAttribute(key string, value interface{}) {
+	s.span.SetAttributes(toAttribute(key, value))
+}
+
+func (s *otelSpan) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *otelSpan) End() {
+	s.span.End()
+}
+
+// 调用方span, 只用于Extract后作为父节点
+type remoteSpan struct {
+	sc saber.SpanContext
+}
+
+func (s remoteSpan) SpanContext() saber.SpanContext             { return s.sc }
+func (s remoteSpan) SetAttribute(key string, value interface{}) {}
+func (s remoteSpan) SetError(err error)                         {}
+func (s remoteSpan) End()                                       {}
+
+func toAttribute(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case uint32:
+		return attribute.Int64(key, int64(v))
+	case float64:
+		return attribute.Float64(key, v)
+	case []string:
+		return attribute.StringSlice(key, v)
+	case fmt.Stringer:
+		return attribute.String(key, v.String())
+	default:
+		return attribute.String(key, fmt.Sprint(v))
+	}
+}
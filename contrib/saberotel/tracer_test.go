@@ -0,0 +1,110 @@
+package saberotel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	saber "github.com/xingshuo/saber/pkg"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newTestServer(t *testing.T, clusterName string) *saber.Server {
+	data, err := json.Marshal(&saber.ServerConfig{
+		ClusterName:    clusterName,
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	assert.Nil(t, err)
+	f, err := ioutil.TempFile("", "saber_config_*.json")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	f.Close()
+	assert.Nil(t, err)
+	s, err := saber.NewServer(f.Name())
+	assert.Nil(t, err)
+	return s
+}
+
+func findSpan(spans tracetest.SpanStubs, name string, kind trace.SpanKind) *tracetest.SpanStub {
+	for i := range spans {
+		if spans[i].Name == name && spans[i].SpanKind == kind {
+			return &spans[i]
+		}
+	}
+	return nil
+}
+
+// 业务方的OpenTelemetry span -> client -> lobby, 整条链路属于同一trace
+func TestTracer(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+	s := newTestServer(t, "test_otel")
+	defer s.Exit()
+	s.SetTracer(NewTracer(tp.Tracer("saber")))
+
+	lobby, err := s.NewService("lobby", 1)
+	assert.Nil(t, err)
+	lobby.RegisterSvcHandler("Login", func(ctx context.Context, req interface{}) (interface{}, error) {
+		saber.SpanFromCtx(ctx).SetAttribute("player", req)
+		// handler中可继续使用OpenTelemetry API
+		_, span := tp.Tracer("biz").Start(ctx, "LoadPlayer")
+		span.End()
+		return nil, saber.NewError(saber.ErrCode_Usr+1, "banned")
+	})
+	client, err := s.NewServiceWithOptions("client", 1, saber.WithParallel(1))
+	assert.Nil(t, err)
+
+	ctx, root := tp.Tracer("biz").Start(context.Background(), "Request")
+	_, err = client.Call(ctx, "lobby", 1, "Login", "lilei")
+	root.End()
+	assert.NotNil(t, err)
+
+	spans := exporter.GetSpans()
+	clientSpan := findSpan(spans, "Login", trace.SpanKindClient)
+	serverSpan := findSpan(spans, "Login", trace.SpanKindServer)
+	bizSpan := findSpan(spans, "LoadPlayer", trace.SpanKindInternal)
+	if !assert.NotNil(t, clientSpan) || !assert.NotNil(t, serverSpan) || !assert.NotNil(t, bizSpan) {
+		return
+	}
+	traceID := root.SpanContext().TraceID()
+	assert.Equal(t, traceID, clientSpan.SpanContext.TraceID())
+	assert.Equal(t, traceID, serverSpan.SpanContext.TraceID())
+	assert.Equal(t, traceID, bizSpan.SpanContext.TraceID())
+	assert.Equal(t, root.SpanContext().SpanID(), clientSpan.Parent.SpanID())
+	assert.Equal(t, clientSpan.SpanContext.SpanID(), serverSpan.Parent.SpanID())
+	assert.Equal(t, serverSpan.SpanContext.SpanID(), bizSpan.Parent.SpanID())
+	assert.Contains(t, serverSpan.Attributes, toAttribute("player", "lilei"))
+	assert.Contains(t, serverSpan.Attributes, toAttribute("rpc.method", "Login"))
+	assert.Equal(t, codes.Error, serverSpan.Status.Code)
+	assert.Contains(t, serverSpan.Status.Description, "banned")
+}
+
+func TestPropagation(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	defer tp.Shutdown(context.Background())
+	tracer := NewTracer(tp.Tracer("saber"))
+	ctx, span := tracer.StartSpan(context.Background(), "Say", saber.SPAN_KIND_CLIENT)
+	defer span.End()
+	md := tracer.Inject(ctx, saber.Metadata{"uid": "1"})
+	assert.Equal(t, saber.FormatTraceparent(span.SpanContext()), md[saber.TRACEPARENT_KEY])
+	assert.Equal(t, "1", md["uid"])
+
+	remote := trace.SpanContextFromContext(tracer.Extract(context.Background(), md))
+	assert.True(t, remote.IsRemote())
+	assert.Equal(t, span.SpanContext().TraceID, saber.TraceID(remote.TraceID()))
+	assert.Equal(t, span.SpanContext().SpanID, saber.SpanID(remote.SpanID()))
+	// 没有span时不写入
+	md = tracer.Inject(context.Background(), saber.Metadata{})
+	assert.Equal(t, 0, len(md))
+	span.SetError(errors.New("boom"))
+}
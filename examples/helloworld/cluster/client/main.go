@@ -2,11 +2,9 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"syscall"
 
-	"github.com/goinggo/mapstructure"
 	saber "github.com/xingshuo/saber/pkg"
 )
 
@@ -32,24 +30,25 @@ func main() {
 	if err != nil {
 		log.Fatalf("new gate service err:%v", err)
 	}
-	gateSvc.RegisterSvcHandler("HeartBeat", func(ctx context.Context, req interface{}) (interface{}, error) {
+	err = gateSvc.RegisterTypedHandler("HeartBeat", func(ctx context.Context, hb *HeartBeat) (*HeartBeat, error) {
 		// svc := saber.GetSvcFromCtx(ctx)
-		hb := &HeartBeat{}
-		err := mapstructure.Decode(req, hb)
-		if err != nil {
-			return nil, fmt.Errorf("proto error %w", err)
-		}
 		log.Printf("recv heartbeat session %d\n", hb.Session)
 		return nil, nil
 	})
+	if err != nil {
+		log.Fatalf("register gate handler err:%v", err)
+	}
+	// 跨节点rpc回包按注册类型解码
+	err = server.RegisterMsgType(saber.MSG_TYPE_CLUSTER_RSP, "ReqLogin", (*RspLogin)(nil))
+	if err != nil {
+		log.Fatalf("register msg type err:%v", err)
+	}
 	rsp, err := gateSvc.CallCluster(context.Background(), "cluster_server", "lobby", 1, "ReqLogin", &ReqLogin{
 		Gid:  101,
 		Name: "lilei",
 	})
 	if err == nil {
-		reply := &RspLogin{}
-		mapstructure.Decode(rsp, reply)
-		log.Printf("rpc result: %d\n", reply.Status)
+		log.Printf("rpc result: %d\n", rsp.(*RspLogin).Status)
 	} else {
 		log.Printf("rpc err: %v\n", err)
 	}
@@ -2,11 +2,9 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"syscall"
 
-	"github.com/goinggo/mapstructure"
 	saber "github.com/xingshuo/saber/pkg"
 )
 
@@ -33,12 +31,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("new lobby service err:%v", err)
 	}
-	lobbySvc.RegisterSvcHandler("ReqLogin", func(ctx context.Context, req interface{}) (interface{}, error) {
-		msg := &ReqLogin{}
-		err := mapstructure.Decode(req, msg)
-		if err != nil {
-			return nil, fmt.Errorf("proto error %w", err)
-		}
+	err = lobbySvc.RegisterTypedHandler("ReqLogin", func(ctx context.Context, msg *ReqLogin) (*RspLogin, error) {
 		svc := saber.GetSvcFromCtx(ctx)
 		session := 500
 		svc.SendCluster(ctx, "cluster_client", "gate", 1, "HeartBeat", &HeartBeat{Session: session})
@@ -49,5 +42,8 @@ func main() {
 		log.Printf("%s on req login %d", msg.Name, msg.Gid)
 		return &RspLogin{Status: 200}, nil
 	})
+	if err != nil {
+		log.Fatalf("register lobby handler err:%v", err)
+	}
 	server.WaitExit(syscall.SIGINT)
 }
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"syscall"
 
@@ -32,11 +31,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("new lobby service err:%v", err)
 	}
-	lobbySvc.RegisterSvcHandler("ReqLogin", func(ctx context.Context, req interface{}) (rsp interface{}, err error) {
-		msg, ok := req.(*ReqLogin)
-		if !ok {
-			return nil, fmt.Errorf("proto error")
-		}
+	err = lobbySvc.RegisterTypedHandler("ReqLogin", func(ctx context.Context, msg *ReqLogin) (*RspLogin, error) {
 		svc := saber.GetSvcFromCtx(ctx)
 		session := 500
 		svc.Send(ctx, "gate", 1, "HeartBeat", &HeartBeat{Session: session})
@@ -47,19 +42,21 @@ func main() {
 		log.Printf("%s on req login %d", msg.Name, msg.Gid)
 		return &RspLogin{Status: 200}, nil
 	})
+	if err != nil {
+		log.Fatalf("register lobby handler err:%v", err)
+	}
 	gateSvc, err := server.NewService("gate", 1)
 	if err != nil {
 		log.Fatalf("new gate service err:%v", err)
 	}
-	gateSvc.RegisterSvcHandler("HeartBeat", func(ctx context.Context, req interface{}) (rsp interface{}, err error) {
+	err = gateSvc.RegisterTypedHandler("HeartBeat", func(ctx context.Context, hb *HeartBeat) (*HeartBeat, error) {
 		// svc := sbapi.GetSvcFromCtx(ctx)
-		hb, ok := req.(*HeartBeat)
-		if !ok {
-			return nil, fmt.Errorf("proto error")
-		}
 		log.Printf("recv heartbeat session %d\n", hb.Session)
 		return nil, nil
 	})
+	if err != nil {
+		log.Fatalf("register gate handler err:%v", err)
+	}
 	rsp, err := gateSvc.Call(context.Background(), "lobby", 1, "ReqLogin", &ReqLogin{
 		Gid:  101,
 		Name: "lilei",
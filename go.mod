@@ -3,8 +3,8 @@ module github.com/xingshuo/saber
 go 1.13
 
 require (
-	github.com/goinggo/mapstructure v0.0.0-20140717182941-194205d9b4a9
 	github.com/google/uuid v1.1.2
 	github.com/stretchr/testify v1.6.1
 	github.com/xingshuo/kite v0.0.0-20210119150727-8e3640efffeb
+	google.golang.org/protobuf v1.25.0
 )
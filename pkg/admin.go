@@ -0,0 +1,231 @@
+package saber
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"sort"
+	"time"
+)
+
+type TimerStatus struct {
+	Session    uint32    `json:"session"`
+	IntervalMs int64     `json:"interval_ms"`
+	Count      int       `json:"count"` // 剩余执行次数, 0表示无限次
+	NextTime   time.Time `json:"next_time"`
+}
+
+type ServiceStatus struct {
+	Name            string         `json:"name"`
+	ID              uint32         `json:"id"`
+	Handle          SVC_HANDLE     `json:"handle"`
+	Parallel        int            `json:"parallel"` // 真并发模式下的最大并发数, 0表示伪并发
+	MailboxLen      int            `json:"mailbox_len"`
+	MailboxLimit    int            `json:"mailbox_limit"` // 邮箱请求数上限, 0表示不限
+	LogLevel        string         `json:"log_level"`
+	Methods         []string       `json:"methods"`
+	StreamMethods   []string       `json:"stream_methods"`
+	PendingSessions []uint32       `json:"pending_sessions"` // 等待回包的rpc session
+	Timers          []*TimerStatus `json:"timers"`
+}
+
+type ClusterStatus struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	State   string `json:"state"` // 连接状态: IDLE, CONNECTING, READY, TRANSIENT_FAILURE, SHUTDOWN
+}
+
+type ServerStatus struct {
+	ClusterName string           `json:"cluster_name"`
+	LocalAddr   string           `json:"local_addr"`
+	Pid         int              `json:"pid"`
+	Services    []*ServiceStatus `json:"services"`
+	Clusters    []*ClusterStatus `json:"clusters"`
+}
+
+// 节点运行状态快照, 供运维排查
+func (s *Server) Status() *ServerStatus {
+	return &ServerStatus{
+		ClusterName: s.ClusterName(),
+		LocalAddr:   s.config.LocalAddr,
+		Pid:         os.Getpid(),
+		Services:    s.servicesStatus(),
+		Clusters:    s.sidecar.clusterProxy.status(),
+	}
+}
+
+func (s *Server) servicesStatus() []*ServiceStatus {
+	s.rwMu.RLock()
+	svcs := make([]*Service, 0, len(s.services))
+	for _, svc := range s.services {
+		svcs = append(svcs, svc)
+	}
+	s.rwMu.RUnlock()
+	sort.Slice(svcs, func(i, j int) bool {
+		if svcs[i].name != svcs[j].name {
+			return svcs[i].name < svcs[j].name
+		}
+		return svcs[i].instID < svcs[j].instID
+	})
+	timers := s.timerStore.status()
+	status := make([]*ServiceStatus, 0, len(svcs))
+	for _, svc := range svcs {
+		st := svc.status()
+		if list := timers[svc.handle]; list != nil {
+			st.Timers = list
+		}
+		status = append(status, st)
+	}
+	return status
+}
+
+func (s *Service) status() *ServiceStatus {
+	st := &ServiceStatus{
+		Name:            s.name,
+		ID:              s.instID,
+		Handle:          s.handle,
+		Parallel:        s.opts.parallel,
+		MailboxLen:      s.mqueue.Len(),
+		MailboxLimit:    s.opts.mailboxSize,
+		LogLevel:        s.GetLogSystem().GetLevel().String(),
+		PendingSessions: s.sessionStore.pendingSessions(),
+		Timers:          []*TimerStatus{},
+	}
+	methods := make(map[string]bool)
+	s.rwMu.RLock()
+	for method := range s.svcHandlers {
+		methods[method] = true
+	}
+	for method := range s.typeHandlers {
+		methods[method] = true
+	}
+	for method := range s.streamHandlers {
+		st.StreamMethods = append(st.StreamMethods, method)
+	}
+	s.rwMu.RUnlock()
+	st.Methods = make([]string, 0, len(methods))
+	for method := range methods {
+		st.Methods = append(st.Methods, method)
+	}
+	if st.StreamMethods == nil {
+		st.StreamMethods = []string{}
+	}
+	sort.Strings(st.Methods)
+	sort.Strings(st.StreamMethods)
+	return st
+}
+
+func (ss *SessionStore) pendingSessions() []uint32 {
+	ss.mu.Lock()
+	sessions := make([]uint32, 0, len(ss.waitSessions))
+	for session := range ss.waitSessions {
+		sessions = append(sessions, session)
+	}
+	ss.mu.Unlock()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i] < sessions[j]
+	})
+	return sessions
+}
+
+// 按服务分组的定时器
+func (ts *TimeStore) status() map[SVC_HANDLE][]*TimerStatus {
+	timers := make(map[SVC_HANDLE][]*TimerStatus)
+	ts.rwMu.RLock()
+	for seq, t := range ts.timers {
+		if t.expired {
+			continue
+		}
+		timers[seq.handle] = append(timers[seq.handle], &TimerStatus{
+			Session:    t.session,
+			IntervalMs: t.interval,
+			Count:      t.count,
+			NextTime:   time.Unix(0, t.nextTime),
+		})
+	}
+	ts.rwMu.RUnlock()
+	for _, list := range timers {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Session < list[j].Session
+		})
+	}
+	return timers
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// 管理端http handler:
+// /status 节点全量状态, /services 服务列表, /clusters 远端节点连接状态,
+// /metrics Prometheus指标, /loglevel 日志等级, /debug/pprof/ 性能分析
+func NewAdminHandler(s *Server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, s.Status())
+	})
+	mux.HandleFunc("/services", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, s.servicesStatus())
+	})
+	mux.HandleFunc("/clusters", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, s.sidecar.clusterProxy.status())
+	})
+	mux.Handle("/metrics", NewPrometheusHandler(s.metrics))
+	mux.Handle("/loglevel", NewLogLevelHandler(s))
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// 管理端无鉴权, 只有回环地址(127.0.0.1, ::1, localhost)视为安全
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// 按配置AdminAddr启动管理端http服务, 非回环地址需配置AdminRemote
+func (s *Server) startAdmin() error {
+	if !s.config.AdminRemote && !isLoopbackAddr(s.config.AdminAddr) {
+		return ADMIN_ADDR_REMOTE_ERR
+	}
+	l, err := net.Listen("tcp", s.config.AdminAddr)
+	if err != nil {
+		return err
+	}
+	s.adminListener = l
+	s.admin = &http.Server{Handler: NewAdminHandler(s)}
+	go func() {
+		err := s.admin.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			s.log.Errorf("admin serve on %s err:%v", l.Addr(), err)
+		}
+	}()
+	s.log.Infof("cluster %s admin listen on %s", s.ClusterName(), l.Addr())
+	return nil
+}
+
+// 管理端实际监听地址, 未开启时返回空
+func (s *Server) AdminAddr() string {
+	if s.adminListener == nil {
+		return ""
+	}
+	return s.adminListener.Addr().String()
+}
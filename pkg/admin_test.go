@@ -0,0 +1,149 @@
+package saber
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getAdminJson(t *testing.T, s *Server, path string, v interface{}) {
+	rsp, err := http.Get("http://" + s.AdminAddr() + path)
+	assert.Nil(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, "application/json", rsp.Header.Get("Content-Type"))
+	assert.Nil(t, json.NewDecoder(rsp.Body).Decode(v))
+}
+
+func TestAdmin(t *testing.T) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	sa := newTestServer(t, ServerConfig{
+		ClusterName:    "test_admin_a",
+		LocalAddr:      addrA,
+		RemoteAddrs:    map[string]string{"test_admin_b": addrB, "test_admin_c": "127.0.0.1:1"},
+		TickIntervalMs: 10,
+		AdminAddr:      "127.0.0.1:0",
+	})
+	defer sa.Exit()
+	sb := newTestServer(t, ServerConfig{
+		ClusterName:    "test_admin_b",
+		LocalAddr:      addrB,
+		RemoteAddrs:    map[string]string{"test_admin_a": addrA},
+		TickIntervalMs: 10,
+	})
+	defer sb.Exit()
+	assert.NotEqual(t, "", sa.AdminAddr())
+	assert.Equal(t, "", sb.AdminAddr())
+
+	block := make(chan struct{})
+	remote, err := sb.NewService("remote", 1)
+	assert.Nil(t, err)
+	remote.RegisterSvcHandler("Block", func(ctx context.Context, req interface{}) (interface{}, error) {
+		<-block
+		return nil, nil
+	})
+	lobby, err := sa.NewServiceWithOptions("lobby", 1, WithParallel(2))
+	assert.Nil(t, err)
+	lobby.RegisterSvcHandler("Login", func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	lobby.RegisterStreamHandler("Upload", func(ctx context.Context, st *Stream) error {
+		return nil
+	})
+	timer := lobby.RegisterTimer(func() {}, 60000, 3)
+	called := make(chan error, 1)
+	go func() {
+		_, err := lobby.CallCluster(context.Background(), "test_admin_b", "remote", 1, "Block", nil)
+		called <- err
+	}()
+
+	var status ServerStatus
+	// 等待rpc发出
+	for i := 0; i < 100; i++ {
+		status = ServerStatus{}
+		getAdminJson(t, sa, "/status", &status)
+		if len(status.Services[0].PendingSessions) > 0 && status.Clusters[0].State == "READY" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "test_admin_a", status.ClusterName)
+	assert.Equal(t, addrA, status.LocalAddr)
+	assert.Equal(t, 1, len(status.Services))
+	st := status.Services[0]
+	assert.Equal(t, "lobby", st.Name)
+	assert.Equal(t, lobby.handle, st.Handle)
+	assert.Equal(t, 2, st.Parallel)
+	assert.Equal(t, "INFO", st.LogLevel)
+	assert.Equal(t, []string{"Login"}, st.Methods)
+	assert.Equal(t, []string{"Upload"}, st.StreamMethods)
+	assert.Equal(t, 1, len(st.PendingSessions))
+	assert.Equal(t, 1, len(st.Timers))
+	assert.Equal(t, timer, st.Timers[0].Session)
+	assert.Equal(t, int64(60000), st.Timers[0].IntervalMs)
+	assert.Equal(t, 3, st.Timers[0].Count)
+	assert.Equal(t, []*ClusterStatus{
+		{Name: "test_admin_b", Address: addrB, State: "READY"},
+		{Name: "test_admin_c", Address: "127.0.0.1:1", State: "IDLE"},
+	}, status.Clusters)
+
+	close(block)
+	assert.Nil(t, <-called)
+	var services []*ServiceStatus
+	getAdminJson(t, sa, "/services", &services)
+	assert.Equal(t, 0, len(services[0].PendingSessions))
+	var clusters []*ClusterStatus
+	getAdminJson(t, sa, "/clusters", &clusters)
+	assert.Equal(t, status.Clusters, clusters)
+
+	for _, path := range []string{"/metrics", "/loglevel", "/debug/pprof/", "/debug/pprof/goroutine?debug=1"} {
+		rsp, err := http.Get("http://" + sa.AdminAddr() + path)
+		assert.Nil(t, err)
+		_, err = ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, rsp.StatusCode, path)
+	}
+}
+
+// 管理端无鉴权, 默认只允许监听回环地址
+func TestAdminRemote(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"127.0.0.1:0": true,
+		"[::1]:0":     true,
+		"localhost:0": true,
+		":0":          false,
+		"0.0.0.0:0":   false,
+		"10.0.0.1:0":  false,
+		"127.0.0.1":   false,
+	} {
+		assert.Equal(t, ok, isLoopbackAddr(addr), addr)
+	}
+
+	f, err := ioutil.TempFile("", "saber_config_*.json")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	config := ServerConfig{
+		ClusterName:    "test_admin_remote",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+		AdminAddr:      "0.0.0.0:0",
+	}
+	writeTestConfig(t, f.Name(), config)
+	s := &Server{}
+	assert.Equal(t, ADMIN_ADDR_REMOTE_ERR, s.Init(f.Name()))
+
+	config.AdminRemote = true
+	writeTestConfig(t, f.Name(), config)
+	s = &Server{}
+	assert.Nil(t, s.Init(f.Name()))
+	defer s.Exit()
+	assert.NotEqual(t, "", s.AdminAddr())
+}
@@ -3,13 +3,30 @@ package saber
 import (
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"math"
 	"reflect"
+	"sync"
+	"time"
+	"unicode/utf8"
 	"unsafe"
 )
 
 //协议格式: 4字节包头长度 + 内容
 const PkgHeadLen = 4
 
+// 内容格式:
+// 旧版本: 1字节msgType + head + body
+// 新版本: 1字节msgType|WIRE_VERSIONED_MASK + 1字节version + 1字节flags + 2字节headLen + head + [metadata] + body
+// head中新增字段只能追加在尾部, 解析时跳过未识别部分
+const (
+	WIRE_VERSION_LEGACY uint8 = 0
+	WIRE_VERSION        uint8 = 1
+	WIRE_VERSIONED_MASK uint8 = 0x80
+	WIRE_PREFIX_LEN           = 5
+	WIRE_FLAG_METADATA  uint8 = 1 << 0
+)
+
 // 用户数据编解码器
 type Codec interface {
 	Marshal(msgType MsgType, method string, v interface{}) ([]byte, error)
@@ -17,14 +34,20 @@ type Codec interface {
 }
 
 type JsonCodec struct {
+	Registry *MsgRegistry // 可选, 命中注册类型时直接解码为具体结构
 }
 
 func (c *JsonCodec) Marshal(msgType MsgType, method string, v interface{}) ([]byte, error) {
 	return json.Marshal(v)
 }
 
-// reflect.TypeOf(v) : map[string]interface{}
+// 未注册类型时 reflect.TypeOf(v) : map[string]interface{}
 func (c *JsonCodec) Unmarshal(msgType MsgType, method string, data []byte) (interface{}, error) {
+	if c.Registry != nil {
+		if t := c.Registry.Lookup(msgType, method); t != nil {
+			return decodeAs(t, data, json.Unmarshal)
+		}
+	}
 	var v interface{}
 	err := json.Unmarshal(data, &v)
 	if err != nil {
@@ -35,6 +58,7 @@ func (c *JsonCodec) Unmarshal(msgType MsgType, method string, data []byte) (inte
 
 var CLUSTER_REQ_HEAD_LEN = int(new(ClusterReqHead).Size())
 var CLUSTER_RSP_HEAD_LEN = int(new(ClusterRspHead).Size())
+var CLUSTER_STREAM_HEAD_LEN = int(new(ClusterStreamHead).Size())
 
 type ClusterBaseHead struct {
 	source      uint64
@@ -138,16 +162,64 @@ func (h *ClusterBaseHead) Size() uintptr {
 
 type ClusterReqHead struct {
 	ClusterBaseHead
+	timeout uint32 // 发出时剩余超时:毫秒, 0表示不限
+}
+
+func (h *ClusterReqHead) Init(source SVC_HANDLE, session uint32, destination SVC_HANDLE, method string, timeout uint32) error {
+	h.timeout = timeout
+	return h.ClusterBaseHead.Init(source, session, destination, method)
+}
+
+// 剩余超时, 0表示不限
+func (h *ClusterReqHead) Timeout() time.Duration {
+	return time.Duration(h.timeout) * time.Millisecond
 }
 
 func (h *ClusterReqHead) Pack(b []byte) (uintptr, error) {
 	// 检查buffer够不够上限,上限会比实际需要用到的多,序列化时buffer一般会足够大
+	if len(b) < CLUSTER_REQ_HEAD_LEN {
+		return 0, PACK_BUFFER_SHORT_ERR
+	}
+	pos, err := h.ClusterBaseHead.Pack(b)
+	if err != nil {
+		return pos, err
+	}
+	binary.BigEndian.PutUint32(b[pos:], h.timeout)
+	pos = pos + unsafe.Sizeof(h.timeout)
+	return pos, nil
+}
+
+// 旧版本请求头不携带timeout
+func (h *ClusterReqHead) PackLegacy(b []byte) (uintptr, error) {
 	if len(b) < CLUSTER_REQ_HEAD_LEN {
 		return 0, PACK_BUFFER_SHORT_ERR
 	}
 	return h.ClusterBaseHead.Pack(b)
 }
 
+func (h *ClusterReqHead) UnpackLegacy(b []byte) (uintptr, error) {
+	h.timeout = 0
+	return h.ClusterBaseHead.Unpack(b)
+}
+
+func (h *ClusterReqHead) Unpack(b []byte) (uintptr, error) {
+	pos, err := h.ClusterBaseHead.Unpack(b)
+	if err != nil {
+		return pos, err
+	}
+	nextPos := pos + unsafe.Sizeof(h.timeout)
+	if len(b) < int(nextPos) {
+		return pos, PACK_BUFFER_SHORT_ERR
+	}
+	h.timeout = binary.BigEndian.Uint32(b[pos:])
+	pos = nextPos
+	return pos, nil
+}
+
+func (h *ClusterReqHead) Size() uintptr {
+	return unsafe.Sizeof(h.timeout) + h.ClusterBaseHead.Size()
+}
+
 type ClusterRspHead struct {
 	ClusterBaseHead
 	errCode uint32
@@ -226,28 +298,191 @@ func (h *ClusterRspHead) Size() uintptr {
 	return size + h.ClusterBaseHead.Size()
 }
 
-func NetPackRequest(buffer []byte, cc Codec, source SVC_HANDLE, session uint32, destination SVC_HANDLE, method string, req interface{}) ([]byte, error) {
-	if PkgHeadLen+1 > len(buffer) {
-		return nil, PACK_BUFFER_SHORT_ERR
+// 流帧包头, session为streamID, method仅OPEN帧携带
+type ClusterStreamHead struct {
+	ClusterBaseHead
+	flags  uint8
+	arg    uint32 // WINDOW: 窗口增量, CLOSE: 错误码
+	emLen  uint8
+	errMsg [ERR_MSG_MAX_LEN]byte
+}
+
+func (h *ClusterStreamHead) Init(source SVC_HANDLE, streamID uint32, destination SVC_HANDLE, method string, flags uint8, arg uint32, errMsg string) error {
+	if len(errMsg) > ERR_MSG_MAX_LEN {
+		return ERR_MSG_LEN_OVER
+	}
+	h.flags = flags
+	h.arg = arg
+	h.emLen = uint8(len(errMsg))
+	copy(h.errMsg[:], errMsg)
+	return h.ClusterBaseHead.Init(source, streamID, destination, method)
+}
+
+func (h *ClusterStreamHead) ErrMsg() string {
+	return string(h.errMsg[:h.emLen])
+}
+
+func (h *ClusterStreamHead) Pack(b []byte) (uintptr, error) {
+	if len(b) < CLUSTER_STREAM_HEAD_LEN {
+		return 0, PACK_BUFFER_SHORT_ERR
+	}
+	pos, err := h.ClusterBaseHead.Pack(b)
+	if err != nil {
+		return pos, err
+	}
+	b[pos] = h.flags
+	pos = pos + unsafe.Sizeof(h.flags)
+	binary.BigEndian.PutUint32(b[pos:], h.arg)
+	pos = pos + unsafe.Sizeof(h.arg)
+	b[pos] = h.emLen
+	pos = pos + unsafe.Sizeof(h.emLen)
+	copy(b[pos:], h.errMsg[:h.emLen])
+	pos = pos + uintptr(h.emLen)
+	return pos, nil
+}
+
+func (h *ClusterStreamHead) Unpack(b []byte) (uintptr, error) {
+	pos, err := h.ClusterBaseHead.Unpack(b)
+	if err != nil {
+		return pos, err
+	}
+	nextPos := pos + unsafe.Sizeof(h.flags) + unsafe.Sizeof(h.arg) + unsafe.Sizeof(h.emLen)
+	if len(b) < int(nextPos) {
+		return pos, PACK_BUFFER_SHORT_ERR
+	}
+	h.flags = b[pos]
+	pos = pos + unsafe.Sizeof(h.flags)
+	h.arg = binary.BigEndian.Uint32(b[pos:])
+	pos = pos + unsafe.Sizeof(h.arg)
+	h.emLen = b[pos]
+	pos = pos + unsafe.Sizeof(h.emLen)
+	nextPos = pos + uintptr(h.emLen)
+	if len(b) < int(nextPos) {
+		return pos, PACK_BUFFER_SHORT_ERR
+	}
+	copy(h.errMsg[:], b[pos:nextPos])
+	pos = nextPos
+	return pos, nil
+}
+
+func (h *ClusterStreamHead) Size() uintptr {
+	size := unsafe.Sizeof(h.flags) + unsafe.Sizeof(h.arg) + unsafe.Sizeof(h.emLen) + unsafe.Sizeof(h.errMsg)
+	return size + h.ClusterBaseHead.Size()
+}
+
+// 写入帧前缀, 返回head起始位置
+// 旧版本: 1字节msgType
+// 新版本: 1字节msgType|WIRE_VERSIONED_MASK + 1字节version + 1字节flags + 2字节headLen
+func packFramePrefix(buffer []byte, msgType MsgType, version uint8, flags uint8) (int, error) {
+	if version == WIRE_VERSION_LEGACY {
+		if PkgHeadLen+1 > len(buffer) {
+			return 0, PACK_BUFFER_SHORT_ERR
+		}
+		buffer[PkgHeadLen] = uint8(msgType)
+		return PkgHeadLen + 1, nil
+	}
+	if PkgHeadLen+WIRE_PREFIX_LEN > len(buffer) {
+		return 0, PACK_BUFFER_SHORT_ERR
+	}
+	buffer[PkgHeadLen] = uint8(msgType) | WIRE_VERSIONED_MASK
+	buffer[PkgHeadLen+1] = version
+	buffer[PkgHeadLen+2] = flags
+	return PkgHeadLen + WIRE_PREFIX_LEN, nil
+}
+
+// 回填headLen, 旧版本无需回填
+func packHeadLen(buffer []byte, version uint8, hsize uintptr) error {
+	if version == WIRE_VERSION_LEGACY {
+		return nil
+	}
+	if hsize > math.MaxUint16 {
+		return WIRE_HEAD_LEN_OVER_ERR
+	}
+	binary.BigEndian.PutUint16(buffer[PkgHeadLen+3:], uint16(hsize))
+	return nil
+}
+
+// 打包缓冲区池: 每次打包独占一个缓冲区, Conn.Send拷贝完成后归还, 避免并发打包相互覆盖
+var packBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, PACK_BUFFER_SIZE)
+		return &b
+	},
+}
+
+func getPackBuffer() *[]byte {
+	return packBufferPool.Get().(*[]byte)
+}
+
+// data为本次打包结果, 打包时扩容过则保留扩容后的空间
+func putPackBuffer(b *[]byte, data []byte) {
+	if cap(data) > cap(*b) {
+		*b = data[:cap(data)]
+	}
+	if cap(*b) > PACK_BUFFER_POOL_MAX {
+		return
+	}
+	packBufferPool.Put(b)
+}
+
+// 保证buffer长度不小于n, 不足时重新分配(尚未写入内容, 无需拷贝)
+func growBuffer(buffer []byte, n int) []byte {
+	if len(buffer) >= n {
+		return buffer
+	}
+	if cap(buffer) >= n {
+		return buffer[:n]
+	}
+	return make([]byte, n)
+}
+
+// 打包结果可能不在buffer上: 空间不足时会重新分配, 调用方应使用返回值
+// version: 协议版本, 旧版本不携带timeout和metadata
+// timeout: 请求剩余超时, <= 0表示不限, 按毫秒向上取整
+func NetPackRequest(buffer []byte, cc Codec, version uint8, source SVC_HANDLE, session uint32, destination SVC_HANDLE, method string, req interface{}, timeout time.Duration, md Metadata) ([]byte, error) {
+	var flags uint8
+	if version != WIRE_VERSION_LEGACY && len(md) > 0 {
+		flags |= WIRE_FLAG_METADATA
 	}
-	buffer[PkgHeadLen] = uint8(MSG_TYPE_CLUSTER_REQ)
 	head := &ClusterReqHead{}
-	err := head.Init(source, session, destination, method)
+	err := head.Init(source, session, destination, method, timeoutToMs(timeout))
 	if err != nil {
 		return nil, err
 	}
-	hsize, err := head.Pack(buffer[PkgHeadLen+1:])
+	body, err := cc.Marshal(MSG_TYPE_CLUSTER_REQ, method, req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", RPC_CODEC_ERR, err)
+	}
+	maxLen := PkgHeadLen + WIRE_PREFIX_LEN + CLUSTER_REQ_HEAD_LEN + len(body)
+	if flags&WIRE_FLAG_METADATA != 0 {
+		maxLen += md.Size()
+	}
+	buffer = growBuffer(buffer, maxLen)
+	pos, err := packFramePrefix(buffer, MSG_TYPE_CLUSTER_REQ, version, flags)
 	if err != nil {
 		return nil, err
 	}
-	pos := PkgHeadLen + 1 + int(hsize)
-	if pos > len(buffer) {
-		return nil, PACK_BUFFER_SHORT_ERR
+	var hsize uintptr
+	if version == WIRE_VERSION_LEGACY {
+		hsize, err = head.PackLegacy(buffer[pos:])
+	} else {
+		hsize, err = head.Pack(buffer[pos:])
 	}
-	body, err := cc.Marshal(MSG_TYPE_CLUSTER_REQ, method, req)
 	if err != nil {
 		return nil, err
 	}
+	err = packHeadLen(buffer, version, hsize)
+	if err != nil {
+		return nil, err
+	}
+	pos += int(hsize)
+	if flags&WIRE_FLAG_METADATA != 0 {
+		msize, err := md.Pack(buffer[pos:])
+		if err != nil {
+			return nil, err
+		}
+		pos += msize
+	}
 	if pos+len(body) > len(buffer) {
 		return nil, PACK_BUFFER_SHORT_ERR
 	}
@@ -257,54 +492,202 @@ func NetPackRequest(buffer []byte, cc Codec, source SVC_HANDLE, session uint32,
 	return buffer[:pos], nil
 }
 
-func NetPackResponse(buffer []byte, cc Codec, source SVC_HANDLE, session uint32, destination SVC_HANDLE, method string, rsp interface{}, rpcErr error) ([]byte, error) {
-	if PkgHeadLen+1 > len(buffer) {
-		return nil, PACK_BUFFER_SHORT_ERR
-	}
-	buffer[PkgHeadLen] = uint8(MSG_TYPE_CLUSTER_RSP)
+// 新旧版本回包头格式一致, 仅帧前缀不同
+func NetPackResponse(buffer []byte, cc Codec, version uint8, source SVC_HANDLE, session uint32, destination SVC_HANDLE, method string, rsp interface{}, rpcErr error) ([]byte, error) {
 	head := &ClusterRspHead{}
 	errCode := ErrCode_OK
 	errMsg := ""
+	var details []byte
 	if rpcErr != nil {
-		errCode = ErrCode_Usr
-		errMsg = rpcErr.Error()
+		e := toError(rpcErr)
+		errCode = e.Code
+		errMsg = truncateErrMsg(e.Message)
+		details = e.Details
 	}
 	err := head.Init(source, session, destination, method, errCode, errMsg)
 	if err != nil {
 		return nil, err
 	}
-	hsize, err := head.Pack(buffer[PkgHeadLen+1:])
+	// 未出现错误才Marshal Rsp, 出错时body为错误附加信息
+	body := details
+	if rpcErr == nil {
+		body, err = cc.Marshal(MSG_TYPE_CLUSTER_RSP, method, rsp)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", RPC_CODEC_ERR, err)
+		}
+	}
+	buffer = growBuffer(buffer, PkgHeadLen+WIRE_PREFIX_LEN+CLUSTER_RSP_HEAD_LEN+len(body))
+	pos, err := packFramePrefix(buffer, MSG_TYPE_CLUSTER_RSP, version, 0)
+	if err != nil {
+		return nil, err
+	}
+	hsize, err := head.Pack(buffer[pos:])
+	if err != nil {
+		return nil, err
+	}
+	err = packHeadLen(buffer, version, hsize)
 	if err != nil {
 		return nil, err
 	}
-	pos := PkgHeadLen + 1 + int(hsize)
-	if pos > len(buffer) {
+	pos += int(hsize)
+	if pos+len(body) > len(buffer) {
 		return nil, PACK_BUFFER_SHORT_ERR
 	}
-	// 未出现错误才Marshal Rsp
-	if rpcErr == nil {
-		body, err := cc.Marshal(MSG_TYPE_CLUSTER_RSP, method, rsp)
+	bsize := copy(buffer[pos:], body)
+	pos += bsize
+	binary.BigEndian.PutUint32(buffer, uint32(pos-PkgHeadLen))
+	return buffer[:pos], nil
+}
+
+// 流帧只支持新版本协议, 旧版本节点收到后直接忽略
+func NetPackStream(buffer []byte, msgType MsgType, head *ClusterStreamHead, body []byte) ([]byte, error) {
+	buffer = growBuffer(buffer, PkgHeadLen+WIRE_PREFIX_LEN+CLUSTER_STREAM_HEAD_LEN+len(body))
+	pos, err := packFramePrefix(buffer, msgType, WIRE_VERSION, 0)
+	if err != nil {
+		return nil, err
+	}
+	hsize, err := head.Pack(buffer[pos:])
+	if err != nil {
+		return nil, err
+	}
+	err = packHeadLen(buffer, WIRE_VERSION, hsize)
+	if err != nil {
+		return nil, err
+	}
+	pos += int(hsize)
+	bsize := copy(buffer[pos:], body)
+	pos += bsize
+	binary.BigEndian.PutUint32(buffer, uint32(pos-PkgHeadLen))
+	return buffer[:pos], nil
+}
+
+// 包体长度(不含4字节包头)超过maxSize时返回RPC_MSG_TOO_LARGE_ERR
+func checkMsgSize(data []byte, maxSize int) error {
+	if size := len(data) - PkgHeadLen; size > maxSize {
+		return fmt.Errorf("%w: size %d, limit %d", RPC_MSG_TOO_LARGE_ERR, size, maxSize)
+	}
+	return nil
+}
+
+// NetUnpack取出的单个包(不含4字节包头)解析结果
+// 旧版本包无法在解析包头前确定head长度, Head为msgType之后的全部内容, Body为nil
+type WireFrame struct {
+	MsgType  MsgType
+	Version  uint8
+	Flags    uint8
+	Head     []byte
+	Metadata Metadata
+	Body     []byte
+}
+
+func (f *WireFrame) Unpack(data []byte) error {
+	if len(data) == 0 {
+		return UNPACK_BUFFER_SHORT_ERR
+	}
+	f.Metadata = nil
+	f.Body = nil
+	if data[0]&WIRE_VERSIONED_MASK == 0 {
+		f.MsgType = MsgType(data[0])
+		f.Version = WIRE_VERSION_LEGACY
+		f.Flags = 0
+		f.Head = data[1:]
+		return nil
+	}
+	if len(data) < WIRE_PREFIX_LEN {
+		return UNPACK_BUFFER_SHORT_ERR
+	}
+	f.MsgType = MsgType(data[0] &^ WIRE_VERSIONED_MASK)
+	f.Version = data[1]
+	f.Flags = data[2]
+	hsize := int(binary.BigEndian.Uint16(data[3:]))
+	pos := WIRE_PREFIX_LEN
+	if pos+hsize > len(data) {
+		return UNPACK_BUFFER_SHORT_ERR
+	}
+	f.Head = data[pos : pos+hsize]
+	pos += hsize
+	if f.Flags&WIRE_FLAG_METADATA != 0 {
+		md, msize, err := UnpackMetadata(data[pos:])
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if pos+len(body) > len(buffer) {
-			return nil, PACK_BUFFER_SHORT_ERR
+		f.Metadata = md
+		pos += msize
+	}
+	f.Body = data[pos:]
+	return nil
+}
+
+// 解析请求头, 返回body; 新版本head中未识别的尾部字段直接跳过
+func NetUnpackRequest(f *WireFrame, head *ClusterReqHead) ([]byte, error) {
+	if f.Version == WIRE_VERSION_LEGACY {
+		pos, err := head.UnpackLegacy(f.Head)
+		if err != nil {
+			return nil, err
 		}
-		bsize := copy(buffer[pos:], body)
-		pos += bsize
+		return f.Head[pos:], nil
 	}
-	binary.BigEndian.PutUint32(buffer, uint32(pos-PkgHeadLen))
-	return buffer[:pos], nil
+	_, err := head.Unpack(f.Head)
+	if err != nil {
+		return nil, err
+	}
+	return f.Body, nil
+}
+
+func NetUnpackResponse(f *WireFrame, head *ClusterRspHead) ([]byte, error) {
+	pos, err := head.Unpack(f.Head)
+	if err != nil {
+		return nil, err
+	}
+	if f.Version == WIRE_VERSION_LEGACY {
+		return f.Head[pos:], nil
+	}
+	return f.Body, nil
 }
 
-func NetUnpack(b []byte) (int, []byte) { //返回(消耗字节数,实际内容)
+// 回复使用的协议版本: 与请求方一致, 高于本节点时按本节点版本回复
+func replyWireVersion(reqVersion uint8) uint8 {
+	if reqVersion > WIRE_VERSION {
+		return WIRE_VERSION
+	}
+	return reqVersion
+}
+
+func timeoutToMs(timeout time.Duration) uint32 {
+	if timeout <= 0 {
+		return 0
+	}
+	ms := (timeout + time.Millisecond - 1) / time.Millisecond
+	if ms > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(ms)
+}
+
+// 错误描述超长时按utf8字符边界截断
+func truncateErrMsg(msg string) string {
+	if len(msg) <= ERR_MSG_MAX_LEN {
+		return msg
+	}
+	n := ERR_MSG_MAX_LEN
+	for n > 0 && !utf8.RuneStart(msg[n]) {
+		n--
+	}
+	return msg[:n]
+}
+
+// 返回(消耗字节数,实际内容), 包体长度超过maxSize时返回RPC_MSG_TOO_LARGE_ERR, 此时字节流无法继续解析
+func NetUnpack(b []byte, maxSize int) (int, []byte, error) {
 	if len(b) < PkgHeadLen { //不够包头长度
-		return 0, nil
+		return 0, nil, nil
 	}
 	bodyLen := int(binary.BigEndian.Uint32(b))
+	if bodyLen > maxSize {
+		return 0, nil, fmt.Errorf("%w: size %d, limit %d", RPC_MSG_TOO_LARGE_ERR, bodyLen, maxSize)
+	}
 	if len(b) < PkgHeadLen+bodyLen { //不够body长度
-		return 0, nil
+		return 0, nil, nil
 	}
 	msgLen := PkgHeadLen + bodyLen
-	return msgLen, b[PkgHeadLen:msgLen]
+	return msgLen, b[PkgHeadLen:msgLen], nil
 }
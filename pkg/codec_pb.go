@@ -0,0 +1,51 @@
+package saber
+
+import (
+	"fmt"
+	"reflect"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var protoMessageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+// protobuf编解码器, 解码时按(MsgType, method)从注册表查找具体消息类型
+// 通常与Server共用注册表: server.SetCodec(saber.NewProtobufCodec(server.GetMsgRegistry())),
+// 服务RegisterTypedHandler时会自动登记请求/回包类型
+type ProtobufCodec struct {
+	Registry *MsgRegistry
+}
+
+func NewProtobufCodec(registry *MsgRegistry) *ProtobufCodec {
+	return &ProtobufCodec{Registry: registry}
+}
+
+func (c *ProtobufCodec) Marshal(msgType MsgType, method string, v interface{}) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s %s %T not proto.Message", CODEC_MSG_TYPE_ERR, msgType, method, v)
+	}
+	return proto.Marshal(m)
+}
+
+func (c *ProtobufCodec) Unmarshal(msgType MsgType, method string, data []byte) (interface{}, error) {
+	var t reflect.Type
+	if c.Registry != nil {
+		t = c.Registry.Lookup(msgType, method)
+	}
+	if t == nil {
+		return nil, fmt.Errorf("%w: %s %s", CODEC_TYPE_UNREGISTERED_ERR, msgType, method)
+	}
+	if t.Kind() != reflect.Ptr || !t.Implements(protoMessageType) {
+		return nil, fmt.Errorf("%w: %s %s %v not proto.Message", CODEC_MSG_TYPE_ERR, msgType, method, t)
+	}
+	m := reflect.New(t.Elem()).Interface().(proto.Message)
+	err := proto.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
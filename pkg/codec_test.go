@@ -1,15 +1,21 @@
 package saber
 
 import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 func TestClusterReqHead(t *testing.T) {
 	var buffer [PACK_BUFFER_SIZE]byte
 	h := &ClusterReqHead{}
-	err := h.Init(100001, 7999, 200002, "getFriends")
+	err := h.Init(100001, 7999, 200002, "getFriends", 200)
 	assert.Nil(t, err)
 	l, err := h.Pack(buffer[:])
 	assert.Nil(t, err)
@@ -20,8 +26,9 @@ func TestClusterReqHead(t *testing.T) {
 	assert.Equal(t, uint64(200002), h2.destination)
 	assert.Equal(t, uint32(7999), h2.session)
 	assert.Equal(t, h2.Method(), "getFriends")
+	assert.Equal(t, 200*time.Millisecond, h2.Timeout())
 	assert.Equal(t, l, l2)
-	assert.Equal(t, uintptr(21+len(h2.Method())), l)
+	assert.Equal(t, uintptr(21+len(h2.Method())+4), l)
 }
 
 func TestClusterRspHead(t *testing.T) {
@@ -43,3 +50,149 @@ func TestClusterRspHead(t *testing.T) {
 	assert.Equal(t, l, l2)
 	assert.Equal(t, uintptr(21+len(h2.Method())+5+len(h2.ErrMsg())), l)
 }
+
+type testReqLogin struct {
+	Gid  uint64
+	Name string
+}
+
+func TestJsonCodecRegistry(t *testing.T) {
+	c := &JsonCodec{Registry: NewMsgRegistry()}
+	data, err := c.Marshal(MSG_TYPE_CLUSTER_REQ, "ReqLogin", &testReqLogin{Gid: 101, Name: "lilei"})
+	assert.Nil(t, err)
+	// 未注册类型
+	v, err := c.Unmarshal(MSG_TYPE_CLUSTER_REQ, "ReqLogin", data)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"Gid": float64(101), "Name": "lilei"}, v)
+	// 指针类型
+	err = c.Registry.Register(MSG_TYPE_CLUSTER_REQ, "ReqLogin", reflect.TypeOf(&testReqLogin{}))
+	assert.Nil(t, err)
+	v, err = c.Unmarshal(MSG_TYPE_CLUSTER_REQ, "ReqLogin", data)
+	assert.Nil(t, err)
+	assert.Equal(t, &testReqLogin{Gid: 101, Name: "lilei"}, v)
+	// 值类型
+	err = c.Registry.Register(MSG_TYPE_CLUSTER_RSP, "ReqLogin", reflect.TypeOf(testReqLogin{}))
+	assert.Nil(t, err)
+	v, err = c.Unmarshal(MSG_TYPE_CLUSTER_RSP, "ReqLogin", data)
+	assert.Nil(t, err)
+	assert.Equal(t, testReqLogin{Gid: 101, Name: "lilei"}, v)
+	// 同一method注册不同类型
+	err = c.Registry.Register(MSG_TYPE_CLUSTER_REQ, "ReqLogin", reflect.TypeOf(testReqLogin{}))
+	assert.NotNil(t, err)
+}
+
+func TestProtobufCodec(t *testing.T) {
+	c := NewProtobufCodec(NewMsgRegistry())
+	data, err := c.Marshal(MSG_TYPE_CLUSTER_REQ, "Echo", wrapperspb.String("hello"))
+	assert.Nil(t, err)
+	_, err = c.Unmarshal(MSG_TYPE_CLUSTER_REQ, "Echo", data)
+	assert.True(t, errors.Is(err, CODEC_TYPE_UNREGISTERED_ERR))
+	err = c.Registry.Register(MSG_TYPE_CLUSTER_REQ, "Echo", reflect.TypeOf((*wrapperspb.StringValue)(nil)))
+	assert.Nil(t, err)
+	v, err := c.Unmarshal(MSG_TYPE_CLUSTER_REQ, "Echo", data)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", v.(*wrapperspb.StringValue).GetValue())
+	_, err = c.Marshal(MSG_TYPE_CLUSTER_REQ, "Echo", &testReqLogin{})
+	assert.True(t, errors.Is(err, CODEC_MSG_TYPE_ERR))
+	err = c.Registry.Register(MSG_TYPE_CLUSTER_RSP, "Echo", reflect.TypeOf(&testReqLogin{}))
+	assert.Nil(t, err)
+	_, err = c.Unmarshal(MSG_TYPE_CLUSTER_RSP, "Echo", data)
+	assert.True(t, errors.Is(err, CODEC_MSG_TYPE_ERR))
+}
+
+func unpackTestRequest(t *testing.T, data []byte) (*WireFrame, *ClusterReqHead, []byte) {
+	n, pkg, err := NetUnpack(data, DEFAULT_MAX_MSG_SIZE)
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), n)
+	f := &WireFrame{}
+	err = f.Unpack(pkg)
+	assert.Nil(t, err)
+	assert.Equal(t, MSG_TYPE_CLUSTER_REQ, f.MsgType)
+	head := &ClusterReqHead{}
+	body, err := NetUnpackRequest(f, head)
+	assert.Nil(t, err)
+	return f, head, body
+}
+
+func TestWireFrame(t *testing.T) {
+	var buffer [PACK_BUFFER_SIZE]byte
+	cc := &JsonCodec{}
+	md := Metadata{"trace_id": "abc123", "caller": "lobby"}
+	data, err := NetPackRequest(buffer[:], cc, WIRE_VERSION, 100001, 7999, 200002, "getFriends", "hello", 200*time.Millisecond, md)
+	assert.Nil(t, err)
+	f, head, body := unpackTestRequest(t, data)
+	assert.Equal(t, WIRE_VERSION, f.Version)
+	assert.Equal(t, md, f.Metadata)
+	assert.Equal(t, "getFriends", head.Method())
+	assert.Equal(t, 200*time.Millisecond, head.Timeout())
+	assert.Equal(t, `"hello"`, string(body))
+
+	// head尾部追加未识别字段
+	hsize := int(binary.BigEndian.Uint16(data[PkgHeadLen+3:]))
+	headEnd := PkgHeadLen + WIRE_PREFIX_LEN + hsize
+	ext := append([]byte{}, data[:headEnd]...)
+	ext = append(ext, 0xAA, 0xBB, 0xCC)
+	ext = append(ext, data[headEnd:]...)
+	binary.BigEndian.PutUint16(ext[PkgHeadLen+3:], uint16(hsize+3))
+	binary.BigEndian.PutUint32(ext, uint32(len(ext)-PkgHeadLen))
+	f, head, body = unpackTestRequest(t, ext)
+	assert.Equal(t, md, f.Metadata)
+	assert.Equal(t, uint32(7999), head.session)
+	assert.Equal(t, 200*time.Millisecond, head.Timeout())
+	assert.Equal(t, `"hello"`, string(body))
+
+	// 旧版本不携带timeout和metadata
+	data, err = NetPackRequest(buffer[:], cc, WIRE_VERSION_LEGACY, 100001, 7999, 200002, "getFriends", "hello", 200*time.Millisecond, md)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(MSG_TYPE_CLUSTER_REQ), data[PkgHeadLen])
+	f, head, body = unpackTestRequest(t, data)
+	assert.Equal(t, WIRE_VERSION_LEGACY, f.Version)
+	assert.Nil(t, f.Metadata)
+	assert.Equal(t, time.Duration(0), head.Timeout())
+	assert.Equal(t, "getFriends", head.Method())
+	assert.Equal(t, `"hello"`, string(body))
+
+	for _, version := range []uint8{WIRE_VERSION_LEGACY, WIRE_VERSION} {
+		data, err = NetPackResponse(buffer[:], cc, version, 200002, 7999, 100001, "getFriends", nil, NewError(ErrCode_Usr, "no such player").WithDetails([]byte("101")))
+		assert.Nil(t, err)
+		_, pkg, err := NetUnpack(data, DEFAULT_MAX_MSG_SIZE)
+		assert.Nil(t, err)
+		f := &WireFrame{}
+		err = f.Unpack(pkg)
+		assert.Nil(t, err)
+		assert.Equal(t, MSG_TYPE_CLUSTER_RSP, f.MsgType)
+		assert.Equal(t, version, f.Version)
+		rspHead := &ClusterRspHead{}
+		body, err = NetUnpackResponse(f, rspHead)
+		assert.Nil(t, err)
+		assert.Equal(t, ErrCode_Usr, rspHead.errCode)
+		assert.Equal(t, "no such player", rspHead.ErrMsg())
+		assert.Equal(t, "101", string(body))
+	}
+}
+
+func TestLargeMsgPack(t *testing.T) {
+	var buffer [PACK_BUFFER_SIZE]byte
+	cc := &JsonCodec{}
+	payload := strings.Repeat("a", 4*PACK_BUFFER_SIZE)
+	data, err := NetPackRequest(buffer[:], cc, WIRE_VERSION, 100001, 7999, 200002, "Echo", payload, 0, nil)
+	assert.Nil(t, err)
+	assert.True(t, len(data) > PACK_BUFFER_SIZE)
+	_, _, body := unpackTestRequest(t, data)
+	assert.Equal(t, `"`+payload+`"`, string(body))
+	data, err = NetPackResponse(buffer[:], cc, WIRE_VERSION, 200002, 7999, 100001, "Echo", payload, nil)
+	assert.Nil(t, err)
+	assert.True(t, len(data) > PACK_BUFFER_SIZE)
+
+	assert.Nil(t, checkMsgSize(data, len(data)-PkgHeadLen))
+	err = checkMsgSize(data, len(data)-PkgHeadLen-1)
+	assert.True(t, errors.Is(err, RPC_MSG_TOO_LARGE_ERR))
+	// 未收全时也按包头长度拒绝
+	n, _, err := NetUnpack(data[:PkgHeadLen], PACK_BUFFER_SIZE)
+	assert.Equal(t, 0, n)
+	assert.True(t, errors.Is(err, RPC_MSG_TOO_LARGE_ERR))
+	n, pkg, err := NetUnpack(data[:PkgHeadLen+1], len(data))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Nil(t, pkg)
+}
@@ -0,0 +1,60 @@
+package saber
+
+import (
+	"context"
+	"time"
+)
+
+// 请求的调用方信息
+type CallerInfo struct {
+	Source  SVC_HANDLE // 调用方服务
+	Cluster string     // 调用方所在节点
+	Session uint32     // 0表示notify
+}
+
+// handler中获取调用方信息
+func CallerFromCtx(ctx context.Context) (*CallerInfo, bool) {
+	caller, ok := ctx.Value(CtxKeyCaller).(*CallerInfo)
+	return caller, ok
+}
+
+// 只继承value, 不继承deadline和cancel. notify发出后调用方ctx随时可能结束, 不应影响接收方处理
+type valueOnlyCtx struct {
+	context.Context
+}
+
+func (valueOnlyCtx) Deadline() (deadline time.Time, ok bool) {
+	return
+}
+
+func (valueOnlyCtx) Done() <-chan struct{} {
+	return nil
+}
+
+func (valueOnlyCtx) Err() error {
+	return nil
+}
+
+// 构造handler的ctx: 节点内请求继承调用方ctx, 跨节点请求以context.Background()为根.
+// 请求已过期时返回false
+func (s *Service) newHandlerCtx(parent context.Context, req *SvcRequest, caller *CallerInfo) (context.Context, context.CancelFunc, bool) {
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx := context.WithValue(parent, CtxKeyService, s)
+	ctx = context.WithValue(ctx, CtxKeyCaller, caller)
+	// metadata只对本次请求有效, 调用方ctx中的metadata不再向下传递
+	ctx = context.WithValue(ctx, CtxKeyMetadata, req.Metadata)
+	if OutgoingMetadataFromCtx(ctx) != nil {
+		ctx = context.WithValue(ctx, CtxKeyOutgoingMetadata, Metadata(nil))
+	}
+	if req.Deadline.IsZero() {
+		return ctx, func() {}, true
+	}
+	// 排队期间已超时, 调用方不再等待回包
+	if !time.Now().Before(req.Deadline) {
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithDeadline(ctx, req.Deadline)
+	return ctx, cancel, true
+}
@@ -0,0 +1,115 @@
+package saber
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCtxKey string
+
+func TestCallerCtx(t *testing.T) {
+	sa, sb := newTestClusterPair(t, "test_ctx_a", "test_ctx_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	type handlerCtx struct {
+		value    interface{}
+		caller   *CallerInfo
+		deadline time.Time
+		err      error
+	}
+	ctxs := make(chan handlerCtx, 1)
+	record := func(ctx context.Context) {
+		caller, ok := CallerFromCtx(ctx)
+		assert.True(t, ok)
+		deadline, _ := ctx.Deadline()
+		ctxs <- handlerCtx{value: ctx.Value(testCtxKey("player")), caller: caller, deadline: deadline, err: ctx.Err()}
+	}
+	newEcho := func(s *Server) *Service {
+		echo, err := s.NewService("echo", 1)
+		assert.Nil(t, err)
+		echo.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+			record(ctx)
+			return MetadataFromCtx(ctx)["from"], nil
+		})
+		echo.RegisterSvcHandler("Wait", func(ctx context.Context, req interface{}) (interface{}, error) {
+			<-ctx.Done()
+			record(ctx)
+			// 与调用方自身的取消结果一致, 避免回包先到达时结果不确定
+			return nil, NewError(ErrCode_Canceled, "handler canceled")
+		})
+		return echo
+	}
+	newEcho(sa)
+	newEcho(sb)
+	client, err := sa.NewService("client", 1)
+	assert.Nil(t, err)
+
+	// 节点内请求继承调用方ctx的value和deadline
+	ctx := context.WithValue(context.Background(), testCtxKey("player"), "lilei")
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	rsp, err := client.Call(WithOutgoingMetadata(ctx, Metadata{"from": "client"}), "echo", 1, "Echo", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "client", rsp)
+	hc := <-ctxs
+	assert.Equal(t, "lilei", hc.value)
+	assert.Equal(t, client.handle, hc.caller.Source)
+	assert.Equal(t, "test_ctx_a", hc.caller.Cluster)
+	assert.NotEqual(t, uint32(0), hc.caller.Session)
+	deadline, _ := ctx.Deadline()
+	assert.Equal(t, deadline, hc.deadline)
+
+	// 调用方待发出的metadata不会传给下一跳
+	rsp, err = client.Call(ctx, "echo", 1, "Echo", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", rsp)
+	<-ctxs
+
+	// 调用方取消后handler的ctx随之结束
+	cctx, ccancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		ccancel()
+	}()
+	_, err = client.Call(cctx, "echo", 1, "Wait", nil)
+	assert.True(t, errors.Is(err, RPC_CANCELED_ERR))
+	hc = <-ctxs
+	assert.Equal(t, context.Canceled, hc.err)
+
+	// 未设置deadline时使用rpc超时
+	start := time.Now()
+	_, err = client.Call(context.Background(), "echo", 1, "Echo", nil, WithTimeout(time.Second))
+	assert.Nil(t, err)
+	hc = <-ctxs
+	assert.False(t, hc.deadline.Before(start.Add(time.Second)))
+	assert.True(t, hc.deadline.Before(time.Now().Add(time.Second)))
+
+	// notify只继承value, 调用方ctx结束不影响处理
+	nctx, ncancel := context.WithCancel(ctx)
+	err = client.Send(nctx, "echo", 1, "Echo", nil)
+	ncancel()
+	assert.Nil(t, err)
+	hc = <-ctxs
+	assert.Equal(t, "lilei", hc.value)
+	assert.Equal(t, uint32(0), hc.caller.Session)
+	assert.True(t, hc.deadline.IsZero())
+	assert.Nil(t, hc.err)
+
+	// 跨节点请求不携带ctx中的value
+	rsp, err = client.CallCluster(WithOutgoingMetadata(ctx, Metadata{"from": "client"}), "test_ctx_b", "echo", 1, "Echo", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "client", rsp)
+	hc = <-ctxs
+	assert.Nil(t, hc.value)
+	assert.Equal(t, client.handle, hc.caller.Source)
+	assert.Equal(t, "test_ctx_a", hc.caller.Cluster)
+	assert.NotEqual(t, uint32(0), hc.caller.Session)
+	assert.False(t, hc.deadline.IsZero())
+
+	_, ok := CallerFromCtx(context.Background())
+	assert.False(t, ok)
+}
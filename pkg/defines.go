@@ -1,18 +1,29 @@
 package saber
 
 const (
-	DEFAULT_MQ_SIZE      = 1024
-	DEFAULT_TIMER_CAP    = 1024
-	MIN_TICK_INTERVAL_MS = 10
-	CLUSTER_NAME_MAX_LEN = 64
-	METHOD_MAX_LEN       = 64
-	PACK_BUFFER_SIZE     = 8192
-	ERR_MSG_MAX_LEN      = 256
+	DEFAULT_MQ_SIZE        = 1024
+	DEFAULT_MQ_BLOCK_MS    = 1000 // OVERFLOW_BLOCK策略下发送方默认最长阻塞时间
+	DEFAULT_STARVE_LIMIT   = 16   // 开启优先级时低优先级消息最多连续被插队次数
+	DEFAULT_TIMER_CAP      = 1024
+	MIN_TICK_INTERVAL_MS   = 10
+	CLUSTER_NAME_MAX_LEN   = 64
+	METHOD_MAX_LEN         = 64
+	PACK_BUFFER_SIZE       = 8192     // 打包缓冲区初始大小, 超出时按需分配
+	PACK_BUFFER_POOL_MAX   = 64 << 10 // 超过该大小的打包缓冲区用完直接丢弃, 不放回池中
+	DEFAULT_MAX_MSG_SIZE   = 4 << 20  // 跨节点单个包体默认上限:字节
+	DEFAULT_STOP_MS        = 10000    // Exit/WaitExit停止时的默认最长等待时间
+	SHUTDOWN_POLL_MS       = 5        // Shutdown检查服务是否处理完的间隔
+	DEFAULT_RPC_TIMEOUT_MS = 10000
+	ERR_MSG_MAX_LEN        = 255 // 受限于emLen(uint8), 超长时截断
 )
 
 const (
-	CtxKeyService      = "SaberService"
-	CtxKeyRpcTimeoutMS = "SaberRpcTimeout"
+	CtxKeyService          = "SaberService"
+	CtxKeyRpcTimeoutMS     = "SaberRpcTimeout"
+	CtxKeyMetadata         = "SaberMetadata"         // 收到的rpc metadata
+	CtxKeyOutgoingMetadata = "SaberOutgoingMetadata" // 待发出的rpc metadata
+	CtxKeySpan             = "SaberSpan"             // 当前trace span
+	CtxKeyCaller           = "SaberCaller"           // 请求的调用方信息
 )
 
 type SVC_HANDLE uint64
@@ -0,0 +1,264 @@
+package saber
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/xingshuo/saber/common/lib"
+	"github.com/xingshuo/saber/common/log"
+)
+
+const DEFAULT_DISCOVERY_POLL_MS = 1000
+
+// 远端节点地址表变更回调, clusterAddrs为全量地址表 clustername: address
+type DiscoveryWatcher func(clusterAddrs map[string]string)
+
+// 服务发现接口: 以全量地址表推送变更, ClusterProxy据此增删改远端节点
+type Discovery interface {
+	// 订阅地址表变更, 订阅成功后会立即推送一次当前全量地址表
+	Watch(watcher DiscoveryWatcher) error
+	Close() error
+}
+
+// 可选接口: 支持设置错误日志输出的服务发现, Server.SetDiscovery时自动设置为节点的LogSystem
+type discoveryLogSetter interface {
+	SetLogSystem(l *log.LogSystem)
+}
+
+func copyClusterAddrs(clusterAddrs map[string]string) map[string]string {
+	addrs := make(map[string]string, len(clusterAddrs))
+	for name, addr := range clusterAddrs {
+		addrs[name] = addr
+	}
+	return addrs
+}
+
+type discoveryEvent struct {
+	watchers []DiscoveryWatcher
+	addrs    map[string]string
+}
+
+// 订阅者列表及变更推送: 变更按发生顺序排队, 由一个goroutine在锁外依次推送,
+// 回调中可以重入discovery(Set, Watch, Close等), 重入产生的变更在当前回调返回后推送
+type discoveryWatchers struct {
+	mu        sync.Mutex
+	watchers  []DiscoveryWatcher
+	events    []discoveryEvent
+	notifying bool
+}
+
+// 新增订阅者并排队推送当前地址表, 调用方持有discovery的锁, 保证与变更的入队顺序一致
+func (w *discoveryWatchers) add(watcher DiscoveryWatcher, addrs map[string]string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.watchers = append(w.watchers, watcher)
+	w.events = append(w.events, discoveryEvent{
+		watchers: []DiscoveryWatcher{watcher},
+		addrs:    copyClusterAddrs(addrs),
+	})
+}
+
+// 排队向全部订阅者推送地址表, 调用方持有discovery的锁
+func (w *discoveryWatchers) changed(addrs map[string]string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.watchers) == 0 {
+		return
+	}
+	watchers := make([]DiscoveryWatcher, len(w.watchers))
+	copy(watchers, w.watchers)
+	w.events = append(w.events, discoveryEvent{watchers: watchers, addrs: copyClusterAddrs(addrs)})
+}
+
+func (w *discoveryWatchers) clear() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.watchers = nil
+	w.events = nil
+}
+
+// 推送排队中的变更, 调用方不能持有discovery的锁. 已有goroutine在推送时直接返回, 由其推送
+func (w *discoveryWatchers) flush() {
+	w.mu.Lock()
+	if w.notifying {
+		w.mu.Unlock()
+		return
+	}
+	w.notifying = true
+	for len(w.events) > 0 {
+		ev := w.events[0]
+		w.events[0] = discoveryEvent{}
+		w.events = w.events[1:]
+		w.mu.Unlock()
+		for _, watcher := range ev.watchers {
+			watcher(copyClusterAddrs(ev.addrs))
+		}
+		w.mu.Lock()
+	}
+	w.notifying = false
+	w.mu.Unlock()
+}
+
+// 内存实现, 主要用于测试和业务层自行对接其他注册中心
+type MemoryDiscovery struct {
+	mu       sync.Mutex
+	addrs    map[string]string
+	watchers discoveryWatchers
+}
+
+func NewMemoryDiscovery(clusterAddrs map[string]string) *MemoryDiscovery {
+	return &MemoryDiscovery{
+		addrs: copyClusterAddrs(clusterAddrs),
+	}
+}
+
+func (d *MemoryDiscovery) Watch(watcher DiscoveryWatcher) error {
+	d.mu.Lock()
+	d.watchers.add(watcher, d.addrs)
+	d.mu.Unlock()
+	d.watchers.flush()
+	return nil
+}
+
+// 新增或修改节点地址
+func (d *MemoryDiscovery) Put(clusterName, addr string) {
+	d.mu.Lock()
+	if old, ok := d.addrs[clusterName]; ok && old == addr {
+		d.mu.Unlock()
+		return
+	}
+	d.addrs[clusterName] = addr
+	d.watchers.changed(d.addrs)
+	d.mu.Unlock()
+	d.watchers.flush()
+}
+
+func (d *MemoryDiscovery) Delete(clusterName string) {
+	d.mu.Lock()
+	if _, ok := d.addrs[clusterName]; !ok {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.addrs, clusterName)
+	d.watchers.changed(d.addrs)
+	d.mu.Unlock()
+	d.watchers.flush()
+}
+
+// 全量替换地址表
+func (d *MemoryDiscovery) Set(clusterAddrs map[string]string) {
+	d.mu.Lock()
+	d.addrs = copyClusterAddrs(clusterAddrs)
+	d.watchers.changed(d.addrs)
+	d.mu.Unlock()
+	d.watchers.flush()
+}
+
+func (d *MemoryDiscovery) Close() error {
+	d.watchers.clear()
+	return nil
+}
+
+// 文件实现: 定时检查配置文件(ServerConfig格式的json), 内容变化时推送其中的RemoteAddrs
+// 读取或解析失败时保留上一次的地址表, 并通过LogSystem记录错误
+type FileDiscovery struct {
+	path     string
+	interval time.Duration
+	mu       sync.Mutex
+	content  []byte
+	addrs    map[string]string
+	watchers discoveryWatchers
+	started  bool
+	quit     *lib.SyncEvent
+	log      *log.LogSystem
+}
+
+// interval: 检查间隔, 单位:毫秒, <= 0时使用默认值
+func NewFileDiscovery(path string, interval int64) (*FileDiscovery, error) {
+	if interval <= 0 {
+		interval = DEFAULT_DISCOVERY_POLL_MS
+	}
+	d := &FileDiscovery{
+		path:     path,
+		interval: time.Duration(interval) * time.Millisecond,
+		quit:     lib.NewSyncEvent(),
+		log:      log.NewStdLogSystem(log.LevelInfo),
+	}
+	_, err := d.load()
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// 返回地址表是否发生变化
+func (d *FileDiscovery) load() (bool, error) {
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return false, err
+	}
+	if d.content != nil && bytes.Equal(data, d.content) {
+		return false, nil
+	}
+	var config ServerConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return false, fmt.Errorf("parse discovery file %s failed:%w", d.path, err)
+	}
+	d.content = data
+	d.addrs = copyClusterAddrs(config.RemoteAddrs)
+	return true, nil
+}
+
+// 设置错误日志输出, 默认输出到标准日志
+func (d *FileDiscovery) SetLogSystem(l *log.LogSystem) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.log = l
+}
+
+func (d *FileDiscovery) Watch(watcher DiscoveryWatcher) error {
+	if d.quit.HasFired() {
+		return fmt.Errorf("discovery %s closed", d.path)
+	}
+	d.mu.Lock()
+	d.watchers.add(watcher, d.addrs)
+	if !d.started {
+		d.started = true
+		go d.poll()
+	}
+	d.mu.Unlock()
+	d.watchers.flush()
+	return nil
+}
+
+func (d *FileDiscovery) poll() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.mu.Lock()
+			changed, err := d.load()
+			if err != nil {
+				d.log.Errorf("file discovery reload err:%v", err)
+			} else if changed {
+				d.watchers.changed(d.addrs)
+			}
+			d.mu.Unlock()
+			d.watchers.flush()
+		case <-d.quit.Done():
+			return
+		}
+	}
+}
+
+func (d *FileDiscovery) Close() error {
+	d.quit.Fire()
+	d.watchers.clear()
+	return nil
+}
@@ -0,0 +1,151 @@
+package saber
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xingshuo/saber/common/log"
+	"github.com/xingshuo/saber/common/utils"
+)
+
+func freeAddr(t testing.TB) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestMemoryDiscovery(t *testing.T) {
+	d := NewMemoryDiscovery(map[string]string{"lobby": "127.0.0.1:9001"})
+	p := &ClusterProxy{}
+	err := d.Watch(p.Reload)
+	assert.Nil(t, err)
+	name, ok := p.GetClusterName(utils.ClusterNameToHash("lobby"))
+	assert.True(t, ok)
+	assert.Equal(t, "lobby", name)
+
+	d.Put("chat", "127.0.0.1:9002")
+	name, ok = p.GetClusterName(utils.ClusterNameToHash("chat"))
+	assert.True(t, ok)
+	assert.Equal(t, "chat", name)
+
+	d.Delete("lobby")
+	_, ok = p.GetClusterName(utils.ClusterNameToHash("lobby"))
+	assert.False(t, ok)
+	_, err = p.GetDialer("lobby")
+	assert.NotNil(t, err)
+
+	d.Set(map[string]string{"gate": "127.0.0.1:9003"})
+	_, ok = p.GetClusterName(utils.ClusterNameToHash("chat"))
+	assert.False(t, ok)
+	_, ok = p.GetClusterName(utils.ClusterNameToHash("gate"))
+	assert.True(t, ok)
+}
+
+func TestDiscoveryReentrant(t *testing.T) {
+	d := NewMemoryDiscovery(nil)
+	var updates []map[string]string
+	// 回调中重入discovery不会死锁, 重入产生的变更在当前回调返回后按顺序推送
+	err := d.Watch(func(clusterAddrs map[string]string) {
+		updates = append(updates, clusterAddrs)
+		if _, ok := clusterAddrs["lobby"]; ok && len(clusterAddrs) == 1 {
+			d.Put("chat", "127.0.0.1:9002")
+			d.Watch(func(map[string]string) {})
+		}
+	})
+	assert.Nil(t, err)
+	d.Put("lobby", "127.0.0.1:9001")
+	assert.Equal(t, []map[string]string{
+		{},
+		{"lobby": "127.0.0.1:9001"},
+		{"lobby": "127.0.0.1:9001", "chat": "127.0.0.1:9002"},
+	}, updates)
+	err = d.Watch(func(map[string]string) {
+		d.Close()
+	})
+	assert.Nil(t, err)
+	d.Put("gate", "127.0.0.1:9003")
+	assert.Equal(t, 3, len(updates))
+}
+
+func TestFileDiscovery(t *testing.T) {
+	f, err := ioutil.TempFile("", "saber_discovery_*.json")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"RemoteAddrs": {"lobby": "127.0.0.1:9001"}}`)
+	f.Close()
+	assert.Nil(t, err)
+
+	d, err := NewFileDiscovery(f.Name(), 10)
+	assert.Nil(t, err)
+	defer d.Close()
+	logger := &testLogger{lines: make(chan string, 16)}
+	d.SetLogSystem(log.NewLogSystem(logger, log.LevelInfo))
+	updates := make(chan map[string]string, 4)
+	err = d.Watch(func(clusterAddrs map[string]string) {
+		updates <- clusterAddrs
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"lobby": "127.0.0.1:9001"}, <-updates)
+
+	// 解析失败保留原地址表
+	err = ioutil.WriteFile(f.Name(), []byte(`{"RemoteAddrs": `), 0644)
+	assert.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, len(updates))
+	// 错误经由LogSystem输出
+	assert.Contains(t, <-logger.lines, "[ERROR]file discovery reload err:")
+
+	err = ioutil.WriteFile(f.Name(), []byte(`{"RemoteAddrs": {"lobby": "127.0.0.1:9002", "chat": "127.0.0.1:9003"}}`), 0644)
+	assert.Nil(t, err)
+	select {
+	case addrs := <-updates:
+		assert.Equal(t, map[string]string{"lobby": "127.0.0.1:9002", "chat": "127.0.0.1:9003"}, addrs)
+	case <-time.After(time.Second):
+		t.Fatal("wait file discovery update timeout")
+	}
+}
+
+func TestDiscoveryCallCluster(t *testing.T) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	sa := newTestServer(t, ServerConfig{
+		ClusterName:    "test_discovery_a",
+		LocalAddr:      addrA,
+		TickIntervalMs: 10,
+	})
+	defer sa.Exit()
+	sb := newTestServer(t, ServerConfig{
+		ClusterName:    "test_discovery_b",
+		LocalAddr:      addrB,
+		RemoteAddrs:    map[string]string{"test_discovery_a": addrA},
+		TickIntervalMs: 10,
+	})
+	defer sb.Exit()
+	echo, err := sb.NewService("echo", 1)
+	assert.Nil(t, err)
+	echo.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	})
+	client, err := sa.NewService("client", 1)
+	assert.Nil(t, err)
+
+	_, err = client.CallCluster(context.Background(), "test_discovery_b", "echo", 1, "Echo", "hello")
+	assert.NotNil(t, err)
+
+	d := NewMemoryDiscovery(nil)
+	err = sa.SetDiscovery(d)
+	assert.Nil(t, err)
+	d.Put("test_discovery_b", addrB)
+	rsp, err := client.CallCluster(context.Background(), "test_discovery_b", "echo", 1, "Echo", "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", rsp)
+
+	d.Delete("test_discovery_b")
+	_, err = client.CallCluster(context.Background(), "test_discovery_b", "echo", 1, "Echo", "hello")
+	assert.NotNil(t, err)
+}
@@ -1,23 +1,120 @@
 package saber
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
-	RPC_SESSION_REPEAT_ERR    = fmt.Errorf("rpc Session repeat")
-	RPC_SESSION_NOEXIST_ERR   = fmt.Errorf("rpc Session no exist")
-	RPC_TIMEOUT_ERR           = fmt.Errorf("rpc timeout")
-	RPC_WAKEUP_ERR            = fmt.Errorf("rpc wake up err")
-	RPC_METHOD_LEN_OVER_ERR   = fmt.Errorf("rpc method len over")
-	CLUSTER_NAME_LEN_OVER_ERR = fmt.Errorf("cluster name len over")
-	ERR_MSG_LEN_OVER          = fmt.Errorf("err msg len over")
-	RPC_RETVALUE_NUM_ERR      = fmt.Errorf("rpc return value num error")
-	RPC_RETVALUE_TYPE_ERR     = fmt.Errorf("rpc return value type error")
-	PACK_BUFFER_SHORT_ERR     = fmt.Errorf("pack buffer not enough")
-	UNPACK_BUFFER_SHORT_ERR   = fmt.Errorf("unpack buffer not enough")
-	MSG_TYPE_ERR              = fmt.Errorf("msg type error")
+	RPC_SESSION_REPEAT_ERR      = fmt.Errorf("rpc Session repeat")
+	RPC_SESSION_NOEXIST_ERR     = fmt.Errorf("rpc Session no exist")
+	RPC_TIMEOUT_ERR             = NewError(ErrCode_Timeout, "rpc timeout")
+	RPC_UNKNOWN_METHOD_ERR      = NewError(ErrCode_UnknownMethod, "rpc unknown method")
+	RPC_CODEC_ERR               = NewError(ErrCode_Codec, "rpc codec error")
+	RPC_SVC_NOT_FOUND_ERR       = NewError(ErrCode_SvcNotFound, "rpc service not found")
+	RPC_HANDLER_PANIC_ERR       = NewError(ErrCode_HandlerPanic, "rpc handler panic")
+	RPC_OVERLOAD_ERR            = NewError(ErrCode_Overload, "rpc service overload")
+	RPC_CANCELED_ERR            = NewError(ErrCode_Canceled, "rpc canceled")
+	RPC_MSG_TOO_LARGE_ERR       = NewError(ErrCode_MsgTooLarge, "rpc msg too large")
+	RPC_SHUTDOWN_ERR            = NewError(ErrCode_Shutdown, "rpc service shutting down")
+	RPC_WAKEUP_ERR              = fmt.Errorf("rpc wake up err")
+	RPC_METHOD_LEN_OVER_ERR     = fmt.Errorf("rpc method len over")
+	CLUSTER_NAME_LEN_OVER_ERR   = fmt.Errorf("cluster name len over")
+	ERR_MSG_LEN_OVER            = fmt.Errorf("err msg len over")
+	RPC_RETVALUE_NUM_ERR        = fmt.Errorf("rpc return value num error")
+	RPC_RETVALUE_TYPE_ERR       = fmt.Errorf("rpc return value type error")
+	RPC_HANDLER_TYPE_ERR        = fmt.Errorf("rpc handler type error")
+	RPC_REQ_TYPE_ERR            = fmt.Errorf("rpc request type error")
+	CODEC_MSG_TYPE_ERR          = fmt.Errorf("codec msg type error")
+	CODEC_TYPE_UNREGISTERED_ERR = fmt.Errorf("codec msg type unregistered")
+	PACK_BUFFER_SHORT_ERR       = fmt.Errorf("pack buffer not enough")
+	UNPACK_BUFFER_SHORT_ERR     = fmt.Errorf("unpack buffer not enough")
+	MSG_TYPE_ERR                = fmt.Errorf("msg type error")
+	METADATA_LEN_OVER_ERR       = fmt.Errorf("metadata len over")
+	WIRE_HEAD_LEN_OVER_ERR      = fmt.Errorf("wire head len over")
+	MAILBOX_OPTION_ERR          = fmt.Errorf("mailbox kind not support bounded or priority")
+	ADMIN_ADDR_REMOTE_ERR       = fmt.Errorf("admin addr not loopback, set AdminRemote to allow")
 )
 
 var (
-	ErrCode_OK  uint32 = 0
-	ErrCode_Usr uint32 = 10001 // 业务层逻辑错误
+	ErrCode_OK uint32 = 0
+	// 框架保留错误码
+	ErrCode_UnknownMethod uint32 = 1  // 目标服务未注册该method
+	ErrCode_Codec         uint32 = 2  // 请求/回包编解码失败
+	ErrCode_SvcNotFound   uint32 = 3  // 目标服务不存在
+	ErrCode_HandlerPanic  uint32 = 4  // handler执行panic
+	ErrCode_Overload      uint32 = 5  // 目标服务过载
+	ErrCode_Timeout       uint32 = 6  // rpc超时
+	ErrCode_Canceled      uint32 = 7  // rpc发起方ctx被取消
+	ErrCode_MsgTooLarge   uint32 = 8  // 跨节点包体超过MaxMsgSize
+	ErrCode_Shutdown      uint32 = 9  // 目标节点或服务正在停止
+	ErrCode_ConnClosed    uint32 = 10 // 与对端节点的连接断开
+	// 业务层逻辑错误, 未携带错误码的error统一使用该值, 业务自定义错误码建议大于该值
+	ErrCode_Usr uint32 = 10001
 )
+
+// 携带错误码的rpc错误, 支持跨节点传递, 调用方可通过errors.Is(按错误码比较)和errors.As判定
+// handler返回*Error即可向调用方返回自定义错误码
+type Error struct {
+	Code    uint32
+	Message string
+	Details []byte // 可选附加信息, 跨节点时随回包body传递
+	cause   error  // 本地产生错误的底层原因, 如: context.DeadlineExceeded, 不跨节点传递
+}
+
+func NewError(code uint32, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s(code:%d)", e.Message, e.Code)
+}
+
+// 错误码相同即认为是同一错误
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+func (e *Error) WithDetails(details []byte) *Error {
+	return &Error{
+		Code:    e.Code,
+		Message: e.Message,
+		Details: details,
+		cause:   e.cause,
+	}
+}
+
+// 获取error对应的错误码: nil返回ErrCode_OK, 未携带错误码的返回ErrCode_Usr
+func ErrorCode(err error) uint32 {
+	if err == nil {
+		return ErrCode_OK
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ErrCode_Usr
+}
+
+// 转换为可跨节点传递的*Error
+func toError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		if e.Error() == err.Error() {
+			return e
+		}
+		// 被包装过, 保留完整的错误描述
+		msg := strings.Replace(err.Error(), e.Error(), e.Message, 1)
+		return &Error{Code: e.Code, Message: msg, Details: e.Details}
+	}
+	return &Error{Code: ErrCode_Usr, Message: err.Error()}
+}
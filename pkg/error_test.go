@@ -0,0 +1,118 @@
+package saber
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError(t *testing.T) {
+	err := NewError(ErrCode_UnknownMethod, "call unknown func %s", "Login")
+	assert.Equal(t, "call unknown func Login(code:1)", err.Error())
+	assert.True(t, errors.Is(err, RPC_UNKNOWN_METHOD_ERR))
+	assert.False(t, errors.Is(err, RPC_CODEC_ERR))
+	wrapped := fmt.Errorf("%w session %d", RPC_TIMEOUT_ERR, 7)
+	assert.True(t, errors.Is(wrapped, RPC_TIMEOUT_ERR))
+	assert.Equal(t, ErrCode_Timeout, ErrorCode(wrapped))
+	assert.Equal(t, "rpc timeout session 7", toError(wrapped).Message)
+	assert.Equal(t, ErrCode_Usr, ErrorCode(fmt.Errorf("no such player")))
+	assert.Equal(t, ErrCode_OK, ErrorCode(nil))
+	var e *Error
+	assert.True(t, errors.As(wrapped, &e))
+	assert.Equal(t, ErrCode_Timeout, e.Code)
+	assert.Equal(t, strings.Repeat("错", 85), truncateErrMsg(strings.Repeat("错", 100)))
+}
+
+func testRpcErrors(t *testing.T, call func(method string, arg interface{}) (interface{}, error)) {
+	_, err := call("Unknown", nil)
+	assert.True(t, errors.Is(err, RPC_UNKNOWN_METHOD_ERR))
+	_, err = call("Panic", nil)
+	assert.True(t, errors.Is(err, RPC_HANDLER_PANIC_ERR))
+	_, err = call("Custom", nil)
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, uint32(20001), e.Code)
+	assert.Equal(t, "no such player", e.Message)
+	assert.Equal(t, []byte("player 101"), e.Details)
+	_, err = call("Plain", nil)
+	assert.Contains(t, err.Error(), "plain error")
+	assert.Equal(t, ErrCode_Usr, ErrorCode(err))
+	rsp, err := call("Echo", "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", rsp)
+}
+
+func registerErrorHandlers(svc *Service) {
+	svc.RegisterSvcHandler("Panic", func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("oops")
+	})
+	svc.RegisterSvcHandler("Custom", func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, NewError(20001, "no such player").WithDetails([]byte("player 101"))
+	})
+	svc.RegisterSvcHandler("Plain", func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, fmt.Errorf("plain error")
+	})
+	svc.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	})
+}
+
+func TestRpcError(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_error",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	svc, err := s.NewService("lobby", 1)
+	assert.Nil(t, err)
+	registerErrorHandlers(svc)
+	client, err := s.NewService("client", 1)
+	assert.Nil(t, err)
+	_, err = client.Call(context.Background(), "nobody", 1, "Echo", nil)
+	assert.True(t, errors.Is(err, RPC_SVC_NOT_FOUND_ERR))
+	testRpcErrors(t, func(method string, arg interface{}) (interface{}, error) {
+		return client.Call(context.Background(), "lobby", 1, method, arg)
+	})
+}
+
+func TestClusterRpcError(t *testing.T) {
+	sa, sb := newTestClusterPair(t, "test_error_a", "test_error_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	svc, err := sb.NewService("lobby", 1)
+	assert.Nil(t, err)
+	registerErrorHandlers(svc)
+	client, err := sa.NewService("client", 1)
+	assert.Nil(t, err)
+	testRpcErrors(t, func(method string, arg interface{}) (interface{}, error) {
+		return client.CallCluster(context.Background(), "test_error_b", "lobby", 1, method, arg)
+	})
+}
+
+func TestClusterUndeliverable(t *testing.T) {
+	sa, sb := newTestClusterPair(t, "test_undeliverable_a", "test_undeliverable_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	svc, err := sb.NewService("lobby", 1)
+	assert.Nil(t, err)
+	err = svc.RegisterTypedHandler("ReqLogin", func(ctx context.Context, req *testReqLogin) (*testReqLogin, error) {
+		return req, nil
+	})
+	assert.Nil(t, err)
+	client, err := sa.NewService("client", 1)
+	assert.Nil(t, err)
+	// 目标服务不存在
+	_, err = client.CallCluster(context.Background(), "test_undeliverable_b", "nobody", 1, "ReqLogin", nil)
+	assert.True(t, errors.Is(err, RPC_SVC_NOT_FOUND_ERR))
+	// 请求解码失败
+	_, err = client.CallCluster(context.Background(), "test_undeliverable_b", "lobby", 1, "ReqLogin", "lilei")
+	assert.True(t, errors.Is(err, RPC_CODEC_ERR))
+	rsp, err := client.CallCluster(context.Background(), "test_undeliverable_b", "lobby", 1, "ReqLogin", &testReqLogin{Gid: 101})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"Gid": float64(101), "Name": ""}, rsp)
+}
@@ -0,0 +1,101 @@
+package saber
+
+import (
+	"context"
+)
+
+// rpc调用信息, 供拦截器使用
+type RpcInfo struct {
+	Method      string
+	Source      SVC_HANDLE // 调用方服务
+	Destination SVC_HANDLE // 被调用方服务
+	Cluster     string     // 对端节点名: 服务端为调用方所在节点, 客户端为目标节点
+	Notify      bool       // Send/SendCluster, 无回包
+}
+
+// 服务端拦截器, 包裹handler执行, 调用handler进入下一个拦截器
+type Interceptor func(ctx context.Context, req interface{}, info *RpcInfo, handler SvcHandlerFunc) (rsp interface{}, err error)
+
+// 发起rpc的实际调用, Notify时rsp恒为nil
+type Invoker func(ctx context.Context, arg interface{}) (rsp interface{}, err error)
+
+// 客户端拦截器, 包裹Call, Send, CallCluster, SendCluster, 调用invoker进入下一个拦截器
+type ClientInterceptor func(ctx context.Context, arg interface{}, info *RpcInfo, invoker Invoker) (rsp interface{}, err error)
+
+// 注册对所有服务生效的服务端拦截器, 先注册的在外层, 且位于Service.Use注册的拦截器外层
+func (s *Server) Use(interceptors ...Interceptor) {
+	s.rwMu.Lock()
+	defer s.rwMu.Unlock()
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
+// 注册对所有服务生效的客户端拦截器, 先注册的在外层, 且位于Service.UseClient注册的拦截器外层
+func (s *Server) UseClient(interceptors ...ClientInterceptor) {
+	s.rwMu.Lock()
+	defer s.rwMu.Unlock()
+	s.clientInterceptors = append(s.clientInterceptors, interceptors...)
+}
+
+func (s *Service) Use(interceptors ...Interceptor) {
+	s.rwMu.Lock()
+	defer s.rwMu.Unlock()
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
+func (s *Service) UseClient(interceptors ...ClientInterceptor) {
+	s.rwMu.Lock()
+	defer s.rwMu.Unlock()
+	s.clientInterceptors = append(s.clientInterceptors, interceptors...)
+}
+
+// 按Server, Service顺序拷贝拦截器, 避免执行期间被并发修改
+func (s *Service) getInterceptors() []Interceptor {
+	s.server.rwMu.RLock()
+	chain := make([]Interceptor, 0, len(s.server.interceptors)+len(s.interceptors))
+	chain = append(chain, s.server.interceptors...)
+	s.server.rwMu.RUnlock()
+	s.rwMu.RLock()
+	chain = append(chain, s.interceptors...)
+	s.rwMu.RUnlock()
+	return chain
+}
+
+func (s *Service) getClientInterceptors() []ClientInterceptor {
+	s.server.rwMu.RLock()
+	chain := make([]ClientInterceptor, 0, len(s.server.clientInterceptors)+len(s.clientInterceptors))
+	chain = append(chain, s.server.clientInterceptors...)
+	s.server.rwMu.RUnlock()
+	s.rwMu.RLock()
+	chain = append(chain, s.clientInterceptors...)
+	s.rwMu.RUnlock()
+	return chain
+}
+
+// 将拦截器链与handler组合成新的handler
+func (s *Service) wrapHandler(info *RpcInfo, handler SvcHandlerFunc) SvcHandlerFunc {
+	chain := s.getInterceptors()
+	for i := len(chain) - 1; i >= 0; i-- {
+		interceptor, next := chain[i], handler
+		handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	return handler
+}
+
+// 经客户端拦截器链发起调用
+func (s *Service) invoke(ctx context.Context, info *RpcInfo, arg interface{}, invoker Invoker) (rsp interface{}, err error) {
+	ctx, span := s.startClientSpan(ctx, info)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	chain := s.getClientInterceptors()
+	for i := len(chain) - 1; i >= 0; i-- {
+		interceptor, next := chain[i], invoker
+		invoker = func(ctx context.Context, arg interface{}) (interface{}, error) {
+			return interceptor(ctx, arg, info, next)
+		}
+	}
+	return invoker(ctx, arg)
+}
@@ -0,0 +1,140 @@
+package saber
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testTrace struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+func (t *testTrace) add(format string, args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = append(t.steps, fmt.Sprintf(format, args...))
+}
+
+func (t *testTrace) take() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	steps := t.steps
+	t.steps = nil
+	return steps
+}
+
+func testInterceptors(t *testing.T, server, peer *Server, cluster string, call func(ctx context.Context, client *Service, method string, arg interface{}) (interface{}, error)) {
+	trace := &testTrace{}
+	notified := make(chan string, 1)
+	echo, err := peer.NewService("echo", 1)
+	assert.Nil(t, err)
+	echo.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+		trace.add("handler")
+		return req, nil
+	})
+	echo.RegisterSvcHandler("Notify", func(ctx context.Context, req interface{}) (interface{}, error) {
+		notified <- req.(string)
+		return nil, nil
+	})
+	client, err := server.NewService("client", 1)
+	assert.Nil(t, err)
+	other, err := server.NewService("other", 1)
+	assert.Nil(t, err)
+	isCaller := func(h SVC_HANDLE) bool {
+		return h == client.handle || h == other.handle
+	}
+
+	peer.Use(func(ctx context.Context, req interface{}, info *RpcInfo, handler SvcHandlerFunc) (interface{}, error) {
+		trace.add("server %s %s notify:%v", info.Method, info.Cluster, info.Notify)
+		assert.True(t, isCaller(info.Source))
+		assert.Equal(t, echo.handle, info.Destination)
+		return handler(ctx, req)
+	})
+	// 鉴权
+	echo.Use(func(ctx context.Context, req interface{}, info *RpcInfo, handler SvcHandlerFunc) (interface{}, error) {
+		trace.add("service")
+		if MetadataFromCtx(ctx)["token"] != "secret" {
+			return nil, NewError(ErrCode_Usr+1, "unauthorized")
+		}
+		return handler(ctx, req)
+	})
+	server.UseClient(func(ctx context.Context, arg interface{}, info *RpcInfo, invoker Invoker) (interface{}, error) {
+		trace.add("client %s %s notify:%v", info.Method, info.Cluster, info.Notify)
+		assert.True(t, isCaller(info.Source))
+		return invoker(WithOutgoingMetadata(ctx, Metadata{"token": "secret"}), arg)
+	})
+	client.UseClient(func(ctx context.Context, arg interface{}, info *RpcInfo, invoker Invoker) (interface{}, error) {
+		trace.add("caller")
+		rsp, err := invoker(ctx, arg)
+		if s, ok := rsp.(string); ok {
+			rsp = s + "!"
+		}
+		return rsp, err
+	})
+
+	rsp, err := call(context.Background(), client, "Echo", "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello!", rsp)
+	assert.Equal(t, []string{
+		fmt.Sprintf("client Echo %s notify:false", cluster),
+		"caller",
+		fmt.Sprintf("server Echo %s notify:false", server.ClusterName()),
+		"service",
+		"handler",
+	}, trace.take())
+
+	_, err = call(context.Background(), client, "Notify", "ping")
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", <-notified)
+	steps := trace.take()
+	assert.Equal(t, fmt.Sprintf("client Notify %s notify:true", cluster), steps[0])
+	assert.Equal(t, fmt.Sprintf("server Notify %s notify:true", server.ClusterName()), steps[2])
+
+	// 拦截器可直接返回错误, 不执行handler
+	other.UseClient(func(ctx context.Context, arg interface{}, info *RpcInfo, invoker Invoker) (interface{}, error) {
+		return invoker(WithOutgoingMetadata(ctx, Metadata{"token": "guess"}), arg)
+	})
+	_, err = call(context.Background(), other, "Echo", "hello")
+	assert.True(t, errors.Is(err, NewError(ErrCode_Usr+1, "")))
+	assert.NotContains(t, trace.take(), "handler")
+
+	// 拦截器panic按handler panic处理
+	echo.Use(func(ctx context.Context, req interface{}, info *RpcInfo, handler SvcHandlerFunc) (interface{}, error) {
+		panic("interceptor")
+	})
+	_, err = call(context.Background(), client, "Echo", "hello")
+	assert.True(t, errors.Is(err, RPC_HANDLER_PANIC_ERR))
+}
+
+func TestInterceptor(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_interceptor",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	testInterceptors(t, s, s, "test_interceptor", func(ctx context.Context, client *Service, method string, arg interface{}) (interface{}, error) {
+		if method == "Notify" {
+			return nil, client.Send(ctx, "echo", 1, method, arg)
+		}
+		return client.Call(ctx, "echo", 1, method, arg)
+	})
+}
+
+func TestClusterInterceptor(t *testing.T) {
+	sa, sb := newTestClusterPair(t, "test_interceptor_a", "test_interceptor_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	testInterceptors(t, sa, sb, "test_interceptor_b", func(ctx context.Context, client *Service, method string, arg interface{}) (interface{}, error) {
+		if method == "Notify" {
+			return nil, client.SendCluster(ctx, "test_interceptor_b", "echo", 1, method, arg)
+		}
+		return client.CallCluster(ctx, "test_interceptor_b", "echo", 1, method, arg)
+	})
+}
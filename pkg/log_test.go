@@ -0,0 +1,259 @@
+package saber
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xingshuo/saber/common/log"
+)
+
+func TestFileLoggerRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saber_log_*")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "saber.log")
+	fl, err := log.NewFileLogger(filename, log.WithMaxSize(1024), log.WithMaxBackups(2), log.WithCompress(true), log.WithBufferSize(256))
+	assert.Nil(t, err)
+	ls := log.NewLogSystem(fl, log.LevelInfo)
+	for i := 0; i < 100; i++ {
+		ls.Infof("line %03d %s", i, strings.Repeat("x", 64))
+		// 每次刷新后检查大小, 保证发生多次轮转
+		assert.Nil(t, ls.Flush())
+	}
+	ls.Debug("filtered")
+	ls.Warning("last line")
+	assert.Nil(t, fl.Close())
+	ls.Error("after close")
+
+	data, err := ioutil.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.True(t, len(data) <= 1024)
+	assert.True(t, strings.HasSuffix(string(data), "[WARNING]last line\n"))
+	assert.NotContains(t, string(data), "filtered")
+	assert.NotContains(t, string(data), "after close")
+
+	infos, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(infos))
+	for _, info := range infos {
+		if info.Name() == "saber.log" {
+			continue
+		}
+		assert.True(t, strings.HasSuffix(info.Name(), ".gz"), info.Name())
+		f, err := os.Open(filepath.Join(dir, info.Name()))
+		assert.Nil(t, err)
+		zr, err := gzip.NewReader(f)
+		assert.Nil(t, err)
+		backup, err := ioutil.ReadAll(zr)
+		f.Close()
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(string(backup[27:]), "[INFO]line "), string(backup))
+	}
+}
+
+func TestFileLoggerCompressAsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saber_log_*")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "saber.log")
+	fl, err := log.NewFileLogger(filename, log.WithMaxSize(4<<20), log.WithCompress(true))
+	assert.Nil(t, err)
+	ls := log.NewLogSystem(fl, log.LevelInfo)
+	// 写满4MB后轮转, 随机内容压缩较慢
+	rnd := rand.New(rand.NewSource(1))
+	chunk := make([]byte, 32<<10)
+	for i := 0; i < 66; i++ {
+		rnd.Read(chunk)
+		ls.Info(hex.EncodeToString(chunk))
+	}
+	ls.Info("during compress")
+	assert.Nil(t, ls.Flush())
+
+	// 压缩在后台进行, 期间写日志不被阻塞
+	infos, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	var raw string
+	for _, info := range infos {
+		if info.Name() != "saber.log" && !strings.HasSuffix(info.Name(), ".gz") {
+			raw = info.Name()
+		}
+	}
+	assert.NotEqual(t, "", raw)
+	data, err := ioutil.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(string(data), "[INFO]during compress\n"))
+
+	// Close等待压缩完成
+	assert.Nil(t, fl.Close())
+	_, err = os.Stat(filepath.Join(dir, raw))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, raw+".gz"))
+	assert.Nil(t, err)
+}
+
+func TestFileLoggerKeepOthers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saber_log_*")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "app")
+	// 同目录下以app.开头但不是历史日志的文件不会被清理
+	others := []string{"app.access.log", "app.pid", "app.20060102-150405.000.bak", "app.20060102-150405.000.x.gz"}
+	for _, name := range others {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644))
+	}
+	fl, err := log.NewFileLogger(filename, log.WithMaxSize(1024), log.WithMaxBackups(1), log.WithBufferSize(256))
+	assert.Nil(t, err)
+	ls := log.NewLogSystem(fl, log.LevelInfo)
+	for i := 0; i < 50; i++ {
+		ls.Infof("line %03d %s", i, strings.Repeat("x", 64))
+		assert.Nil(t, ls.Flush())
+	}
+	assert.Nil(t, fl.Close())
+
+	infos, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	var backups []string
+	for _, info := range infos {
+		if info.Name() != "app" && !contains(others, info.Name()) {
+			backups = append(backups, info.Name())
+		}
+	}
+	assert.Equal(t, len(others)+2, len(infos))
+	assert.Equal(t, 1, len(backups))
+	for _, name := range others {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.Nil(t, err)
+		assert.Equal(t, name, string(data))
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type testLogger struct {
+	lines chan string
+}
+
+func (l *testLogger) Log(lv log.LogLevel, args ...interface{}) {
+	l.lines <- fmt.Sprintf("[%s]", lv) + fmt.Sprint(args...)
+}
+
+func (l *testLogger) Logf(lv log.LogLevel, format string, args ...interface{}) {
+	l.lines <- fmt.Sprintf("[%s]", lv) + fmt.Sprintf(format, args...)
+}
+
+func TestLogFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saber_log_*")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "server.log")
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_log",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+		LogFile:        filename,
+	})
+	echo, err := s.NewService("echo", 1)
+	assert.Nil(t, err)
+	echo.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+		GetSvcFromCtx(ctx).GetLogSystem().Infof("echo %v", req)
+		return req, nil
+	})
+	client, err := s.NewService("client", 1)
+	assert.Nil(t, err)
+	_, err = client.Call(context.Background(), "echo", 1, "Echo", "hello world")
+	assert.Nil(t, err)
+	// Exit时落盘缓冲中的日志
+	s.Exit()
+	data, err := ioutil.ReadFile(filename)
+	assert.Nil(t, err)
+	expect := fmt.Sprintf("[INFO]echo hello world cluster=test_log service=echo id=1 handle=%d\n", echo.handle)
+	assert.Contains(t, string(data), expect)
+
+	// 自定义logger同样附带服务字段, 值含空格等字符时加引号
+	logger := &testLogger{lines: make(chan string, 1)}
+	echo.SetLogSystem(logger, log.LevelInfo)
+	echo.GetLogSystem().With("player", "li lei", "empty", "").Warning("kick")
+	assert.Equal(t, fmt.Sprintf(`[WARNING]kick cluster=test_log service=echo id=1 handle=%d player="li lei" empty=""`, echo.handle), <-logger.lines)
+	ls := log.NewLogSystem(logger, log.LevelInfo)
+	child := ls.With("k", "v")
+	ls.SetLevel(log.LevelError)
+	child.Info("filtered")
+	child.Errorf("err %d", 1)
+	assert.Equal(t, "[ERROR]err 1 k=v", <-logger.lines)
+}
+
+func TestServiceLogLevel(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_log_level",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	logger := &testLogger{lines: make(chan string, 16)}
+	// 过滤服务启动等info日志
+	s.SetLogSystem(logger, log.LevelWarning)
+	lobby, err := s.NewService("lobby", 1)
+	assert.Nil(t, err)
+	chat, err := s.NewService("chat", 1)
+	assert.Nil(t, err)
+
+	// 单独调高lobby日志等级, 不影响其他服务
+	assert.Nil(t, s.SetServiceLogLevel("lobby", 1, "debug"))
+	lobby.GetLogSystem().Debug("lobby debug")
+	chat.GetLogSystem().Debug("chat debug")
+	assert.Equal(t, fmt.Sprintf("[DEBUG]lobby debug cluster=test_log_level service=lobby id=1 handle=%d", lobby.handle), <-logger.lines)
+	assert.Equal(t, 0, len(logger.lines))
+	assert.NotNil(t, s.SetServiceLogLevel("lobby", 2, "debug"))
+	assert.NotNil(t, s.SetServiceLogLevel("lobby", 1, "verbose"))
+
+	handler := NewLogLevelHandler(s)
+	doRequest := func(method, query string) (int, *LogLevels) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/loglevel?"+query, nil))
+		levels := &LogLevels{}
+		if w.Code == http.StatusOK {
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), levels))
+		}
+		return w.Code, levels
+	}
+	code, levels := doRequest(http.MethodGet, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "WARNING", levels.Level)
+	assert.Equal(t, 2, len(levels.Services))
+	assert.Equal(t, SvcLogLevel{Name: "chat", ID: 1, Handle: chat.handle, Level: "WARNING", Inherited: true}, *levels.Services[0])
+	assert.Equal(t, SvcLogLevel{Name: "lobby", ID: 1, Handle: lobby.handle, Level: "DEBUG"}, *levels.Services[1])
+
+	// 修改Server等级, 未单独设置的服务随之生效
+	code, levels = doRequest(http.MethodPost, "level=error")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ERROR", levels.Level)
+	assert.Equal(t, "ERROR", levels.Services[0].Level)
+	assert.Equal(t, "DEBUG", levels.Services[1].Level)
+	code, levels = doRequest(http.MethodPost, "service=lobby&id=1&level=inherit")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ERROR", levels.Services[1].Level)
+	assert.True(t, levels.Services[1].Inherited)
+	code, _ = doRequest(http.MethodPost, "service=lobby&id=x&level=debug")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = doRequest(http.MethodDelete, "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
@@ -0,0 +1,121 @@
+package saber
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xingshuo/saber/common/log"
+	"github.com/xingshuo/saber/common/utils"
+)
+
+// 服务日志等级, Inherited为true时沿用Server等级
+type SvcLogLevel struct {
+	Name      string     `json:"name"`
+	ID        uint32     `json:"id"`
+	Handle    SVC_HANDLE `json:"handle"`
+	Level     string     `json:"level"`
+	Inherited bool       `json:"inherited"`
+}
+
+type LogLevels struct {
+	Level    string         `json:"level"`
+	Services []*SvcLogLevel `json:"services"`
+}
+
+// Server及各服务当前日志等级
+func (s *Server) LogLevels() *LogLevels {
+	levels := &LogLevels{Level: s.log.GetLevel().String()}
+	s.rwMu.RLock()
+	for _, svc := range s.services {
+		ls := svc.GetLogSystem()
+		levels.Services = append(levels.Services, &SvcLogLevel{
+			Name:      svc.name,
+			ID:        svc.instID,
+			Handle:    svc.handle,
+			Level:     ls.GetLevel().String(),
+			Inherited: ls.LevelInherited(),
+		})
+	}
+	s.rwMu.RUnlock()
+	sort.Slice(levels.Services, func(i, j int) bool {
+		a, b := levels.Services[i], levels.Services[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+	return levels
+}
+
+// 运行时单独修改服务日志等级, level为空或inherit时恢复沿用Server等级
+func (s *Server) SetServiceLogLevel(svcName string, svcID uint32, level string) error {
+	svc := s.GetService(SVC_HANDLE(utils.MakeServiceHandle(s.ClusterName(), svcName, svcID)))
+	if svc == nil {
+		return fmt.Errorf("unknown service %s-%d", svcName, svcID)
+	}
+	ls := svc.GetLogSystem()
+	if level == "" || strings.EqualFold(level, "inherit") {
+		ls.ResetLevel()
+		s.log.Infof("service %s log level inherit %s", svc, ls.GetLevel())
+		return nil
+	}
+	lv, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	s.log.Infof("service %s log level: %s -> %s", svc, ls.GetLevel(), lv)
+	ls.SetLevel(lv)
+	return nil
+}
+
+// 查看/修改日志等级的http handler, 如: http.Handle("/loglevel", NewLogLevelHandler(server)).
+// GET返回LogLevels(json); POST service=lobby&id=1&level=debug修改单个服务等级, level为空或inherit时恢复沿用Server等级;
+// POST level=warning修改Server等级, 未单独设置等级的服务随之生效
+func NewLogLevelHandler(s *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodPut:
+			err := setLogLevelByForm(s, r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(s.LogLevels())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+func setLogLevelByForm(s *Server, r *http.Request) error {
+	err := r.ParseForm()
+	if err != nil {
+		return err
+	}
+	level := r.Form.Get("level")
+	svcName := r.Form.Get("service")
+	if svcName == "" {
+		lv, err := log.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		s.log.Infof("server log level: %s -> %s", s.log.GetLevel(), lv)
+		s.log.SetLevel(lv)
+		return nil
+	}
+	svcID, err := strconv.ParseUint(r.Form.Get("id"), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid service id %q", r.Form.Get("id"))
+	}
+	return s.SetServiceLogLevel(svcName, uint32(svcID), level)
+}
@@ -0,0 +1,124 @@
+package saber
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// 服务邮箱: 多个生产者Push, 服务Serve协程单独Pop
+type Mailbox interface {
+	// 返回true表示消费方处于等待状态, 需要唤醒
+	Push(ctx context.Context, source SVC_HANDLE, msgType MsgType, session uint32, data interface{}) (bool, error)
+	// 返回empty为true时消费方进入等待状态, 下一次Push负责唤醒
+	Pop() (empty bool, ctx context.Context, source SVC_HANDLE, msgType MsgType, session uint32, data interface{})
+	Len() int
+	// 超过上限被拒绝的请求数和被丢弃的notify数
+	Overflows() (rejected, dropped uint64)
+}
+
+// 邮箱实现
+type MailboxKind int
+
+const (
+	// 加锁的循环数组(MsgQueue), 支持有界邮箱和优先级
+	MAILBOX_RING MailboxKind = iota
+	// 无锁多生产者单消费者队列(MPSCQueue), 适用于大量服务向同一服务发消息的场景, 不支持有界邮箱和优先级
+	MAILBOX_MPSC
+)
+
+func (k MailboxKind) String() string {
+	switch k {
+	case MAILBOX_RING:
+		return "ring"
+	case MAILBOX_MPSC:
+		return "mpsc"
+	default:
+		return "unknown"
+	}
+}
+
+type mpscNode struct {
+	next unsafe.Pointer // *mpscNode
+	msg  Message
+}
+
+var mpscNodePool = sync.Pool{
+	New: func() interface{} {
+		return &mpscNode{}
+	},
+}
+
+// 无锁多生产者单消费者队列(Vyukov intrusive MPSC):
+// 生产者原子交换head后链接到前一节点, 消费者从tail沿next出队, 出队后的旧tail作为新的哑节点
+func NewMPSCQueue() *MPSCQueue {
+	stub := &mpscNode{}
+	return &MPSCQueue{
+		head:    unsafe.Pointer(stub),
+		tail:    stub,
+		waiting: 1,
+	}
+}
+
+type MPSCQueue struct {
+	// 原子操作的64位字段置于结构体开头, 保证32位平台对齐
+	size    int64
+	head    unsafe.Pointer // *mpscNode, 最近入队的节点, 生产者竞争写入
+	waiting int32          // 消费方是否在等待唤醒
+	tail    *mpscNode      // 哑节点, 其next为队头, 仅消费者访问
+}
+
+func (q *MPSCQueue) Push(ctx context.Context, source SVC_HANDLE, msgType MsgType, session uint32, data interface{}) (bool, error) {
+	n := mpscNodePool.Get().(*mpscNode)
+	n.msg.Source = source
+	n.msg.MsgType = msgType
+	n.msg.Session = session
+	n.msg.Data = data
+	n.msg.Ctx = ctx
+	atomic.AddInt64(&q.size, 1)
+	prev := (*mpscNode)(atomic.SwapPointer(&q.head, unsafe.Pointer(n)))
+	// 交换head和链接prev之间消费者可能短暂看到队列为空, 此时由本次链接后的唤醒兜底
+	atomic.StorePointer(&prev.next, unsafe.Pointer(n))
+	return atomic.CompareAndSwapInt32(&q.waiting, 1, 0), nil
+}
+
+func (q *MPSCQueue) pop() (Message, bool) {
+	tail := q.tail
+	next := (*mpscNode)(atomic.LoadPointer(&tail.next))
+	if next == nil {
+		return Message{}, false
+	}
+	q.tail = next
+	top := next.msg
+	// 释放引用, 避免出队后ctx和消息体仍被哑节点持有
+	next.msg = Message{}
+	// 已有后继节点说明不会再有生产者访问旧tail, 可以回收
+	atomic.StorePointer(&tail.next, nil)
+	mpscNodePool.Put(tail)
+	atomic.AddInt64(&q.size, -1)
+	return top, true
+}
+
+func (q *MPSCQueue) Pop() (empty bool, ctx context.Context, source SVC_HANDLE, msgType MsgType, session uint32, data interface{}) {
+	top, ok := q.pop()
+	if !ok {
+		// 先标记等待再检查一次, 避免与生产者交错时丢失唤醒
+		atomic.StoreInt32(&q.waiting, 1)
+		top, ok = q.pop()
+		if !ok {
+			return true, nil, 0, 0, 0, nil
+		}
+		// 失败说明生产者已发出唤醒, 只会多一次空转
+		atomic.CompareAndSwapInt32(&q.waiting, 1, 0)
+	}
+	return false, top.Ctx, top.Source, top.MsgType, top.Session, top.Data
+}
+
+func (q *MPSCQueue) Len() int {
+	return int(atomic.LoadInt64(&q.size))
+}
+
+func (q *MPSCQueue) Overflows() (rejected, dropped uint64) {
+	return 0, 0
+}
@@ -0,0 +1,111 @@
+package saber
+
+import (
+	"context"
+	"encoding/binary"
+)
+
+const (
+	METADATA_KEY_MAX_LEN   = 255   // 受限于klen(uint8)
+	METADATA_VALUE_MAX_LEN = 65535 // 受限于vlen(uint16)
+)
+
+// rpc附加的键值对(trace id, 鉴权token, 调用方身份等), 随请求跨节点传递
+type Metadata map[string]string
+
+func (md Metadata) Copy() Metadata {
+	c := make(Metadata, len(md))
+	for k, v := range md {
+		c[k] = v
+	}
+	return c
+}
+
+// 编码后长度
+func (md Metadata) Size() int {
+	size := 2
+	for k, v := range md {
+		size += 1 + len(k) + 2 + len(v)
+	}
+	return size
+}
+
+// 编码格式: 2字节kv数量 + n * (1字节klen + key + 2字节vlen + value)
+func (md Metadata) Pack(b []byte) (int, error) {
+	if len(md) > 0xFFFF {
+		return 0, METADATA_LEN_OVER_ERR
+	}
+	if len(b) < 2 {
+		return 0, PACK_BUFFER_SHORT_ERR
+	}
+	binary.BigEndian.PutUint16(b, uint16(len(md)))
+	pos := 2
+	for k, v := range md {
+		if len(k) > METADATA_KEY_MAX_LEN || len(v) > METADATA_VALUE_MAX_LEN {
+			return pos, METADATA_LEN_OVER_ERR
+		}
+		if pos+1+len(k)+2+len(v) > len(b) {
+			return pos, PACK_BUFFER_SHORT_ERR
+		}
+		b[pos] = uint8(len(k))
+		pos++
+		pos += copy(b[pos:], k)
+		binary.BigEndian.PutUint16(b[pos:], uint16(len(v)))
+		pos += 2
+		pos += copy(b[pos:], v)
+	}
+	return pos, nil
+}
+
+func UnpackMetadata(b []byte) (Metadata, int, error) {
+	if len(b) < 2 {
+		return nil, 0, UNPACK_BUFFER_SHORT_ERR
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	pos := 2
+	md := make(Metadata, n)
+	for i := 0; i < n; i++ {
+		if pos+1 > len(b) {
+			return nil, pos, UNPACK_BUFFER_SHORT_ERR
+		}
+		klen := int(b[pos])
+		pos++
+		if pos+klen+2 > len(b) {
+			return nil, pos, UNPACK_BUFFER_SHORT_ERR
+		}
+		k := string(b[pos : pos+klen])
+		pos += klen
+		vlen := int(binary.BigEndian.Uint16(b[pos:]))
+		pos += 2
+		if pos+vlen > len(b) {
+			return nil, pos, UNPACK_BUFFER_SHORT_ERR
+		}
+		md[k] = string(b[pos : pos+vlen])
+		pos += vlen
+	}
+	return md, pos, nil
+}
+
+// 在ctx上追加发出rpc时携带的metadata, 同名key覆盖
+func WithOutgoingMetadata(ctx context.Context, md Metadata) context.Context {
+	old := OutgoingMetadataFromCtx(ctx)
+	merged := make(Metadata, len(old)+len(md))
+	for k, v := range old {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, CtxKeyOutgoingMetadata, merged)
+}
+
+func OutgoingMetadataFromCtx(ctx context.Context) Metadata {
+	md, _ := ctx.Value(CtxKeyOutgoingMetadata).(Metadata)
+	return md
+}
+
+// handler中获取调用方携带的metadata
+func MetadataFromCtx(ctx context.Context) Metadata {
+	md, _ := ctx.Value(CtxKeyMetadata).(Metadata)
+	return md
+}
@@ -0,0 +1,364 @@
+package saber
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type MetricType int
+
+const (
+	METRIC_COUNTER MetricType = iota
+	METRIC_GAUGE
+	METRIC_HISTOGRAM
+)
+
+func (t MetricType) String() string {
+	switch t {
+	case METRIC_COUNTER:
+		return "counter"
+	case METRIC_GAUGE:
+		return "gauge"
+	case METRIC_HISTOGRAM:
+		return "histogram"
+	}
+	return "untyped"
+}
+
+// 延迟分桶上界:秒
+var DEFAULT_LATENCY_BUCKETS = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// 框架内置指标
+const (
+	METRIC_MAILBOX_DEPTH       = "saber_mailbox_depth"
+	METRIC_MAILBOX_OVERFLOW    = "saber_mailbox_overflow_total"
+	METRIC_DISPATCH_SECONDS    = "saber_dispatch_seconds"
+	METRIC_RPC_TOTAL           = "saber_rpc_total"
+	METRIC_TIMER_FIRES_TOTAL   = "saber_timer_fires_total"
+	METRIC_CLUSTER_SENT_BYTES  = "saber_cluster_sent_bytes_total"
+	METRIC_CLUSTER_SENT_FRAMES = "saber_cluster_sent_frames_total"
+	METRIC_CLUSTER_RECV_BYTES  = "saber_cluster_recv_bytes_total"
+	METRIC_CLUSTER_RECV_FRAMES = "saber_cluster_recv_frames_total"
+)
+
+// 对端可以请求任意method, 服务未注册的method在指标中统一记为该值, 避免时间序列无限增长
+const METRIC_UNKNOWN_METHOD = "unknown"
+
+// 单条时间序列的快照
+type MetricSample struct {
+	LabelValues []string // 与MetricFamily.LabelNames一一对应
+	Value       float64  // counter/gauge
+	Count       uint64   // histogram观测次数
+	Sum         float64  // histogram观测值总和
+	Buckets     []uint64 // histogram各分桶累计计数, 与MetricFamily.Buckets一一对应
+}
+
+// 同名指标的快照
+type MetricFamily struct {
+	Name       string
+	Help       string
+	Type       MetricType
+	LabelNames []string
+	Buckets    []float64
+	Samples    []*MetricSample
+}
+
+// 指标导出接口, 接入其他监控系统时实现该接口并定期调用Metrics.Export
+type MetricsExporter interface {
+	Export(families []*MetricFamily) error
+}
+
+// 原子操作的64位字段置于结构体开头, 保证32位平台对齐
+type metricSeries struct {
+	value   int64 // counter/gauge
+	count   uint64
+	sum     int64 // histogram观测值总和:纳秒
+	labels  []string
+	buckets []uint64
+}
+
+func (m *metricSeries) add(delta int64) {
+	atomic.AddInt64(&m.value, delta)
+}
+
+func (m *metricSeries) set(v int64) {
+	atomic.StoreInt64(&m.value, v)
+}
+
+func (m *metricSeries) observe(bounds []float64, d time.Duration) {
+	atomic.AddUint64(&m.count, 1)
+	atomic.AddInt64(&m.sum, int64(d))
+	seconds := d.Seconds()
+	for i, bound := range bounds {
+		if seconds <= bound {
+			atomic.AddUint64(&m.buckets[i], 1)
+			break
+		}
+	}
+}
+
+type metricVec struct {
+	name       string
+	help       string
+	typ        MetricType
+	labelNames []string
+	buckets    []float64
+	mu         sync.RWMutex
+	series     map[string]*metricSeries
+}
+
+func (v *metricVec) with(labels ...string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+	v.mu.RLock()
+	m := v.series[key]
+	v.mu.RUnlock()
+	if m != nil {
+		return m
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m = v.series[key]
+	if m == nil {
+		m = &metricSeries{labels: labels}
+		if v.typ == METRIC_HISTOGRAM {
+			m.buckets = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = m
+	}
+	return m
+}
+
+func (v *metricVec) gather() *MetricFamily {
+	f := &MetricFamily{
+		Name:       v.name,
+		Help:       v.help,
+		Type:       v.typ,
+		LabelNames: v.labelNames,
+		Buckets:    v.buckets,
+	}
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		m := v.series[key]
+		sample := &MetricSample{LabelValues: m.labels}
+		if v.typ == METRIC_HISTOGRAM {
+			sample.Count = atomic.LoadUint64(&m.count)
+			sample.Sum = time.Duration(atomic.LoadInt64(&m.sum)).Seconds()
+			sample.Buckets = make([]uint64, len(m.buckets))
+			var cumulative uint64
+			for i := range m.buckets {
+				cumulative += atomic.LoadUint64(&m.buckets[i])
+				sample.Buckets[i] = cumulative
+			}
+		} else {
+			sample.Value = float64(atomic.LoadInt64(&m.value))
+		}
+		f.Samples = append(f.Samples, sample)
+	}
+	v.mu.RUnlock()
+	return f
+}
+
+// 指标注册表, 每个Server持有一份, 通过Server.Metrics获取
+type Metrics struct {
+	mu         sync.RWMutex
+	vecs       map[string]*metricVec
+	collectors []func() []*MetricFamily
+
+	dispatch     *metricVec
+	rpc          *metricVec
+	timerFires   *metricVec
+	clusterSentB *metricVec
+	clusterSentF *metricVec
+	clusterRecvB *metricVec
+	clusterRecvF *metricVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{vecs: make(map[string]*metricVec)}
+	m.dispatch = m.newVec(METRIC_DISPATCH_SECONDS, "Latency of dispatched messages by msg type and method.", METRIC_HISTOGRAM, DEFAULT_LATENCY_BUCKETS, "service", "msg_type", "method")
+	m.rpc = m.newVec(METRIC_RPC_TOTAL, "Rpc outcomes by error code, side is client or server.", METRIC_COUNTER, nil, "service", "side", "method", "code")
+	m.timerFires = m.newVec(METRIC_TIMER_FIRES_TOTAL, "Number of fired service timers.", METRIC_COUNTER, nil, "service")
+	m.clusterSentB = m.newVec(METRIC_CLUSTER_SENT_BYTES, "Bytes sent to remote cluster.", METRIC_COUNTER, nil, "cluster")
+	m.clusterSentF = m.newVec(METRIC_CLUSTER_SENT_FRAMES, "Frames sent to remote cluster.", METRIC_COUNTER, nil, "cluster")
+	m.clusterRecvB = m.newVec(METRIC_CLUSTER_RECV_BYTES, "Bytes received from remote cluster.", METRIC_COUNTER, nil, "cluster")
+	m.clusterRecvF = m.newVec(METRIC_CLUSTER_RECV_FRAMES, "Frames received from remote cluster.", METRIC_COUNTER, nil, "cluster")
+	return m
+}
+
+func newMetricVec(name, help string, typ MetricType, buckets []float64, labelNames ...string) *metricVec {
+	return &metricVec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*metricSeries),
+	}
+}
+
+func (m *Metrics) newVec(name, help string, typ MetricType, buckets []float64, labelNames ...string) *metricVec {
+	v := newMetricVec(name, help, typ, buckets, labelNames...)
+	m.mu.Lock()
+	m.vecs[name] = v
+	m.mu.Unlock()
+	return v
+}
+
+// 注册采集回调, 每次Gather时执行, 返回当次新建的指标快照.
+// 用于邮箱积压等直接读取运行状态的指标, 不修改共享的序列, 并发Gather互不影响
+func (m *Metrics) addCollector(f func() []*MetricFamily) {
+	m.mu.Lock()
+	m.collectors = append(m.collectors, f)
+	m.mu.Unlock()
+}
+
+// 按指标名排序返回全部指标快照
+func (m *Metrics) Gather() []*MetricFamily {
+	m.mu.RLock()
+	collectors := m.collectors
+	vecs := make([]*metricVec, 0, len(m.vecs))
+	for _, v := range m.vecs {
+		vecs = append(vecs, v)
+	}
+	m.mu.RUnlock()
+	families := make([]*MetricFamily, 0, len(vecs))
+	for _, v := range vecs {
+		families = append(families, v.gather())
+	}
+	for _, f := range collectors {
+		families = append(families, f()...)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+	return families
+}
+
+func (m *Metrics) Export(e MetricsExporter) error {
+	return e.Export(m.Gather())
+}
+
+func (m *Metrics) observeDispatch(service string, msgType MsgType, method string, start time.Time) {
+	m.dispatch.with(service, msgType.String(), method).observe(m.dispatch.buckets, time.Since(start))
+}
+
+func (m *Metrics) incRpc(service, side, method string, err error) {
+	m.rpc.with(service, side, method, strconv.FormatUint(uint64(ErrorCode(err)), 10)).add(1)
+}
+
+func (m *Metrics) incTimerFire(service string) {
+	m.timerFires.with(service).add(1)
+}
+
+func (m *Metrics) addClusterSent(cluster string, bytes int) {
+	m.clusterSentB.with(cluster).add(int64(bytes))
+	m.clusterSentF.with(cluster).add(1)
+}
+
+func (m *Metrics) addClusterRecv(cluster string, bytes int) {
+	m.clusterRecvB.with(cluster).add(int64(bytes))
+	m.clusterRecvF.with(cluster).add(1)
+}
+
+// Prometheus文本格式导出
+type PrometheusExporter struct {
+	W io.Writer
+}
+
+func (e *PrometheusExporter) Export(families []*MetricFamily) error {
+	w := bufio.NewWriter(e.W)
+	for _, f := range families {
+		if len(f.Samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", f.Name, escapeHelp(f.Help))
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.Name, f.Type)
+		for _, sample := range f.Samples {
+			if f.Type != METRIC_HISTOGRAM {
+				fmt.Fprintf(w, "%s%s %s\n", f.Name, formatLabels(f.LabelNames, sample.LabelValues, ""), formatFloat(sample.Value))
+				continue
+			}
+			for i, bound := range f.Buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", f.Name, formatLabels(f.LabelNames, sample.LabelValues, formatFloat(bound)), sample.Buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.Name, formatLabels(f.LabelNames, sample.LabelValues, "+Inf"), sample.Count)
+			labels := formatLabels(f.LabelNames, sample.LabelValues, "")
+			fmt.Fprintf(w, "%s_sum%s %s\n", f.Name, labels, formatFloat(sample.Sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", f.Name, labels, sample.Count)
+		}
+	}
+	return w.Flush()
+}
+
+// 供Prometheus拉取的http handler, 如: http.Handle("/metrics", NewPrometheusHandler(server.Metrics()))
+func NewPrometheusHandler(m *Metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		err := m.Export(&PrometheusExporter{W: w})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// le: histogram分桶标签, 为空时不输出
+func formatLabels(names, values []string, le string) string {
+	if len(names) == 0 && le == "" {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabelValue(values[i]))
+		sb.WriteByte('"')
+	}
+	if le != "" {
+		if len(names) > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(`le="`)
+		sb.WriteString(le)
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var (
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return helpReplacer.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
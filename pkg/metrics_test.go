@@ -0,0 +1,129 @@
+package saber
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func findSample(families []*MetricFamily, name string, labels ...string) *MetricSample {
+	for _, f := range families {
+		if f.Name != name {
+			continue
+		}
+		for _, sample := range f.Samples {
+			if strings.Join(sample.LabelValues, ",") == strings.Join(labels, ",") {
+				return sample
+			}
+		}
+	}
+	return nil
+}
+
+func TestPrometheusExporter(t *testing.T) {
+	m := NewMetrics()
+	m.incRpc("chat-1", "client", "Say", nil)
+	m.incRpc("chat-1", "client", "Say", nil)
+	m.incRpc("chat-1", "client", "Say", RPC_TIMEOUT_ERR)
+	m.observeDispatch("chat-1", MSG_TYPE_SVC_REQ, "Say", time.Now().Add(-2*time.Millisecond))
+	m.addClusterSent(`lobby"1`, 100)
+	m.addCollector(func() []*MetricFamily {
+		depth := newMetricVec(METRIC_MAILBOX_DEPTH, "Number of messages waiting in service mailbox.", METRIC_GAUGE, nil, "service")
+		depth.with("chat-1").set(3)
+		return []*MetricFamily{depth.gather()}
+	})
+
+	var buf bytes.Buffer
+	err := m.Export(&PrometheusExporter{W: &buf})
+	assert.Nil(t, err)
+	out := buf.String()
+	assert.Contains(t, out, "# TYPE saber_rpc_total counter\n")
+	assert.Contains(t, out, `saber_rpc_total{service="chat-1",side="client",method="Say",code="0"} 2`+"\n")
+	assert.Contains(t, out, `saber_rpc_total{service="chat-1",side="client",method="Say",code="6"} 1`+"\n")
+	assert.Contains(t, out, "# TYPE saber_dispatch_seconds histogram\n")
+	assert.Contains(t, out, `saber_dispatch_seconds_bucket{service="chat-1",msg_type="SVC_REQ",method="Say",le="0.001"} 0`+"\n")
+	assert.Contains(t, out, `saber_dispatch_seconds_bucket{service="chat-1",msg_type="SVC_REQ",method="Say",le="0.005"} 1`+"\n")
+	assert.Contains(t, out, `saber_dispatch_seconds_bucket{service="chat-1",msg_type="SVC_REQ",method="Say",le="+Inf"} 1`+"\n")
+	assert.Contains(t, out, `saber_dispatch_seconds_count{service="chat-1",msg_type="SVC_REQ",method="Say"} 1`+"\n")
+	assert.Contains(t, out, `saber_cluster_sent_bytes_total{cluster="lobby\"1"} 100`+"\n")
+	assert.Contains(t, out, `saber_mailbox_depth{service="chat-1"} 3`+"\n")
+	// 无数据的指标不输出
+	assert.NotContains(t, out, "saber_timer_fires_total")
+}
+
+func TestClusterMetrics(t *testing.T) {
+	sa, sb := newTestClusterPair(t, "test_metrics_a", "test_metrics_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	echo, err := sb.NewService("echo", 1)
+	assert.Nil(t, err)
+	echo.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	})
+	fired := make(chan struct{}, 1)
+	echo.RegisterTimer(func() {
+		fired <- struct{}{}
+	}, 10, 1)
+	client, err := sa.NewService("client", 1)
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = client.CallCluster(context.Background(), "test_metrics_b", "echo", 1, "Echo", "hello")
+		assert.Nil(t, err)
+	}
+	// 服务端未注册的method统一记为unknown
+	for _, method := range []string{"Missing", "Absent"} {
+		_, err = client.CallCluster(context.Background(), "test_metrics_b", "echo", 1, method, "hello")
+		assert.NotNil(t, err)
+	}
+	<-fired
+
+	fa := sa.Metrics().Gather()
+	assert.Equal(t, float64(3), findSample(fa, METRIC_RPC_TOTAL, "client-1", "client", "Echo", "0").Value)
+	assert.Equal(t, float64(1), findSample(fa, METRIC_RPC_TOTAL, "client-1", "client", "Missing", "1").Value)
+	assert.Equal(t, uint64(3), findSample(fa, METRIC_DISPATCH_SECONDS, "client-1", "CLUSTER_RSP", "Echo").Count)
+	assert.Equal(t, float64(5), findSample(fa, METRIC_CLUSTER_SENT_FRAMES, "test_metrics_b").Value)
+	assert.Equal(t, float64(5), findSample(fa, METRIC_CLUSTER_RECV_FRAMES, "test_metrics_b").Value)
+	assert.True(t, findSample(fa, METRIC_CLUSTER_SENT_BYTES, "test_metrics_b").Value > 0)
+	assert.NotNil(t, findSample(fa, METRIC_MAILBOX_DEPTH, "client-1"))
+
+	fb := sb.Metrics().Gather()
+	assert.Equal(t, float64(3), findSample(fb, METRIC_RPC_TOTAL, "echo-1", "server", "Echo", "0").Value)
+	assert.Equal(t, float64(2), findSample(fb, METRIC_RPC_TOTAL, "echo-1", "server", METRIC_UNKNOWN_METHOD, "1").Value)
+	assert.Nil(t, findSample(fb, METRIC_RPC_TOTAL, "echo-1", "server", "Missing", "1"))
+	assert.Equal(t, uint64(3), findSample(fb, METRIC_DISPATCH_SECONDS, "echo-1", "CLUSTER_REQ", "Echo").Count)
+	assert.Equal(t, uint64(2), findSample(fb, METRIC_DISPATCH_SECONDS, "echo-1", "CLUSTER_REQ", METRIC_UNKNOWN_METHOD).Count)
+	assert.Equal(t, float64(1), findSample(fb, METRIC_TIMER_FIRES_TOTAL, "echo-1").Value)
+	assert.Equal(t, float64(5), findSample(fb, METRIC_CLUSTER_RECV_FRAMES, "test_metrics_a").Value)
+	assert.Equal(t, findSample(fa, METRIC_CLUSTER_SENT_BYTES, "test_metrics_b").Value, findSample(fb, METRIC_CLUSTER_RECV_BYTES, "test_metrics_a").Value)
+
+	// 并发采集各自生成快照, 不会读到被其他采集清空的序列
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.NotNil(t, findSample(sa.Metrics().Gather(), METRIC_MAILBOX_DEPTH, "client-1"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 已删除的服务不再上报邮箱积压
+	sb.DelService("echo", 1)
+	assert.Nil(t, findSample(sb.Metrics().Gather(), METRIC_MAILBOX_DEPTH, "echo-1"))
+
+	rec := httptest.NewRecorder()
+	NewPrometheusHandler(sa.Metrics()).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, string(body), `saber_rpc_total{service="client-1",side="client",method="Echo",code="0"} 3`)
+}
@@ -1,102 +1,380 @@
 package saber
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// 循环数组消息队列
-func NewMQueue(cap int) *MsgQueue {
-	mq := &MsgQueue{
-		head: 0,
-		tail: 0,
+// 邮箱请求数达到上限时的处理策略
+type OverflowPolicy int
+
+const (
+	// 拒绝新请求, Call/CallCluster调用方收到ErrCode_Overload
+	OVERFLOW_REJECT OverflowPolicy = iota
+	// 丢弃队列中最早的notify腾出空间, 队列中没有notify时拒绝
+	OVERFLOW_DROP_OLDEST
+	// 阻塞发送方直至有空间, 超时或ctx结束后拒绝. 跨节点请求会阻塞gate读取, 形成对远端的反压
+	OVERFLOW_BLOCK
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OVERFLOW_REJECT:
+		return "reject"
+	case OVERFLOW_DROP_OLDEST:
+		return "drop_oldest"
+	case OVERFLOW_BLOCK:
+		return "block"
+	default:
+		return "unknown"
+	}
+}
+
+// 只有请求受邮箱上限约束, 回包/定时器/流消息始终入队, 避免已发出的rpc和流因回包被丢弃而挂起
+func isRequestMsg(msgType MsgType) bool {
+	return msgType == MSG_TYPE_SVC_REQ || msgType == MSG_TYPE_CLUSTER_REQ
+}
+
+// 消息优先级, 开启优先级后高优先级消息先出队
+type MsgPriority int
+
+const (
+	PRIORITY_RESPONSE MsgPriority = iota // 回包: 唤醒在途rpc
+	PRIORITY_TIMER                       // 定时器
+	PRIORITY_REQUEST                     // 请求及其他消息
+	PRIORITY_NUM
+)
+
+func (p MsgPriority) String() string {
+	switch p {
+	case PRIORITY_RESPONSE:
+		return "response"
+	case PRIORITY_TIMER:
+		return "timer"
+	case PRIORITY_REQUEST:
+		return "request"
+	default:
+		return "unknown"
+	}
+}
+
+func msgPriority(msgType MsgType) MsgPriority {
+	switch msgType {
+	case MSG_TYPE_SVC_RSP, MSG_TYPE_CLUSTER_RSP:
+		return PRIORITY_RESPONSE
+	case MSG_TYPE_TIMER:
+		return PRIORITY_TIMER
+	default:
+		return PRIORITY_REQUEST
+	}
+}
+
+// 循环数组
+type msgRing struct {
+	head int // 队头
+	tail int // 队尾(指向下一个可放置位置)
+	cap  int
+	data []Message
+}
+
+func newMsgRing(cap int) msgRing {
+	return msgRing{
 		cap:  cap,
 		data: make([]Message, cap),
+	}
+}
+
+func (r *msgRing) expand() {
+	newq := make([]Message, r.cap*2)
+	for i := 0; i < r.cap; i++ {
+		newq[i] = r.data[(r.head+i)%r.cap]
+	}
+	r.data = newq
+	r.tail = r.cap
+	r.head = 0
+	r.cap *= 2
+}
+
+func (r *msgRing) push(ctx context.Context, source SVC_HANDLE, msgType MsgType, session uint32, data interface{}) {
+	back := &r.data[r.tail]
+	back.Source = source
+	back.MsgType = msgType
+	back.Session = session
+	back.Data = data
+	back.Ctx = ctx
+	r.tail++
+	if r.tail >= r.cap {
+		r.tail = 0
+	}
+	if r.head == r.tail {
+		r.expand()
+	}
+}
+
+func (r *msgRing) pop() Message {
+	top := r.data[r.head]
+	// 释放引用, 避免出队后ctx和消息体仍被队列持有
+	r.data[r.head] = Message{}
+	r.head++
+	if r.head >= r.cap {
+		r.head = 0
+	}
+	return top
+}
+
+// 由于push时相等会扩容,所以相等只可能是空
+func (r *msgRing) empty() bool {
+	return r.head == r.tail
+}
+
+func (r *msgRing) len() int {
+	if r.tail >= r.head {
+		return r.tail - r.head
+	}
+	return r.tail - r.head + r.cap
+}
+
+// 移除最早的notify, 其后的消息依次前移
+func (r *msgRing) dropOldestNotify() bool {
+	for i := r.head; i != r.tail; i = (i + 1) % r.cap {
+		m := &r.data[i]
+		if !isRequestMsg(m.MsgType) || m.Session != 0 {
+			continue
+		}
+		for j := i; ; {
+			next := (j + 1) % r.cap
+			if next == r.tail {
+				break
+			}
+			r.data[j] = r.data[next]
+			j = next
+		}
+		r.tail = (r.tail - 1 + r.cap) % r.cap
+		r.data[r.tail] = Message{}
+		return true
+	}
+	return false
+}
+
+// 服务邮箱: 默认单个FIFO, 开启优先级后按MsgPriority分多条队列
+func NewMQueue(cap int) *MsgQueue {
+	mq := &MsgQueue{
+		msgRing:     newMsgRing(cap),
 		waitConsume: true,
 	}
 	return mq
 }
 
 type MsgQueue struct {
-	head int // 队头
-	tail int // 队尾(指向下一个可放置位置)
-	cap  int
-	data []Message
-	rwMu sync.RWMutex
+	// 原子操作的64位字段置于结构体开头, 保证32位平台对齐
+	rejected uint64 // 因超过上限被拒绝的请求数
+	dropped  uint64 // OVERFLOW_DROP_OLDEST丢弃的notify数
+
+	msgRing     // 未开启优先级时存放全部消息, 开启后存放PRIORITY_REQUEST
+	rwMu        sync.RWMutex
 	waitConsume bool
+
+	lanes       []*msgRing // 开启优先级时按MsgPriority索引
+	skipped     []int      // 各队列非空但被更高优先级插队的连续次数
+	starveLimit int
+
+	limit        int // 请求数上限, <= 0不限
+	policy       OverflowPolicy
+	blockTimeout time.Duration
+	reqCount     int           // 队列中的请求数
+	spaceNotify  chan struct{} // OVERFLOW_BLOCK下有请求出队时关闭, 唤醒阻塞的发送方
 }
 
-func (mq *MsgQueue) expand() {
-	newq := make([]Message, mq.cap*2)
-	for i := 0; i < mq.cap; i++ {
-		newq[i] = mq.data[(mq.head+i)%mq.cap]
+// 开启优先级: 高优先级消息先出队; 低优先级队列连续被插队starveLimit次后优先出队一条, 避免饿死.
+// starveLimit <= 0使用DEFAULT_STARVE_LIMIT, 需在服务开始收消息前调用
+func (mq *MsgQueue) SetPriority(starveLimit int) {
+	if starveLimit <= 0 {
+		starveLimit = DEFAULT_STARVE_LIMIT
 	}
-	mq.data = newq
-	mq.tail = mq.cap
-	mq.head = 0
-	mq.cap *= 2
+	mq.rwMu.Lock()
+	defer mq.rwMu.Unlock()
+	mq.lanes = make([]*msgRing, PRIORITY_NUM)
+	for i := range mq.lanes {
+		if MsgPriority(i) == PRIORITY_REQUEST {
+			mq.lanes[i] = &mq.msgRing
+		} else {
+			ring := newMsgRing(DEFAULT_MQ_SIZE / 4)
+			mq.lanes[i] = &ring
+		}
+	}
+	mq.skipped = make([]int, PRIORITY_NUM)
+	mq.starveLimit = starveLimit
+}
+
+// 设置请求数上限及溢出策略, 需在服务开始收消息前调用
+func (mq *MsgQueue) SetLimit(limit int, policy OverflowPolicy, blockTimeout time.Duration) {
+	mq.rwMu.Lock()
+	defer mq.rwMu.Unlock()
+	mq.limit = limit
+	mq.policy = policy
+	mq.blockTimeout = blockTimeout
 }
 
-func (mq *MsgQueue) Push(source SVC_HANDLE, msgType MsgType, session uint32, data interface{}) bool {
+// 超过上限被拒绝的请求数和被丢弃的notify数
+func (mq *MsgQueue) Overflows() (rejected, dropped uint64) {
+	return atomic.LoadUint64(&mq.rejected), atomic.LoadUint64(&mq.dropped)
+}
+
+// 请求数达到上限时按policy处理, 拒绝时返回RPC_OVERLOAD_ERR(OVERFLOW_BLOCK下ctx结束时返回对应的超时/取消错误)
+func (mq *MsgQueue) Push(ctx context.Context, source SVC_HANDLE, msgType MsgType, session uint32, data interface{}) (bool, error) {
 	mq.rwMu.Lock()
 	defer mq.rwMu.Unlock()
+	if mq.limit > 0 && isRequestMsg(msgType) && mq.reqCount >= mq.limit {
+		err := mq.makeRoom(ctx, session)
+		if err != nil {
+			atomic.AddUint64(&mq.rejected, 1)
+			return false, err
+		}
+	}
+	if isRequestMsg(msgType) {
+		mq.reqCount++
+	}
 	wakeUp := mq.waitConsume
 	if wakeUp {
 		mq.waitConsume = false
 	}
-	back := &mq.data[mq.tail]
-	back.Source = source
-	back.MsgType = msgType
-	back.Session = session
-	back.Data = data
-	mq.tail++
-	if mq.tail >= mq.cap {
-		mq.tail = 0
+	if mq.lanes != nil {
+		mq.lanes[msgPriority(msgType)].push(ctx, source, msgType, session, data)
+	} else {
+		mq.push(ctx, source, msgType, session, data)
 	}
-	if mq.head == mq.tail {
-		mq.expand()
+	return wakeUp, nil
+}
+
+// 调用时持有rwMu, OVERFLOW_BLOCK等待期间释放
+func (mq *MsgQueue) makeRoom(ctx context.Context, session uint32) error {
+	switch mq.policy {
+	case OVERFLOW_DROP_OLDEST:
+		// 请求均在PRIORITY_REQUEST队列(即内嵌的msgRing)中
+		if mq.dropOldestNotify() {
+			mq.reqCount--
+			atomic.AddUint64(&mq.dropped, 1)
+			return nil
+		}
+	case OVERFLOW_BLOCK:
+		timer := time.NewTimer(mq.blockTimeout)
+		defer timer.Stop()
+		for mq.limit > 0 && mq.reqCount >= mq.limit {
+			if mq.spaceNotify == nil {
+				mq.spaceNotify = make(chan struct{})
+			}
+			space := mq.spaceNotify
+			mq.rwMu.Unlock()
+			select {
+			case <-space:
+				mq.rwMu.Lock()
+			case <-timer.C:
+				mq.rwMu.Lock()
+				return RPC_OVERLOAD_ERR
+			case <-ctx.Done():
+				mq.rwMu.Lock()
+				return rpcCtxError(ctx, session)
+			}
+		}
+		return nil
+	}
+	return RPC_OVERLOAD_ERR
+}
+
+// 开启优先级时选择出队的队列, 返回-1表示全部为空
+func (mq *MsgQueue) pickLane() int {
+	pick := -1
+	for i, lane := range mq.lanes {
+		if lane.empty() {
+			continue
+		}
+		if pick < 0 {
+			pick = i
+		} else if mq.skipped[i] >= mq.starveLimit {
+			// 低优先级队列等待过久, 本次优先出队
+			return i
+		}
 	}
-	return wakeUp
+	return pick
 }
 
-func (mq *MsgQueue) Pop() (empty bool, source SVC_HANDLE, msgType MsgType, session uint32, data interface{}) {
+func (mq *MsgQueue) Pop() (empty bool, ctx context.Context, source SVC_HANDLE, msgType MsgType, session uint32, data interface{}) {
 	mq.rwMu.Lock()
 	defer mq.rwMu.Unlock()
-	if mq.head == mq.tail { // 由于Push时相等会扩容,所以相等只可能是空
+	ring := &mq.msgRing
+	if mq.lanes != nil {
+		pick := mq.pickLane()
+		if pick < 0 {
+			ring = nil
+		} else {
+			ring = mq.lanes[pick]
+			for i, lane := range mq.lanes {
+				if i == pick || lane.empty() {
+					mq.skipped[i] = 0
+				} else {
+					mq.skipped[i]++
+				}
+			}
+		}
+	}
+	if ring == nil || ring.empty() {
 		mq.waitConsume = true
-		return true, 0, 0, 0, nil
+		return true, nil, 0, 0, 0, nil
 	}
-	top := &mq.data[mq.head]
-	mq.head++
-	if mq.head >= mq.cap {
-		mq.head = 0
+	top := ring.pop()
+	if isRequestMsg(top.MsgType) {
+		mq.reqCount--
+		if mq.spaceNotify != nil {
+			close(mq.spaceNotify)
+			mq.spaceNotify = nil
+		}
 	}
-	return false, top.Source, top.MsgType, top.Session, top.Data
+	return false, top.Ctx, top.Source, top.MsgType, top.Session, top.Data
 }
 
-func (mq *MsgQueue) Peek() (empty bool, source SVC_HANDLE, msgType MsgType, session uint32, data interface{}) {
+func (mq *MsgQueue) Peek() (empty bool, ctx context.Context, source SVC_HANDLE, msgType MsgType, session uint32, data interface{}) {
 	mq.rwMu.RLock()
 	defer mq.rwMu.RUnlock()
-	if mq.head == mq.tail { // 由于Push时相等会扩容,所以相等只可能是空
-		return true, 0, 0, 0, nil
+	ring := &mq.msgRing
+	if mq.lanes != nil {
+		pick := mq.pickLane()
+		if pick < 0 {
+			return true, nil, 0, 0, 0, nil
+		}
+		ring = mq.lanes[pick]
+	}
+	if ring.empty() {
+		return true, nil, 0, 0, 0, nil
 	}
-	top := &mq.data[mq.head]
-	return false, top.Source, top.MsgType, top.Session, top.Data
+	top := &ring.data[ring.head]
+	return false, top.Ctx, top.Source, top.MsgType, top.Session, top.Data
 }
 
 func (mq *MsgQueue) Len() int {
 	mq.rwMu.RLock()
 	defer mq.rwMu.RUnlock()
-	if mq.tail >= mq.head {
-		return mq.tail - mq.head
+	return mq.len()
+}
+
+// 持有rwMu时调用
+func (mq *MsgQueue) len() int {
+	if mq.lanes == nil {
+		return mq.msgRing.len()
+	}
+	n := 0
+	for _, lane := range mq.lanes {
+		n += lane.len()
 	}
-	return mq.tail - mq.head + mq.cap
+	return n
 }
 
 func (mq *MsgQueue) debug() {
 	mq.rwMu.RLock()
 	defer mq.rwMu.RUnlock()
-	fmt.Printf("head:%d tail:%d cap:%d len:%d\n", mq.head, mq.tail, mq.cap, mq.Len())
+	fmt.Printf("head:%d tail:%d cap:%d len:%d\n", mq.head, mq.tail, mq.cap, mq.len())
 	for i := mq.head; i != mq.tail; i = (i + 1) % mq.cap {
 		fmt.Println(mq.data[i])
 	}
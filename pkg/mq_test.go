@@ -1,7 +1,12 @@
 package saber
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -9,17 +14,17 @@ import (
 func TestMsgQueue(t *testing.T) {
 	mq := NewMQueue(3)
 	data := []Message{
-		{0, MSG_TYPE_TIMER, 1, nil},
-		{0, MSG_TYPE_TIMER, 2, nil},
-		{0, MSG_TYPE_TIMER, 3, nil},
-		{0, MSG_TYPE_TIMER, 4, nil},
-		{0, MSG_TYPE_TIMER, 5, nil},
-		{0, MSG_TYPE_TIMER, 6, nil},
-		{0, MSG_TYPE_TIMER, 7, nil},
-		{0, MSG_TYPE_TIMER, 8, nil},
+		{MsgType: MSG_TYPE_TIMER, Session: 1},
+		{MsgType: MSG_TYPE_TIMER, Session: 2},
+		{MsgType: MSG_TYPE_TIMER, Session: 3},
+		{MsgType: MSG_TYPE_TIMER, Session: 4},
+		{MsgType: MSG_TYPE_TIMER, Session: 5},
+		{MsgType: MSG_TYPE_TIMER, Session: 6},
+		{MsgType: MSG_TYPE_TIMER, Session: 7},
+		{MsgType: MSG_TYPE_TIMER, Session: 8},
 	}
 	for i := range data {
-		mq.Push(data[i].Source, data[i].MsgType, data[i].Session, data[i].Data)
+		mq.Push(data[i].Ctx, data[i].Source, data[i].MsgType, data[i].Session, data[i].Data)
 	}
 	assert.Equal(t, 0, mq.head)
 	assert.Equal(t, 8, mq.tail)
@@ -33,31 +38,268 @@ func TestMsgQueue(t *testing.T) {
 	assert.Equal(t, 8, mq.tail)
 	assert.Equal(t, 4, mq.Len())
 	data = []Message{
-		{0, MSG_TYPE_TIMER, 9, nil},
-		{0, MSG_TYPE_TIMER, 10, nil},
-		{0, MSG_TYPE_TIMER, 11, nil},
-		{0, MSG_TYPE_TIMER, 12, nil},
-		{0, MSG_TYPE_TIMER, 13, nil},
-		{0, MSG_TYPE_TIMER, 14, nil},
-		{0, MSG_TYPE_TIMER, 15, nil},
+		{MsgType: MSG_TYPE_TIMER, Session: 9},
+		{MsgType: MSG_TYPE_TIMER, Session: 10},
+		{MsgType: MSG_TYPE_TIMER, Session: 11},
+		{MsgType: MSG_TYPE_TIMER, Session: 12},
+		{MsgType: MSG_TYPE_TIMER, Session: 13},
+		{MsgType: MSG_TYPE_TIMER, Session: 14},
+		{MsgType: MSG_TYPE_TIMER, Session: 15},
 	}
 	for i := range data {
-		mq.Push(data[i].Source, data[i].MsgType, data[i].Session, data[i].Data)
+		mq.Push(data[i].Ctx, data[i].Source, data[i].MsgType, data[i].Session, data[i].Data)
 	}
 	assert.Equal(t, 4, mq.head)
 	assert.Equal(t, 3, mq.tail)
 	assert.Equal(t, 11, mq.Len())
 	assert.Equal(t, 12, mq.cap)
-	_, _, _, session, _ := mq.Peek()
+	_, _, _, _, session, _ := mq.Peek()
 	assert.Equal(t, uint32(5), session)
 	// 打印一下
 	mq.debug()
 	// 临界触发expand
-	mq.Push(0, MSG_TYPE_TIMER, 16, nil)
+	mq.Push(nil, 0, MSG_TYPE_TIMER, 16, nil)
 	assert.Equal(t, 0, mq.head)
 	assert.Equal(t, 12, mq.tail)
 	assert.Equal(t, 12, mq.Len())
 	assert.Equal(t, 24, mq.cap)
-	_, _, _, session, _ = mq.Peek()
+	_, _, _, _, session, _ = mq.Peek()
 	assert.Equal(t, uint32(5), session)
 }
+
+func popData(mq *MsgQueue) interface{} {
+	_, _, _, _, _, data := mq.Pop()
+	return data
+}
+
+func TestBoundedMsgQueue(t *testing.T) {
+	mq := NewMQueue(4)
+	mq.SetLimit(2, OVERFLOW_REJECT, 0)
+	_, err := mq.Push(nil, 0, MSG_TYPE_SVC_REQ, 1, "call1")
+	assert.Nil(t, err)
+	_, err = mq.Push(nil, 0, MSG_TYPE_CLUSTER_REQ, 0, "notify1")
+	assert.Nil(t, err)
+	_, err = mq.Push(nil, 0, MSG_TYPE_SVC_REQ, 2, "call2")
+	assert.True(t, errors.Is(err, RPC_OVERLOAD_ERR))
+	// 回包和定时器不受上限约束
+	_, err = mq.Push(nil, 0, MSG_TYPE_SVC_RSP, 3, "rsp")
+	assert.Nil(t, err)
+	_, err = mq.Push(nil, 0, MSG_TYPE_TIMER, 4, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, mq.Len())
+	assert.Equal(t, "call1", popData(mq))
+	_, err = mq.Push(nil, 0, MSG_TYPE_SVC_REQ, 2, "call2")
+	assert.Nil(t, err)
+	rejected, dropped := mq.Overflows()
+	assert.Equal(t, uint64(1), rejected)
+	assert.Equal(t, uint64(0), dropped)
+
+	// 丢弃最早的notify, 队列绕圈时保持顺序
+	mq = NewMQueue(4)
+	mq.SetLimit(3, OVERFLOW_DROP_OLDEST, 0)
+	mq.Push(nil, 0, MSG_TYPE_TIMER, 1, "timer")
+	mq.Push(nil, 0, MSG_TYPE_TIMER, 2, "timer")
+	popData(mq)
+	popData(mq)
+	for _, m := range []Message{
+		{MsgType: MSG_TYPE_SVC_REQ, Session: 1, Data: "call1"},
+		{MsgType: MSG_TYPE_SVC_REQ, Data: "notify1"},
+		{MsgType: MSG_TYPE_CLUSTER_REQ, Data: "notify2"},
+		{MsgType: MSG_TYPE_SVC_REQ, Data: "notify3"},
+		{MsgType: MSG_TYPE_SVC_REQ, Session: 2, Data: "call2"},
+		{MsgType: MSG_TYPE_SVC_RSP, Session: 3, Data: "rsp"},
+	} {
+		_, err = mq.Push(nil, m.Source, m.MsgType, m.Session, m.Data)
+		assert.Nil(t, err)
+	}
+	_, err = mq.Push(nil, 0, MSG_TYPE_SVC_REQ, 4, "call3")
+	assert.Nil(t, err)
+	// 队列中已没有notify
+	_, err = mq.Push(nil, 0, MSG_TYPE_SVC_REQ, 0, "notify4")
+	assert.True(t, errors.Is(err, RPC_OVERLOAD_ERR))
+	for _, data := range []string{"call1", "call2", "rsp", "call3"} {
+		assert.Equal(t, data, popData(mq))
+	}
+	empty, _, _, _, _, _ := mq.Pop()
+	assert.True(t, empty)
+	rejected, dropped = mq.Overflows()
+	assert.Equal(t, uint64(1), rejected)
+	assert.Equal(t, uint64(3), dropped)
+
+	// 阻塞发送方直至有请求出队
+	mq = NewMQueue(4)
+	mq.SetLimit(1, OVERFLOW_BLOCK, time.Second)
+	_, err = mq.Push(nil, 0, MSG_TYPE_SVC_REQ, 1, "call1")
+	assert.Nil(t, err)
+	pushed := make(chan error, 1)
+	go func() {
+		_, err := mq.Push(context.Background(), 0, MSG_TYPE_SVC_REQ, 2, "call2")
+		pushed <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, len(pushed))
+	assert.Equal(t, "call1", popData(mq))
+	assert.Nil(t, <-pushed)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = mq.Push(ctx, 0, MSG_TYPE_SVC_REQ, 3, "call3")
+	assert.True(t, errors.Is(err, RPC_CANCELED_ERR))
+	mq.SetLimit(1, OVERFLOW_BLOCK, 20*time.Millisecond)
+	_, err = mq.Push(context.Background(), 0, MSG_TYPE_SVC_REQ, 4, "call4")
+	assert.True(t, errors.Is(err, RPC_OVERLOAD_ERR))
+	assert.Equal(t, "call2", popData(mq))
+	rejected, _ = mq.Overflows()
+	assert.Equal(t, uint64(2), rejected)
+}
+
+func TestPriorityMsgQueue(t *testing.T) {
+	mq := NewMQueue(4)
+	mq.SetPriority(2)
+	for _, m := range []Message{
+		{MsgType: MSG_TYPE_SVC_REQ, Data: "req1"},
+		{MsgType: MSG_TYPE_CLUSTER_REQ, Data: "req2"},
+		{MsgType: MSG_TYPE_SVC_REQ, Data: "req3"},
+		{MsgType: MSG_TYPE_TIMER, Data: "timer1"},
+		{MsgType: MSG_TYPE_SVC_RSP, Data: "rsp1"},
+		{MsgType: MSG_TYPE_CLUSTER_RSP, Data: "rsp2"},
+		{MsgType: MSG_TYPE_SVC_RSP, Data: "rsp3"},
+		{MsgType: MSG_TYPE_SVC_RSP, Data: "rsp4"},
+	} {
+		mq.Push(nil, m.Source, m.MsgType, m.Session, m.Data)
+	}
+	assert.Equal(t, 8, mq.Len())
+	_, _, _, _, _, data := mq.Peek()
+	assert.Equal(t, "rsp1", data)
+	// 回包优先, 低优先级连续被插队2次后出队一条
+	for _, data := range []string{"rsp1", "rsp2", "timer1", "req1", "rsp3", "rsp4", "req2", "req3"} {
+		assert.Equal(t, data, popData(mq))
+	}
+	empty, _, _, _, _, _ := mq.Pop()
+	assert.True(t, empty)
+	assert.Equal(t, 0, mq.Len())
+
+	// 与有界邮箱组合: 上限只统计请求
+	mq.SetLimit(1, OVERFLOW_DROP_OLDEST, 0)
+	mq.Push(nil, 0, MSG_TYPE_SVC_REQ, 0, "notify1")
+	mq.Push(nil, 0, MSG_TYPE_TIMER, 1, "timer2")
+	_, err := mq.Push(nil, 0, MSG_TYPE_SVC_REQ, 2, "call1")
+	assert.Nil(t, err)
+	assert.Equal(t, "timer2", popData(mq))
+	assert.Equal(t, "call1", popData(mq))
+}
+
+func TestMPSCQueue(t *testing.T) {
+	q := NewMPSCQueue()
+	empty, _, _, _, _, _ := q.Pop()
+	assert.True(t, empty)
+	wakeUp, err := q.Push(nil, 1, MSG_TYPE_SVC_REQ, 1, "req1")
+	assert.Nil(t, err)
+	assert.True(t, wakeUp)
+	wakeUp, _ = q.Push(nil, 2, MSG_TYPE_SVC_RSP, 2, "rsp1")
+	assert.False(t, wakeUp)
+	assert.Equal(t, 2, q.Len())
+	empty, _, source, msgType, session, data := q.Pop()
+	assert.False(t, empty)
+	assert.Equal(t, SVC_HANDLE(1), source)
+	assert.Equal(t, MSG_TYPE_SVC_REQ, msgType)
+	assert.Equal(t, uint32(1), session)
+	assert.Equal(t, "req1", data)
+	_, _, _, _, _, data = q.Pop()
+	assert.Equal(t, "rsp1", data)
+	empty, _, _, _, _, _ = q.Pop()
+	assert.True(t, empty)
+	assert.Equal(t, 0, q.Len())
+	// 消费方等待时再次唤醒
+	wakeUp, _ = q.Push(nil, 0, MSG_TYPE_TIMER, 3, nil)
+	assert.True(t, wakeUp)
+
+	// 多生产者并发入队: 不丢消息, 不丢唤醒, 同一生产者的消息保持顺序
+	const producers, num = 8, 10000
+	q = NewMPSCQueue()
+	notify := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < num; i++ {
+				wakeUp, _ := q.Push(nil, SVC_HANDLE(p), MSG_TYPE_SVC_REQ, 0, i)
+				if wakeUp {
+					select {
+					case notify <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}(p)
+	}
+	next := make([]int, producers)
+	for recv := 0; recv < producers*num; {
+		empty, _, source, _, _, data := q.Pop()
+		if empty {
+			select {
+			case <-notify:
+			case <-time.After(time.Second):
+				t.Fatalf("lost wake up, recv %d", recv)
+			}
+			continue
+		}
+		assert.Equal(t, next[source], data)
+		next[source]++
+		recv++
+	}
+	wg.Wait()
+	assert.Equal(t, 0, q.Len())
+}
+
+// 多生产者扇入单消费者, 消费方按Serve的方式等待唤醒
+func benchmarkMailbox(b *testing.B, mb Mailbox, producers int) {
+	notify := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		for recv := 0; recv < b.N; {
+			empty, _, _, _, _, _ := mb.Pop()
+			if empty {
+				<-notify
+				continue
+			}
+			recv++
+		}
+		close(done)
+	}()
+	b.ReportAllocs()
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		n := b.N / producers
+		if p < b.N%producers {
+			n++
+		}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				wakeUp, _ := mb.Push(nil, 0, MSG_TYPE_SVC_REQ, 0, nil)
+				if wakeUp {
+					select {
+					case notify <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+	<-done
+}
+
+func BenchmarkMailbox(b *testing.B) {
+	for _, producers := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("ring-%d", producers), func(b *testing.B) {
+			benchmarkMailbox(b, NewMQueue(DEFAULT_MQ_SIZE), producers)
+		})
+		b.Run(fmt.Sprintf("mpsc-%d", producers), func(b *testing.B) {
+			benchmarkMailbox(b, NewMPSCQueue(), producers)
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package saber
+
+import "time"
+
+// Provide service Optional Config Parameters
+
+type svcOptions struct {
+	parallel       int            // 真并发模式下同时执行的handler数上限, <= 0 表示伪并发模式
+	mailboxSize    int            // 邮箱中请求数上限, <= 0 表示不限
+	overflowPolicy OverflowPolicy // 请求数达到上限时的处理策略
+	blockTimeout   time.Duration  // OVERFLOW_BLOCK策略下发送方最长阻塞时间
+	priority       bool           // 邮箱是否按MsgPriority分优先级
+	starveLimit    int            // 低优先级消息最多连续被插队次数
+	mailboxKind    MailboxKind    // 邮箱实现
+}
+
+type SvcOption interface {
+	apply(*svcOptions)
+}
+
+type funcSvcOption struct {
+	f func(*svcOptions)
+}
+
+func (fso *funcSvcOption) apply(so *svcOptions) {
+	fso.f(so)
+}
+
+func newFuncSvcOption(f func(*svcOptions)) *funcSvcOption {
+	return &funcSvcOption{
+		f: f,
+	}
+}
+
+// 真并发模式: 服务最多同时执行n个消息处理函数, 适用于无状态(或自行保证并发安全)的服务
+// 注意: 该模式下handler, 定时器回调之间不再串行执行
+func WithParallel(n int) SvcOption {
+	return newFuncSvcOption(func(so *svcOptions) {
+		so.parallel = n
+	})
+}
+
+// 有界邮箱: 队列中的请求(SVC_REQ/CLUSTER_REQ)数达到size时按policy处理, 避免慢服务邮箱无限增长.
+// 被拒绝的rpc返回ErrCode_Overload, 跨节点请求由gate回复远端调用方
+func WithMailbox(size int, policy OverflowPolicy) SvcOption {
+	return newFuncSvcOption(func(so *svcOptions) {
+		so.mailboxSize = size
+		so.overflowPolicy = policy
+	})
+}
+
+// OVERFLOW_BLOCK策略下发送方最长阻塞时间, 默认DEFAULT_MQ_BLOCK_MS
+func WithBlockTimeout(d time.Duration) SvcOption {
+	return newFuncSvcOption(func(so *svcOptions) {
+		so.blockTimeout = d
+	})
+}
+
+// 邮箱优先级: 回包 > 定时器 > 请求, 避免大量请求堆积时在途rpc的回包和定时器排队等待.
+// 低优先级消息连续被插队starveLimit次后优先处理一条, starveLimit <= 0使用DEFAULT_STARVE_LIMIT.
+// 注意: 不同优先级的消息之间不再保证按到达顺序处理
+func WithPriority(starveLimit int) SvcOption {
+	return newFuncSvcOption(func(so *svcOptions) {
+		so.priority = true
+		so.starveLimit = starveLimit
+	})
+}
+
+// 邮箱实现, 默认MAILBOX_RING. MAILBOX_MPSC入队无锁, 适用于多生产者扇入的热点服务,
+// 不能与WithMailbox, WithPriority同时使用
+func WithMailboxKind(kind MailboxKind) SvcOption {
+	return newFuncSvcOption(func(so *svcOptions) {
+		so.mailboxKind = kind
+	})
+}
+
+func defaultSvcOptions() svcOptions {
+	return svcOptions{
+		parallel:     0,
+		blockTimeout: DEFAULT_MQ_BLOCK_MS * time.Millisecond,
+	}
+}
+
+// Provide rpc call Optional Config Parameters
+
+type callOptions struct {
+	timeout time.Duration // 0: 沿用ctx或Server默认超时, < 0: 不超时
+}
+
+type CallOption interface {
+	apply(*callOptions)
+}
+
+type funcCallOption struct {
+	f func(*callOptions)
+}
+
+func (fco *funcCallOption) apply(co *callOptions) {
+	fco.f(co)
+}
+
+func newFuncCallOption(f func(*callOptions)) *funcCallOption {
+	return &funcCallOption{
+		f: f,
+	}
+}
+
+// 单次rpc超时, 优先级高于ctx中的CtxKeyRpcTimeoutMS和Server默认超时; ctx自身的deadline始终生效
+func WithTimeout(d time.Duration) CallOption {
+	return newFuncCallOption(func(co *callOptions) {
+		co.timeout = d
+	})
+}
+
+func defaultCallOptions() callOptions {
+	return callOptions{
+		timeout: 0,
+	}
+}
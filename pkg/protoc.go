@@ -1,7 +1,9 @@
 package saber
 
 import (
+	"context"
 	"fmt"
+	"time"
 )
 
 type MsgType int
@@ -10,6 +12,10 @@ func (mt MsgType) IsClusterMsg() bool {
 	return mt == MSG_TYPE_CLUSTER_REQ || mt == MSG_TYPE_CLUSTER_RSP
 }
 
+func (mt MsgType) IsStreamMsg() bool {
+	return mt >= MSG_TYPE_STREAM_OPEN && mt <= MSG_TYPE_STREAM_CLOSE
+}
+
 func (mt MsgType) String() string {
 	switch mt {
 	case MSG_TYPE_TIMER:
@@ -22,6 +28,16 @@ func (mt MsgType) String() string {
 		return "CLUSTER_REQ"
 	case MSG_TYPE_CLUSTER_RSP:
 		return "CLUSTER_RSP"
+	case MSG_TYPE_STREAM_OPEN:
+		return "STREAM_OPEN"
+	case MSG_TYPE_STREAM_DATA:
+		return "STREAM_DATA"
+	case MSG_TYPE_STREAM_WINDOW:
+		return "STREAM_WINDOW"
+	case MSG_TYPE_STREAM_CLOSE:
+		return "STREAM_CLOSE"
+	case MSG_TYPE_STOP:
+		return "STOP"
 	default:
 		return "unknown"
 	}
@@ -33,11 +49,19 @@ const (
 	MSG_TYPE_SVC_RSP
 	MSG_TYPE_CLUSTER_REQ
 	MSG_TYPE_CLUSTER_RSP
+	MSG_TYPE_STREAM_OPEN   // 发起流, 经由目标服务消息队列启动stream handler
+	MSG_TYPE_STREAM_DATA   // 流数据分片
+	MSG_TYPE_STREAM_WINDOW // 流控窗口更新
+	MSG_TYPE_STREAM_CLOSE  // 结束发送或异常中断
+	MSG_TYPE_STOP          // 服务停止, 执行OnStop回调, 仅节点内使用
 )
 
 type SvcRequest struct {
-	Method string
-	Body   interface{}
+	Method      string
+	Body        interface{}
+	Deadline    time.Time // 跨节点请求按剩余超时还原的截止时间, 零值表示不限
+	Metadata    Metadata
+	wireVersion uint8 // 跨节点请求方使用的协议版本, 回包时沿用
 }
 
 type SvcResponse struct {
@@ -56,6 +80,7 @@ type Message struct {
 	MsgType MsgType
 	Session uint32
 	Data    interface{}
+	Ctx     context.Context // 节点内请求的调用方ctx
 }
 
 func (m *Message) String() string {
@@ -0,0 +1,134 @@
+package saber
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	ctxType   = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+type msgKey struct {
+	msgType MsgType
+	method  string
+}
+
+// 消息类型注册表: (MsgType, method) -> 消息具体类型, 供Codec解码时构造具体结构
+// 注意: 同一节点内, 同一method对应的消息类型需唯一
+type MsgRegistry struct {
+	rwMu  sync.RWMutex
+	types map[msgKey]reflect.Type
+}
+
+func NewMsgRegistry() *MsgRegistry {
+	return &MsgRegistry{
+		types: make(map[msgKey]reflect.Type),
+	}
+}
+
+func (r *MsgRegistry) Register(msgType MsgType, method string, t reflect.Type) error {
+	if t == nil {
+		return fmt.Errorf("register nil msg type: %s %s", msgType, method)
+	}
+	r.rwMu.Lock()
+	defer r.rwMu.Unlock()
+	key := msgKey{msgType: msgType, method: method}
+	if old := r.types[key]; old != nil && old != t {
+		return fmt.Errorf("register conflict msg type: %s %s %v != %v", msgType, method, old, t)
+	}
+	r.types[key] = t
+	return nil
+}
+
+func (r *MsgRegistry) Lookup(msgType MsgType, method string) reflect.Type {
+	r.rwMu.RLock()
+	defer r.rwMu.RUnlock()
+	return r.types[msgKey{msgType: msgType, method: method}]
+}
+
+// 按注册类型构造消息并解码: 指针类型返回指针, 否则返回值
+func decodeAs(t reflect.Type, data []byte, unmarshal func([]byte, interface{}) error) (interface{}, error) {
+	if t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		if err := unmarshal(data, v.Interface()); err != nil {
+			return nil, err
+		}
+		return v.Interface(), nil
+	}
+	v := reflect.New(t)
+	if err := unmarshal(data, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+// 强类型handler: func(ctx context.Context, req *Req) (rsp *Rsp, err error)
+type typedHandler struct {
+	reqType reflect.Type
+	rspType reflect.Type
+	fn      reflect.Value
+}
+
+func newTypedHandler(handler interface{}) (*typedHandler, error) {
+	fn := reflect.ValueOf(handler)
+	ft := fn.Type()
+	if ft.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%w: %v is not func", RPC_HANDLER_TYPE_ERR, ft)
+	}
+	if ft.NumIn() != 2 || ft.In(0) != ctxType {
+		return nil, fmt.Errorf("%w: %v want func(context.Context, Req)", RPC_HANDLER_TYPE_ERR, ft)
+	}
+	if ft.NumOut() != 2 {
+		return nil, fmt.Errorf("%w: %v want (Rsp, error)", RPC_RETVALUE_NUM_ERR, ft)
+	}
+	if ft.Out(1) != errorType {
+		return nil, fmt.Errorf("%w: %v want (Rsp, error)", RPC_RETVALUE_TYPE_ERR, ft)
+	}
+	return &typedHandler{
+		reqType: ft.In(1),
+		rspType: ft.Out(0),
+		fn:      fn,
+	}, nil
+}
+
+func (h *typedHandler) checkReq(method string, req interface{}) error {
+	if req == nil {
+		switch h.reqType.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+			return nil
+		}
+	} else if reflect.TypeOf(req).AssignableTo(h.reqType) {
+		return nil
+	}
+	return fmt.Errorf("%w: method %s expect %v, got %T", RPC_REQ_TYPE_ERR, method, h.reqType, req)
+}
+
+func (h *typedHandler) wrap(method string) SvcHandlerFunc {
+	return func(ctx context.Context, req interface{}) (interface{}, error) {
+		if err := h.checkReq(method, req); err != nil {
+			return nil, err
+		}
+		arg := reflect.Zero(h.reqType)
+		if req != nil {
+			arg = reflect.ValueOf(req)
+		}
+		out := h.fn.Call([]reflect.Value{reflect.ValueOf(ctx), arg})
+		err, _ := out[1].Interface().(error)
+		return nilableInterface(out[0]), err
+	}
+}
+
+// 值为nil的指针/map/slice等返回无类型nil, 避免调用方拿到非nil的interface{}
+func nilableInterface(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Chan, reflect.Func:
+		if v.IsNil() {
+			return nil
+		}
+	}
+	return v.Interface()
+}
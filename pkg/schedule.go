@@ -6,6 +6,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/xingshuo/saber/common/utils"
 )
 
 type waitPool struct {
@@ -30,14 +32,93 @@ func newWaitPool() *waitPool {
 	}
 }
 
+type execCtxKey struct{}
+
+// handler的一次执行(请求, 流, 停止回调及定时器): 伪并发模式下持有服务执行权, 真并发模式下占用一个worker名额.
+// 经由handler的ctx传递, 只有持有者发起的rpc需要让出执行权, 其他goroutine(如main)发起的rpc直接等待回包.
+// handler执行期间其他goroutine使用其ctx发起rpc时视同handler本身, 需要并发发起rpc时应使用真并发模式
+type svcExec struct {
+	svc     *Service
+	runner  *svcRunner // 伪并发模式下内联执行所在的分发循环
+	holding int32      // 1:持有执行权, 0:让出等待回包, -1:执行结束
+}
+
+func withExec(ctx context.Context, e *svcExec) context.Context {
+	return context.WithValue(ctx, execCtxKey{}, e)
+}
+
+// 执行结束, 返回是否仍持有执行权. 之后仍使用该ctx发起的rpc(如handler创建的goroutine)不再让出执行权
+func (e *svcExec) finish() bool {
+	return atomic.SwapInt32(&e.holding, -1) == 1
+}
+
+// 声明让出执行权: 发起rpc的是持有执行权的handler时返回其执行记录, 否则返回nil.
+// handler经由ctx识别; 定时器回调没有ctx, 按执行期间登记的goroutine id识别
+func (s *Service) claimExec(ctx context.Context) *svcExec {
+	if e, ok := ctx.Value(execCtxKey{}).(*svcExec); ok && e.svc == s && atomic.CompareAndSwapInt32(&e.holding, 1, 0) {
+		return e
+	}
+	if atomic.LoadInt32(&s.timerRunning) == 0 {
+		return nil
+	}
+	s.timerMu.Lock()
+	e := s.timerExecs[utils.GoroutineID()]
+	s.timerMu.Unlock()
+	if e != nil && atomic.CompareAndSwapInt32(&e.holding, 1, 0) {
+		return e
+	}
+	return nil
+}
+
+// 放弃让出(rpc未发出)
+func (s *Service) unclaimExec(e *svcExec) {
+	if e != nil && !atomic.CompareAndSwapInt32(&e.holding, 0, 1) && s.isParallel() {
+		// 期间handler已执行结束, 由这里归还名额
+		<-s.workers
+	}
+}
+
+// 登记定时器回调所在goroutine, 返回goroutine id
+func (s *Service) enterTimer(e *svcExec) int64 {
+	var goid int64
+	if r := e.runner; r != nil {
+		// 伪并发模式下定时器在分发goroutine上执行, 同一分发循环只获取一次
+		if r.goid == 0 {
+			r.goid = utils.GoroutineID()
+		}
+		goid = r.goid
+	} else {
+		goid = utils.GoroutineID()
+	}
+	s.timerMu.Lock()
+	s.timerExecs[goid] = e
+	s.timerMu.Unlock()
+	atomic.AddInt32(&s.timerRunning, 1)
+	return goid
+}
+
+func (s *Service) leaveTimer(goid int64) {
+	atomic.AddInt32(&s.timerRunning, -1)
+	s.timerMu.Lock()
+	delete(s.timerExecs, goid)
+	s.timerMu.Unlock()
+}
+
+// 等待回包的rpc
+type waitSession struct {
+	done    chan *SvcResponse
+	yielded bool // 发起方让出了执行权, 唤醒后需等待其交还
+}
+
 type SessionStore struct {
-	waitSessions map[uint32]chan *SvcResponse
+	mu           sync.Mutex // 真并发模式下多个handler会同时发起rpc
+	waitSessions map[uint32]waitSession
 	waitPool     *waitPool
 	seq          uint32
 }
 
 func (ss *SessionStore) Init() {
-	ss.waitSessions = make(map[uint32]chan *SvcResponse)
+	ss.waitSessions = make(map[uint32]waitSession)
 }
 
 func (ss *SessionStore) NewSessionID() uint32 {
@@ -49,55 +130,120 @@ func (ss *SessionStore) NewSessionID() uint32 {
 	}
 }
 
-// Fixme: 存在2个goroutine同时访问ss.waitSessions的情况(Wait的超时和WakeUp并行), 不过目前只有读取和删除会并发, 暂时不加锁
-func (ss *SessionStore) WakeUp(session uint32, rsp *SvcResponse) error {
-	done := ss.waitSessions[session]
-	if done == nil {
-		return RPC_SESSION_NOEXIST_ERR
+func (ss *SessionStore) remove(session uint32) {
+	ss.mu.Lock()
+	delete(ss.waitSessions, session)
+	ss.mu.Unlock()
+}
+
+// 等待回包的rpc数
+func (ss *SessionStore) pending() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return len(ss.waitSessions)
+}
+
+// 返回等待方是否让出了执行权
+func (ss *SessionStore) WakeUp(session uint32, rsp *SvcResponse) (bool, error) {
+	ss.mu.Lock()
+	ws, ok := ss.waitSessions[session]
+	if !ok {
+		ss.mu.Unlock()
+		return false, RPC_SESSION_NOEXIST_ERR
 	}
 	delete(ss.waitSessions, session)
+	ss.mu.Unlock()
 	select {
-	case done <- rsp:
-		return nil
+	case ws.done <- rsp:
+		return ws.yielded, nil
 	default: // Wait和 Wakeup并行先触发超时了, 所以失败
-		return RPC_WAKEUP_ERR
+		return false, RPC_WAKEUP_ERR
 	}
 }
 
-func (ss *SessionStore) Wait(ctx context.Context, session uint32, srcSvc *Service, onWait func() error) (interface{}, error) {
-	done := ss.waitSessions[session]
+// 超时或ctx取消后放弃等待, 返回等待chan是否可复用
+func (ss *SessionStore) cancel(session uint32) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	_, waiting := ss.waitSessions[session]
+	delete(ss.waitSessions, session)
+	// WakeUp已取走chan时可能已写入回包, 不能再放回pool
+	return waiting
+}
+
+func rpcCtxError(ctx context.Context, session uint32) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &Error{
+			Code:    ErrCode_Timeout,
+			Message: fmt.Sprintf("rpc timeout session %d: %v", session, ctx.Err()),
+			cause:   ctx.Err(),
+		}
+	}
+	return &Error{
+		Code:    ErrCode_Canceled,
+		Message: fmt.Sprintf("rpc canceled session %d: %v", session, ctx.Err()),
+		cause:   ctx.Err(),
+	}
+}
+
+// timeout <= 0时只受ctx的deadline/cancel约束
+func (ss *SessionStore) Wait(ctx context.Context, session uint32, srcSvc *Service, timeout time.Duration, onWait func() error) (interface{}, error) {
+	// 只有持有执行权的handler需要让出, 须在登记前确定: 其他goroutine的回包可能在onWait返回前就被分发
+	e := srcSvc.claimExec(ctx)
+	yielded := e != nil
+	ss.mu.Lock()
 	// 理论上不可能出现
-	if done != nil {
+	if _, ok := ss.waitSessions[session]; ok {
+		ss.mu.Unlock()
+		srcSvc.unclaimExec(e)
 		return nil, RPC_SESSION_REPEAT_ERR
 	}
-	done = ss.waitPool.get() // 防止写端先写入,读端还未进入读取状态, 设置缓存大小为1
-	ss.waitSessions[session] = done
+	done := ss.waitPool.get() // 防止写端先写入,读端还未进入读取状态, 设置缓存大小为1
+	ss.waitSessions[session] = waitSession{done: done, yielded: yielded}
+	ss.mu.Unlock()
+	// 先登记session再检查, 保证与abort并发时要么这里返回, 要么abort唤醒该session
+	if srcSvc.isAborted() && ss.cancel(session) {
+		srcSvc.unclaimExec(e)
+		ss.waitPool.put(done)
+		return nil, RPC_SHUTDOWN_ERR
+	}
 	err := onWait()
 	if err != nil {
-		delete(ss.waitSessions, session)
+		srcSvc.unclaimExec(e)
+		ss.remove(session)
 		ss.waitPool.put(done)
 		return nil, err
 	}
-	if !srcSvc.isParallel() { // 通知Serve继续处理其他消息
-		srcSvc.suspend <- struct{}{}
+	// 让出执行权, 通知Serve继续处理其他消息
+	if yielded {
+		srcSvc.yield(e)
+		defer srcSvc.reacquire(e)
 	}
-	timeout, _ := ctx.Value(CtxKeyRpcTimeoutMS).(time.Duration)
+	var timeoutC <-chan time.Time
 	if timeout > 0 {
 		timer := time.NewTimer(timeout)
-		select {
-		case <-timer.C:
-			delete(ss.waitSessions, session)
-			ss.waitPool.put(done)
-			return nil, fmt.Errorf("%w session %d", RPC_TIMEOUT_ERR, session)
-		case rsp := <-done:
-			ss.waitPool.put(done)
-			timer.Stop()
-			return rsp.Body, rsp.Err
-		}
+		defer timer.Stop()
+		timeoutC = timer.C
 	}
+	var rpcErr error
 	select {
 	case rsp := <-done:
 		ss.waitPool.put(done)
 		return rsp.Body, rsp.Err
+	case <-timeoutC:
+		rpcErr = fmt.Errorf("%w session %d", RPC_TIMEOUT_ERR, session)
+	case <-ctx.Done():
+		rpcErr = rpcCtxError(ctx, session)
+	}
+	if srcSvc.isParallel() || !yielded {
+		if ss.cancel(session) {
+			ss.waitPool.put(done)
+		}
+		return nil, rpcErr
 	}
+	// 伪并发模式: 经由服务消息队列唤醒, 保证重新获得执行权后再返回, 之后到达的回包会因session不存在被丢弃
+	srcSvc.pushMsg(context.Background(), srcSvc.handle, MSG_TYPE_SVC_RSP, session, &SvcResponse{Err: rpcErr})
+	rsp := <-done
+	ss.waitPool.put(done)
+	return rsp.Body, rsp.Err
 }
@@ -1,13 +1,19 @@
 package saber
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/xingshuo/saber/common/log"
 	"github.com/xingshuo/saber/common/utils"
@@ -18,46 +24,220 @@ type ServerConfig struct {
 	LocalAddr      string            // 本进程/容器 mesh地址 ip:port
 	RemoteAddrs    map[string]string // 远端节点地址表
 	TickIntervalMs int64             // 定时器检测间隔:毫秒
+	RpcTimeoutMs   int64             // rpc默认超时:毫秒, == 0使用DEFAULT_RPC_TIMEOUT_MS, < 0不超时
+	LogLevel       string            // 日志等级: debug, info, warning, error. 默认info
+	MaxMsgSize     int               // 跨节点单个包体上限:字节, <= 0使用DEFAULT_MAX_MSG_SIZE, 收发双方均做检查
+	WireCompat     bool              // 发送旧版本协议(不携带超时/metadata), 滚动升级期间开启; 接收始终兼容新旧版本
+	LogFile        string            // 日志文件路径, 为空输出到标准日志
+	LogMaxSizeMB   int64             // 日志文件轮转大小:MB, <= 0使用默认100MB
+	LogRotateHours int64             // 日志文件按时间轮转间隔:小时, <= 0不按时间轮转
+	LogMaxBackups  int               // 保留的历史日志文件数, <= 0全部保留
+	LogCompress    bool              // 历史日志文件gzip压缩
+	AdminAddr      string            // 管理端http地址 ip:port, 为空不开启. 提供状态查询(json), 指标, 日志等级及pprof, 无鉴权, 必须绑定回环或内网地址
+	AdminRemote    bool              // 允许AdminAddr监听非回环地址(包括空ip和0.0.0.0), 默认拒绝; 开启时需自行通过内网/防火墙限制访问
+	StopTimeoutMs  int64             // Exit/WaitExit停止时等待在途消息和rpc的最长时间:毫秒, <= 0使用DEFAULT_STOP_MS
+}
+
+// 检查配置合法性, 并返回解析后的日志等级
+func (c *ServerConfig) validate() (log.LogLevel, error) {
+	if c.ClusterName == "" {
+		return log.LevelInfo, fmt.Errorf("ClusterName empty")
+	}
+	if len(c.ClusterName) > CLUSTER_NAME_MAX_LEN {
+		return log.LevelInfo, CLUSTER_NAME_LEN_OVER_ERR
+	}
+	if c.LogLevel == "" {
+		return log.LevelInfo, nil
+	}
+	return log.ParseLevel(c.LogLevel)
 }
 
 type Server struct {
-	config     ServerConfig
+	config     ServerConfig // ClusterName, LocalAddr等不可重载字段初始化后只读; 可重载字段只在持有reloadMu时读写, 其他goroutine读取对应的原子副本
+	configPath string
+	reloadMu   sync.Mutex
+	rpcTimeout int64 // rpc默认超时:纳秒, 运行时可重载
+	stopMs     int64 // Exit停止时的最长等待时间:毫秒, 运行时可重载
+	wireCompat int32 // 是否发送旧版本协议, 运行时可重载
+	maxMsgSize int64 // 跨节点单个包体上限, 运行时可重载
 	rwMu       sync.RWMutex
 	services   map[SVC_HANDLE]*Service
 	svcGroup   map[string]map[uint32]*Service
 	sidecar    *Sidecar
 	timerStore *TimeStore
 	log        *log.LogSystem
+	fileLogger *log.FileLogger // 配置LogFile时创建, Exit时关闭
 	codec      Codec
+	registry   *MsgRegistry
 	waitPool   *waitPool
+	metrics    *Metrics
+	tracer     atomic.Value // tracerHolder
+
+	interceptors       []Interceptor // rwMu保护
+	clientInterceptors []ClientInterceptor
+
+	admin         *http.Server // 配置AdminAddr时创建
+	adminListener net.Listener
+
+	shuttingDown int32 // 已开始Shutdown, gate不再接收新的跨节点请求
 }
 
 func (s *Server) Init(config string) error {
 	s.services = make(map[SVC_HANDLE]*Service)
 	s.svcGroup = make(map[string]map[uint32]*Service)
-	err := s.loadConfig(config)
+	s.log = log.NewStdLogSystem(log.LevelInfo)
+	s.configPath = config
+	err := s.loadConfig(config, &s.config)
+	if err != nil {
+		return err
+	}
+	lv, err := s.config.validate()
 	if err != nil {
+		s.log.Errorf("check config %s failed:%v", config, err)
 		return err
 	}
+	s.log.SetLevel(lv)
+	if s.config.LogFile != "" {
+		err = s.openLogFile(lv)
+		if err != nil {
+			s.log.Errorf("open log file %s failed:%v", s.config.LogFile, err)
+			return err
+		}
+	}
+	s.setRpcTimeout(s.config.RpcTimeoutMs)
+	s.setWireCompat(s.config.WireCompat)
+	s.setMaxMsgSize(s.config.MaxMsgSize)
+	s.setStopTimeout(s.config.StopTimeoutMs)
+	s.metrics = NewMetrics()
+	s.metrics.addCollector(s.collectMailbox)
+	s.SetTracer(nil)
 	s.sidecar = &Sidecar{server: s}
 	err = s.sidecar.Init()
 	if err != nil {
 		return err
 	}
-	s.log = log.NewStdLogSystem(log.LevelInfo)
-	s.codec = &JsonCodec{}
+	s.registry = NewMsgRegistry()
+	s.codec = &JsonCodec{Registry: s.registry}
 	s.timerStore = &TimeStore{
 		server: s,
 	}
 	s.timerStore.Init()
 	s.waitPool = newWaitPool()
+	if s.config.AdminAddr != "" {
+		err = s.startAdmin()
+		if err != nil {
+			s.sidecar.Exit()
+			s.log.Errorf("start admin on %s failed:%v", s.config.AdminAddr, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) openLogFile(lv log.LogLevel) error {
+	opts := []log.FileOption{
+		log.WithMaxBackups(s.config.LogMaxBackups),
+		log.WithCompress(s.config.LogCompress),
+		log.WithRotateInterval(time.Duration(s.config.LogRotateHours) * time.Hour),
+	}
+	if s.config.LogMaxSizeMB > 0 {
+		opts = append(opts, log.WithMaxSize(s.config.LogMaxSizeMB<<20))
+	}
+	fl, err := log.NewFileLogger(s.config.LogFile, opts...)
+	if err != nil {
+		return err
+	}
+	s.fileLogger = fl
+	s.log = log.NewLogSystem(fl, lv)
 	return nil
 }
 
+func (s *Server) Metrics() *Metrics {
+	return s.metrics
+}
+
+// 采集各服务邮箱积压及溢出计数, 已删除的服务不再上报.
+// 溢出计数由邮箱累计, 只增不减, 按counter导出
+func (s *Server) collectMailbox() []*MetricFamily {
+	depth := newMetricVec(METRIC_MAILBOX_DEPTH, "Number of messages waiting in service mailbox.", METRIC_GAUGE, nil, "service")
+	over := newMetricVec(METRIC_MAILBOX_OVERFLOW, "Requests rejected or notifies dropped by bounded mailbox, action is reject or drop.", METRIC_COUNTER, nil, "service", "action")
+	s.rwMu.RLock()
+	for _, svc := range s.services {
+		depth.with(svc.metricLabel).set(int64(svc.mqueue.Len()))
+		if svc.opts.mailboxSize > 0 {
+			rejected, dropped := svc.mqueue.Overflows()
+			over.with(svc.metricLabel, "reject").set(int64(rejected))
+			over.with(svc.metricLabel, "drop").set(int64(dropped))
+		}
+	}
+	s.rwMu.RUnlock()
+	return []*MetricFamily{depth.gather(), over.gather()}
+}
+
+type tracerHolder struct {
+	Tracer
+}
+
+// 设置链路追踪实现, nil表示不追踪
+func (s *Server) SetTracer(t Tracer) {
+	if t == nil {
+		t = NewNoopTracer()
+	}
+	s.tracer.Store(tracerHolder{t})
+}
+
+func (s *Server) Tracer() Tracer {
+	return s.tracer.Load().(tracerHolder).Tracer
+}
+
 func (s *Server) ClusterName() string {
 	return s.config.ClusterName
 }
 
+func (s *Server) setRpcTimeout(ms int64) {
+	if ms == 0 {
+		ms = DEFAULT_RPC_TIMEOUT_MS
+	}
+	timeout := time.Duration(ms) * time.Millisecond
+	if ms < 0 {
+		timeout = 0
+	}
+	atomic.StoreInt64(&s.rpcTimeout, int64(timeout))
+}
+
+// rpc默认超时, 0表示不超时
+func (s *Server) RpcTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rpcTimeout))
+}
+
+func (s *Server) setMaxMsgSize(size int) {
+	if size <= 0 {
+		size = DEFAULT_MAX_MSG_SIZE
+	}
+	atomic.StoreInt64(&s.maxMsgSize, int64(size))
+}
+
+// 跨节点单个包体上限:字节
+func (s *Server) MaxMsgSize() int {
+	return int(atomic.LoadInt64(&s.maxMsgSize))
+}
+
+func (s *Server) setWireCompat(compat bool) {
+	var v int32
+	if compat {
+		v = 1
+	}
+	atomic.StoreInt32(&s.wireCompat, v)
+}
+
+// 发起跨节点请求使用的协议版本
+func (s *Server) WireVersion() uint8 {
+	if atomic.LoadInt32(&s.wireCompat) != 0 {
+		return WIRE_VERSION_LEGACY
+	}
+	return WIRE_VERSION
+}
+
 func (s *Server) SetLogSystem(logger log.Logger, lv log.LogLevel) {
 	s.log = log.NewLogSystem(logger, lv)
 }
@@ -72,13 +252,32 @@ func (s *Server) SetCodec(c Codec) {
 	}
 }
 
-func (s *Server) loadConfig(config string) error {
+// 使用自定义服务发现替代配置中的静态RemoteAddrs, 如: NewFileDiscovery
+func (s *Server) SetDiscovery(d Discovery) error {
+	return s.sidecar.SetDiscovery(d)
+}
+
+func (s *Server) GetCodec() Codec {
+	return s.codec
+}
+
+func (s *Server) GetMsgRegistry() *MsgRegistry {
+	return s.registry
+}
+
+// 注册method对应的消息类型, v为该类型的任意值(如: (*RspLogin)(nil)), 用于内置Codec解码
+// 典型应用场景: 跨节点rpc发起方注册回包类型 RegisterMsgType(MSG_TYPE_CLUSTER_RSP, "ReqLogin", (*RspLogin)(nil))
+func (s *Server) RegisterMsgType(msgType MsgType, method string, v interface{}) error {
+	return s.registry.Register(msgType, method, reflect.TypeOf(v))
+}
+
+func (s *Server) loadConfig(config string, conf *ServerConfig) error {
 	data, err := ioutil.ReadFile(config)
 	if err != nil {
 		s.log.Errorf("load config %s failed:%v\n", config, err)
 		return err
 	}
-	err = json.Unmarshal(data, &s.config)
+	err = json.Unmarshal(data, conf)
 	if err != nil {
 		s.log.Errorf("load config %s failed:%v.\n", config, err)
 		return err
@@ -86,7 +285,82 @@ func (s *Server) loadConfig(config string) error {
 	return nil
 }
 
+// 重新读取配置文件, 校验后按差异生效: RemoteAddrs, TickIntervalMs, RpcTimeoutMs, LogLevel, WireCompat, MaxMsgSize, StopTimeoutMs
+// ClusterName, LocalAddr, Log文件相关配置及AdminAddr/AdminRemote不支持运行时修改, 发生变化时返回错误且整份配置不生效
+func (s *Server) ReloadConfig() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	var conf ServerConfig
+	err := s.loadConfig(s.configPath, &conf)
+	if err != nil {
+		return err
+	}
+	lv, err := conf.validate()
+	if err != nil {
+		return fmt.Errorf("reload config %s failed:%w", s.configPath, err)
+	}
+	fixed := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"ClusterName", s.config.ClusterName, conf.ClusterName},
+		{"LocalAddr", s.config.LocalAddr, conf.LocalAddr},
+		{"LogFile", s.config.LogFile, conf.LogFile},
+		{"LogMaxSizeMB", s.config.LogMaxSizeMB, conf.LogMaxSizeMB},
+		{"LogRotateHours", s.config.LogRotateHours, conf.LogRotateHours},
+		{"LogMaxBackups", s.config.LogMaxBackups, conf.LogMaxBackups},
+		{"LogCompress", s.config.LogCompress, conf.LogCompress},
+		{"AdminAddr", s.config.AdminAddr, conf.AdminAddr},
+		{"AdminRemote", s.config.AdminRemote, conf.AdminRemote},
+	}
+	for _, f := range fixed {
+		if f.old != f.new {
+			return fmt.Errorf("reload config %s failed: %s can't change live (%v -> %v)", s.configPath, f.name, f.old, f.new)
+		}
+	}
+	if !reflect.DeepEqual(conf.RemoteAddrs, s.config.RemoteAddrs) {
+		s.log.Infof("reload config RemoteAddrs: %v -> %v", s.config.RemoteAddrs, conf.RemoteAddrs)
+		s.config.RemoteAddrs = conf.RemoteAddrs
+		s.sidecar.Reload(conf.RemoteAddrs)
+	}
+	if conf.RpcTimeoutMs != s.config.RpcTimeoutMs {
+		s.log.Infof("reload config RpcTimeoutMs: %d -> %d", s.config.RpcTimeoutMs, conf.RpcTimeoutMs)
+		s.config.RpcTimeoutMs = conf.RpcTimeoutMs
+		s.setRpcTimeout(conf.RpcTimeoutMs)
+	}
+	if conf.MaxMsgSize != s.config.MaxMsgSize {
+		s.log.Infof("reload config MaxMsgSize: %d -> %d", s.config.MaxMsgSize, conf.MaxMsgSize)
+		s.config.MaxMsgSize = conf.MaxMsgSize
+		s.setMaxMsgSize(conf.MaxMsgSize)
+	}
+	if conf.WireCompat != s.config.WireCompat {
+		s.log.Infof("reload config WireCompat: %v -> %v", s.config.WireCompat, conf.WireCompat)
+		s.config.WireCompat = conf.WireCompat
+		s.setWireCompat(conf.WireCompat)
+	}
+	if conf.StopTimeoutMs != s.config.StopTimeoutMs {
+		s.log.Infof("reload config StopTimeoutMs: %d -> %d", s.config.StopTimeoutMs, conf.StopTimeoutMs)
+		s.config.StopTimeoutMs = conf.StopTimeoutMs
+		s.setStopTimeout(conf.StopTimeoutMs)
+	}
+	if conf.TickIntervalMs != s.config.TickIntervalMs {
+		s.log.Infof("reload config TickIntervalMs: %d -> %d", s.config.TickIntervalMs, conf.TickIntervalMs)
+		s.config.TickIntervalMs = conf.TickIntervalMs
+		s.timerStore.SetTickInterval(conf.TickIntervalMs)
+	}
+	if lv != s.log.GetLevel() {
+		s.log.Infof("reload config LogLevel: %s -> %s", s.log.GetLevel(), lv)
+		s.config.LogLevel = conf.LogLevel
+		s.log.SetLevel(lv)
+	}
+	return nil
+}
+
 func (s *Server) NewService(svcName string, svcID uint32) (*Service, error) {
+	return s.NewServiceWithOptions(svcName, svcID)
+}
+
+func (s *Server) NewServiceWithOptions(svcName string, svcID uint32, opts ...SvcOption) (*Service, error) {
 	s.rwMu.Lock()
 	defer s.rwMu.Unlock()
 	handle := SVC_HANDLE(utils.MakeServiceHandle(s.ClusterName(), svcName, svcID))
@@ -98,6 +372,13 @@ func (s *Server) NewService(svcName string, svcID uint32) (*Service, error) {
 		name:   svcName,
 		instID: svcID,
 		handle: handle,
+		opts:   defaultSvcOptions(),
+	}
+	for _, opt := range opts {
+		opt.apply(&svc.opts)
+	}
+	if svc.opts.mailboxKind == MAILBOX_MPSC && (svc.opts.mailboxSize > 0 || svc.opts.priority) {
+		return nil, MAILBOX_OPTION_ERR
 	}
 	svc.Init()
 	s.services[handle] = svc
@@ -128,24 +409,52 @@ func (s *Server) GetService(handle SVC_HANDLE) *Service {
 	return s.services[handle]
 }
 
-//接收指定信号，优雅退出接口
+//接收指定信号，优雅退出接口. 未指定SIGHUP时, 收到SIGHUP重新加载配置
 func (s *Server) WaitExit(sigs ...os.Signal) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, sigs...)
+	signal.Notify(c, append(sigs, syscall.SIGHUP)...)
 	sig := <-c
+	for sig == syscall.SIGHUP && !hasSignal(sigs, sig) {
+		err := s.ReloadConfig()
+		if err != nil {
+			s.log.Errorf("reload config on signal(%d) err:%v", sig, err)
+		} else {
+			s.log.Infof("reload config on signal(%d) done", sig)
+		}
+		sig = <-c
+	}
 	s.log.Infof("Server(%v) exitNotify with signal(%d)\n", syscall.Getpid(), sig)
 	s.Exit()
 }
 
+func hasSignal(sigs []os.Signal, sig os.Signal) bool {
+	for _, v := range sigs {
+		if v == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// 停止节点, 等同于最长等待StopTimeoutMs的Shutdown
 func (s *Server) Exit() {
-	s.sidecar.Exit()
-	svcs := make([]*Service, 0)
-	s.rwMu.RLock()
-	for _, svc := range s.services {
-		svcs = append(svcs, svc)
+	timeout := s.stopTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err != nil {
+		s.log.Warningf("Server(%v) shutdown not finished in %v: %v", syscall.Getpid(), timeout, err)
 	}
-	s.rwMu.RUnlock()
-	for _, svc := range svcs {
-		svc.Exit()
+}
+
+func (s *Server) setStopTimeout(ms int64) {
+	if ms <= 0 {
+		ms = DEFAULT_STOP_MS
 	}
+	atomic.StoreInt64(&s.stopMs, ms)
+}
+
+// Exit停止时的最长等待时间
+func (s *Server) stopTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.stopMs)) * time.Millisecond
 }
@@ -0,0 +1,91 @@
+package saber
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xingshuo/saber/common/log"
+	"github.com/xingshuo/saber/common/utils"
+)
+
+func writeTestConfig(t *testing.T, path string, config ServerConfig) {
+	data, err := json.Marshal(&config)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path, data, 0644)
+	assert.Nil(t, err)
+}
+
+func TestReloadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "saber_config_*.json")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	config := ServerConfig{
+		ClusterName:    "test_reload",
+		LocalAddr:      "127.0.0.1:0",
+		RemoteAddrs:    map[string]string{"lobby": "127.0.0.1:9001"},
+		TickIntervalMs: 10,
+	}
+	writeTestConfig(t, f.Name(), config)
+	s := &Server{}
+	err = s.Init(f.Name())
+	assert.Nil(t, err)
+	defer s.Exit()
+	assert.Equal(t, log.LogLevel(log.LevelInfo), s.GetLogSystem().GetLevel())
+	assert.Equal(t, DEFAULT_STOP_MS*time.Millisecond, s.stopTimeout())
+
+	config.RemoteAddrs = map[string]string{"chat": "127.0.0.1:9002"}
+	config.TickIntervalMs = 20
+	config.LogLevel = "debug"
+	config.StopTimeoutMs = 5000
+	writeTestConfig(t, f.Name(), config)
+	err = s.ReloadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, log.LogLevel(log.LevelDebug), s.GetLogSystem().GetLevel())
+	assert.Equal(t, int64(20), s.config.TickIntervalMs)
+	assert.Equal(t, 5*time.Second, s.stopTimeout())
+	_, ok := s.sidecar.clusterProxy.GetClusterName(utils.ClusterNameToHash("lobby"))
+	assert.False(t, ok)
+	_, ok = s.sidecar.clusterProxy.GetClusterName(utils.ClusterNameToHash("chat"))
+	assert.True(t, ok)
+
+	// 非法配置整份不生效
+	bad := config
+	bad.LogLevel = "verbose"
+	bad.RemoteAddrs = nil
+	writeTestConfig(t, f.Name(), bad)
+	assert.NotNil(t, s.ReloadConfig())
+	bad = config
+	bad.LocalAddr = "127.0.0.1:9003"
+	bad.RemoteAddrs = nil
+	writeTestConfig(t, f.Name(), bad)
+	assert.NotNil(t, s.ReloadConfig())
+	bad = config
+	bad.ClusterName = "test_reload2"
+	writeTestConfig(t, f.Name(), bad)
+	assert.NotNil(t, s.ReloadConfig())
+	// 只在启动时生效的配置发生变化时报错, 不静默忽略
+	for _, change := range []func(c *ServerConfig){
+		func(c *ServerConfig) { c.LogFile = "saber.log" },
+		func(c *ServerConfig) { c.LogMaxSizeMB = 1 },
+		func(c *ServerConfig) { c.LogRotateHours = 1 },
+		func(c *ServerConfig) { c.LogMaxBackups = 1 },
+		func(c *ServerConfig) { c.LogCompress = true },
+		func(c *ServerConfig) { c.AdminAddr = "127.0.0.1:0" },
+		func(c *ServerConfig) { c.AdminRemote = true },
+	} {
+		bad = config
+		change(&bad)
+		writeTestConfig(t, f.Name(), bad)
+		err = s.ReloadConfig()
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "can't change live")
+	}
+	_, ok = s.sidecar.clusterProxy.GetClusterName(utils.ClusterNameToHash("chat"))
+	assert.True(t, ok)
+	assert.Equal(t, log.LogLevel(log.LevelDebug), s.GetLogSystem().GetLevel())
+}
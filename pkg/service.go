@@ -2,8 +2,12 @@ package saber
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/xingshuo/saber/common/lib"
 	"github.com/xingshuo/saber/common/log"
 	"github.com/xingshuo/saber/common/utils"
@@ -17,21 +21,39 @@ type SvcTimer struct {
 }
 
 type Service struct {
-	server       *Server
-	name         string // 服务名 如: chat, agent
-	instID       uint32 // 服务实例ID
-	handle       SVC_HANDLE
-	mqueue       *MsgQueue
-	svcHandlers  map[string]SvcHandlerFunc
-	svcTimers    map[uint32]*SvcTimer
-	msgNotify    chan struct{}
-	exitNotify   *lib.SyncEvent
-	exitDone     *lib.SyncEvent
-	sessionStore *SessionStore
-	suspend      chan struct{}
-	log          *log.LogSystem
-	codec        Codec
-	packBuffer   [PACK_BUFFER_SIZE]byte
+	server         *Server
+	name           string // 服务名 如: chat, agent
+	instID         uint32 // 服务实例ID
+	handle         SVC_HANDLE
+	opts           svcOptions
+	mqueue         Mailbox
+	rwMu           sync.RWMutex // 真并发模式下保护svcHandlers, streamHandlers, svcTimers, 拦截器
+	svcHandlers    map[string]SvcHandlerFunc
+	typeHandlers   map[string]*typedHandler
+	streamHandlers map[string]StreamHandlerFunc
+	svcTimers      map[uint32]*SvcTimer
+	streamMu       sync.Mutex
+	streams        map[streamKey]*Stream
+	msgNotify      chan struct{}
+	exitNotify     *lib.SyncEvent
+	exitDone       *lib.SyncEvent
+	sessionStore   *SessionStore
+	suspend        chan struct{}
+	workers        chan struct{} // 真并发模式下限制同时执行的handler数
+	timerMu        sync.Mutex
+	timerExecs     map[int64]*svcExec // 正在执行的定时器回调, 按所在goroutine id登记
+	timerRunning   int32
+	log            *log.LogSystem
+	codec          Codec
+
+	interceptors       []Interceptor
+	clientInterceptors []ClientInterceptor
+	metricLabel        string // 指标中的service标签, 如: chat-1
+
+	stopHooks []SvcStopFunc // rwMu保护
+	stopped   int32         // 已开始停止, 不再接收新的流
+	busy      int32         // 正在分发的消息及真并发模式下执行中的handler数
+	aborted   int32         // 停止等待超时, 剩余请求和在途rpc返回RPC_SHUTDOWN_ERR
 }
 
 func (s *Service) String() string {
@@ -41,21 +63,80 @@ func (s *Service) String() string {
 //as C++ constructor
 func (s *Service) Init() {
 	s.msgNotify = make(chan struct{}, 1)
-	s.mqueue = NewMQueue(DEFAULT_MQ_SIZE)
+	s.metricLabel = fmt.Sprintf("%s-%d", s.name, s.instID)
+	s.mqueue = s.newMailbox()
 	s.svcHandlers = make(map[string]SvcHandlerFunc)
+	s.typeHandlers = make(map[string]*typedHandler)
+	s.streamHandlers = make(map[string]StreamHandlerFunc)
+	s.streams = make(map[streamKey]*Stream)
 	s.sessionStore = &SessionStore{waitPool: s.server.waitPool}
 	s.sessionStore.Init()
 	s.svcTimers = make(map[uint32]*SvcTimer)
 	s.exitNotify = lib.NewSyncEvent()
 	s.exitDone = lib.NewSyncEvent()
 	s.suspend = make(chan struct{}, 1)
-	s.log = s.server.GetLogSystem()
+	s.timerExecs = make(map[int64]*svcExec)
+	if s.isParallel() {
+		s.workers = make(chan struct{}, s.opts.parallel)
+	}
+	// 默认沿用Server的logger和等级, 可单独设置等级(Server.SetServiceLogLevel)
+	s.log = s.withLogFields(s.server.GetLogSystem().Fork())
 	s.codec = s.server.codec
 }
 
 // 服务启动时注册
 func (s *Service) RegisterSvcHandler(method string, handler SvcHandlerFunc) {
+	s.rwMu.Lock()
+	defer s.rwMu.Unlock()
 	s.svcHandlers[method] = handler
+	delete(s.typeHandlers, method)
+}
+
+// 服务启动时注册强类型handler, 格式: func(ctx context.Context, req *Req) (rsp *Rsp, err error)
+// 请求/回包类型会登记到Server的消息类型注册表, 内置Codec可将跨节点消息直接解码为具体结构;
+// 节点内Call/Send的请求类型不匹配时, 调用方直接返回RPC_REQ_TYPE_ERR
+func (s *Service) RegisterTypedHandler(method string, handler interface{}) error {
+	h, err := newTypedHandler(handler)
+	if err != nil {
+		return err
+	}
+	err = s.server.registry.Register(MSG_TYPE_CLUSTER_REQ, method, h.reqType)
+	if err != nil {
+		return err
+	}
+	err = s.server.registry.Register(MSG_TYPE_CLUSTER_RSP, method, h.rspType)
+	if err != nil {
+		return err
+	}
+	s.rwMu.Lock()
+	defer s.rwMu.Unlock()
+	s.svcHandlers[method] = h.wrap(method)
+	s.typeHandlers[method] = h
+	return nil
+}
+
+func (s *Service) checkReqType(method string, req interface{}) error {
+	s.rwMu.RLock()
+	h := s.typeHandlers[method]
+	s.rwMu.RUnlock()
+	if h == nil {
+		return nil
+	}
+	return h.checkReq(method, req)
+}
+
+func (s *Service) getSvcHandler(method string) SvcHandlerFunc {
+	s.rwMu.RLock()
+	defer s.rwMu.RUnlock()
+	return s.svcHandlers[method]
+}
+
+// 服务端指标中的method标签
+func (s *Service) methodLabel(method string) string {
+	if s.getSvcHandler(method) == nil {
+		return METRIC_UNKNOWN_METHOD
+	}
+	return method
 }
 
 // interval:执行间隔, 单位:毫秒
@@ -67,7 +148,9 @@ func (s *Service) RegisterTimer(onTick SvcTimerFunc, interval int64, count int)
 		onTick: onTick,
 		count:  count,
 	}
+	s.rwMu.Lock()
 	s.svcTimers[session] = t
+	s.rwMu.Unlock()
 	if interval == 0 {
 		t.count = 1
 		s.pushMsg(context.Background(), SVC_HANDLE(0), MSG_TYPE_TIMER, session, nil)
@@ -81,13 +164,20 @@ func (s *Service) RegisterTimer(onTick SvcTimerFunc, interval int64, count int)
 }
 
 func (s *Service) UnRegisterTimer(session uint32) {
+	s.rwMu.Lock()
 	delete(s.svcTimers, session)
+	s.rwMu.Unlock()
 	s.server.timerStore.Remove(s.handle, session)
 }
 
 // 服务自定义logger实现
 func (s *Service) SetLogSystem(logger log.Logger, lv log.LogLevel) {
-	s.log = log.NewLogSystem(logger, lv)
+	s.log = s.withLogFields(log.NewLogSystem(logger, lv))
+}
+
+// 服务输出的每行日志附带节点名, 服务名/ID和handle
+func (s *Service) withLogFields(ls *log.LogSystem) *log.LogSystem {
+	return ls.With("cluster", s.server.ClusterName(), "service", s.name, "id", s.instID, "handle", s.handle)
 }
 
 func (s *Service) GetLogSystem() *log.LogSystem {
@@ -102,177 +192,377 @@ func (s *Service) SetCodec(c Codec) {
 }
 
 func (s *Service) isParallel() bool {
-	return false
+	return s.opts.parallel > 0
+}
+
+// 伪并发模式下执行分发循环的goroutine
+type svcRunner struct {
+	goid     int64 // 首次执行定时器时获取
+	detached bool  // 内联执行的handler阻塞在rpc, 分发循环已交给新的goroutine
 }
 
-func (s *Service) onSvcTimer(session uint32) {
+// 伪并发模式下通知Serve继续处理其他消息, 真并发模式下无需交接
+func (s *Service) resume() {
+	if !s.isParallel() {
+		s.suspend <- struct{}{}
+	}
+}
+
+// rpc等待回包前让出执行权(调用方已通过claimExec声明): 伪并发模式由新goroutine接替分发循环(非内联执行时通知Serve继续处理),
+// 真并发模式归还worker名额, 否则名额被等待回包的handler占满时, Serve无法再分发回包导致死锁
+func (s *Service) yield(e *svcExec) {
+	if s.isParallel() {
+		<-s.workers
+		return
+	}
+	if r := e.runner; !r.detached {
+		// handler在分发goroutine上内联执行, 由新goroutine接替分发循环
+		r.detached = true
+		go s.serve()
+	} else {
+		s.suspend <- struct{}{}
+	}
+}
+
+// rpc返回后重新获取执行权, 伪并发模式由Serve分发回包时等待suspend完成交接
+func (s *Service) reacquire(e *svcExec) {
+	if !s.isParallel() {
+		atomic.CompareAndSwapInt32(&e.holding, 0, 1)
+		return
+	}
+	s.workers <- struct{}{}
+	if !atomic.CompareAndSwapInt32(&e.holding, 0, 1) {
+		// handler已执行结束(由其创建的goroutine使用handler的ctx发起的rpc), 名额直接归还
+		<-s.workers
+	}
+}
+
+func (s *Service) onSvcTimer(e *svcExec, session uint32) {
+	defer s.server.metrics.observeDispatch(s.metricLabel, MSG_TYPE_TIMER, "", time.Now())
+	s.rwMu.RLock()
 	t := s.svcTimers[session]
+	s.rwMu.RUnlock()
 	if t != nil {
+		s.server.metrics.incTimerFire(s.metricLabel)
+		goid := s.enterTimer(e)
 		t.onTick()
+		s.leaveTimer(goid)
 		// 有限次执行
+		s.rwMu.Lock()
 		if t.count > 0 {
 			t.count--
 			if t.count == 0 {
 				delete(s.svcTimers, session)
 			}
 		}
+		s.rwMu.Unlock()
 	}
-	s.suspend <- struct{}{}
 }
 
-func (s *Service) onRecvSvcReq(source SVC_HANDLE, session uint32, msg interface{}) {
+// 执行handler, panic转换为ErrCode_HandlerPanic错误返回给调用方
+func (s *Service) callHandler(ctx context.Context, method string, handler SvcHandlerFunc, req interface{}) (rsp interface{}, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			s.log.Errorf("%s panic occurred on handle %s: %v\n%s", s, method, e, debug.Stack())
+			rsp = nil
+			err = NewError(ErrCode_HandlerPanic, "handler %s panic: %v", method, e)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+func (s *Service) replySvc(dh SVC_HANDLE, session uint32, method string, rsp interface{}, rpcErr error) {
+	s.server.metrics.incRpc(s.metricLabel, "server", s.methodLabel(method), rpcErr)
+	err := s.rawSend(context.Background(), dh, MSG_TYPE_SVC_RSP, session, &SvcResponse{
+		Body: rsp,
+		Err:  rpcErr,
+	})
+	if err != nil {
+		s.log.Errorf("reply svc msg err:%v", err)
+	}
+}
+
+// version: 请求方使用的协议版本
+func (s *Service) replyCluster(version uint8, dh SVC_HANDLE, session uint32, method string, rsp interface{}, rpcErr error) {
+	s.server.metrics.incRpc(s.metricLabel, "server", s.methodLabel(method), rpcErr)
+	cluster, exist := s.server.sidecar.GetClusterName(dh)
+	if !exist {
+		s.log.Errorf("reply %s to unknown cluster, dst svc %d", method, dh)
+		return
+	}
+	buf := getPackBuffer()
+	data, err := NetPackResponse(*buf, s.codec, replyWireVersion(version), s.handle, session, dh, method, rsp, rpcErr)
+	if err == nil {
+		err = checkMsgSize(data, s.server.MaxMsgSize())
+	}
+	if err != nil && rpcErr == nil {
+		// 回包编码失败或超长, 将错误返回给调用方
+		s.log.Errorf("netpack rsp err:%v", err)
+		data, err = NetPackResponse(*buf, s.codec, replyWireVersion(version), s.handle, session, dh, method, nil, err)
+	}
+	if err != nil {
+		putPackBuffer(buf, nil)
+		s.log.Errorf("netpack rsp err:%v", err)
+		return
+	}
+	err = s.server.sidecar.Send(cluster, data)
+	putPackBuffer(buf, data)
+	if err != nil {
+		s.log.Errorf("reply cluster rpc err:%v", err)
+	}
+}
+
+func (s *Service) onRecvSvcReq(parent context.Context, source SVC_HANDLE, session uint32, msg interface{}) {
 	defer func() {
-		s.suspend <- struct{}{}
 		if e := recover(); e != nil {
 			s.log.Errorf("panic occurred on recv svc req: %v", e)
 		}
 	}()
 	req := msg.(*SvcRequest)
-	handler := s.svcHandlers[req.Method]
+	handler := s.getSvcHandler(req.Method)
+	label := req.Method
+	if handler == nil {
+		label = METRIC_UNKNOWN_METHOD
+	}
+	defer s.server.metrics.observeDispatch(s.metricLabel, MSG_TYPE_SVC_REQ, label, time.Now())
 	if handler == nil {
 		if session != 0 {
-			err := s.rawSend(context.Background(), source, MSG_TYPE_SVC_RSP, session, &SvcResponse{
-				Err: fmt.Errorf("call unknown func %s", req.Method),
-			})
-			if err != nil {
-				s.log.Errorf("reply svc msg err:%v", err)
-			}
+			s.replySvc(source, session, req.Method, nil, NewError(ErrCode_UnknownMethod, "call unknown func %s", req.Method))
 		}
 		return
 	}
-	ctx := context.WithValue(context.Background(), CtxKeyService, s)
+	caller := &CallerInfo{Source: source, Cluster: s.server.ClusterName(), Session: session}
+	ctx, cancel, ok := s.newHandlerCtx(parent, req, caller)
+	if !ok {
+		s.log.Warningf("drop expired svc req %s from %d, session %d", req.Method, source, session)
+		return
+	}
+	defer cancel()
 	// svc, _ := ctx.Value(CtxKeyService).(*Service)
-	rsp, err := handler(ctx, req.Body)
+	info := &RpcInfo{
+		Method:      req.Method,
+		Source:      source,
+		Destination: s.handle,
+		Cluster:     caller.Cluster,
+		Notify:      session == 0,
+	}
+	ctx, span := s.startServerSpan(ctx, info, req.Metadata)
+	rsp, err := s.callHandler(ctx, req.Method, s.wrapHandler(info, handler), req.Body)
+	span.SetError(err)
+	span.End()
 	if session != 0 {
-		rspErr := s.rawSend(ctx, source, MSG_TYPE_SVC_RSP, session, &SvcResponse{
-			Body: rsp,
-			Err:  err,
-		})
-		if rspErr != nil {
-			s.log.Errorf("reply svc msg err:%v", rspErr)
-		}
+		s.replySvc(source, session, req.Method, rsp, err)
 	}
 }
 
-func (s *Service) onRecvSvcRsp(source SVC_HANDLE, session uint32, msg interface{}) {
+// 返回是否唤醒了让出执行权等待中的rpc
+func (s *Service) onRecvSvcRsp(source SVC_HANDLE, session uint32, msg interface{}) bool {
 	// 根据session唤醒, 这里不需要唤醒suspend chan, 等发起rpc的goroutine处理完自己唤醒
+	defer s.server.metrics.observeDispatch(s.metricLabel, MSG_TYPE_SVC_RSP, "", time.Now())
 	rsp := msg.(*SvcResponse)
-	err := s.sessionStore.WakeUp(session, rsp)
+	yielded, err := s.sessionStore.WakeUp(session, rsp)
 	if err != nil {
 		s.log.Errorf("wakeup Session %d from %d err: %v", session, source, err)
+		return false
 	}
+	return yielded
 }
 
-func (s *Service) onRecvClusterReq(source SVC_HANDLE, session uint32, msg interface{}) {
+func (s *Service) onRecvClusterReq(parent context.Context, source SVC_HANDLE, session uint32, msg interface{}) {
 	defer func() {
-		s.suspend <- struct{}{}
 		if e := recover(); e != nil {
 			s.log.Errorf("panic occurred on recv cluster req: %v", e)
 		}
 	}()
-	cluster, exist := s.server.sidecar.GetClusterName(source)
 	req := msg.(*SvcRequest)
+	defer s.server.metrics.observeDispatch(s.metricLabel, MSG_TYPE_CLUSTER_REQ, s.methodLabel(req.Method), time.Now())
 	arg, err := s.codec.Unmarshal(MSG_TYPE_CLUSTER_REQ, req.Method, req.Body.([]byte))
 	if err != nil {
 		s.log.Errorf("codec.Unmarshal cluster req err:%v", err)
+		if session != 0 {
+			s.replyCluster(req.wireVersion, source, session, req.Method, nil, fmt.Errorf("%w: %s %v", RPC_CODEC_ERR, req.Method, err))
+		}
 		return
 	}
 
-	handler := s.svcHandlers[req.Method]
+	handler := s.getSvcHandler(req.Method)
 	if handler == nil {
 		if session != 0 {
-			rpcErr := fmt.Errorf("unknown rpc func %s", req.Method)
-			if !exist {
-				s.log.Errorf("recv %v from unknown cluster", rpcErr)
-				return
-			}
-			data, err := NetPackResponse(s.packBuffer[:], s.codec, s.handle, session, source, req.Method, nil, rpcErr)
-			if err != nil {
-				s.log.Errorf("netpack rsp err:%v", err)
-				return
-			}
-			err = s.server.sidecar.Send(cluster, data)
-			if err != nil {
-				s.log.Errorf("reply cluster rpc err:%v", err)
-			}
+			s.replyCluster(req.wireVersion, source, session, req.Method, nil, NewError(ErrCode_UnknownMethod, "unknown rpc func %s", req.Method))
 		}
 		return
 	}
-	ctx := context.WithValue(context.Background(), CtxKeyService, s)
-	rsp, rpcErr := handler(ctx, arg)
+	cluster, _ := s.server.sidecar.GetClusterName(source)
+	caller := &CallerInfo{Source: source, Cluster: cluster, Session: session}
+	ctx, cancel, ok := s.newHandlerCtx(parent, req, caller)
+	if !ok {
+		// 调用方不再等待回包, 直接丢弃
+		s.log.Warningf("drop expired cluster req %s from %d, session %d", req.Method, source, session)
+		return
+	}
+	defer cancel()
+	info := &RpcInfo{
+		Method:      req.Method,
+		Source:      source,
+		Destination: s.handle,
+		Cluster:     cluster,
+		Notify:      session == 0,
+	}
+	ctx, span := s.startServerSpan(ctx, info, req.Metadata)
+	rsp, rpcErr := s.callHandler(ctx, req.Method, s.wrapHandler(info, handler), arg)
+	span.SetError(rpcErr)
+	span.End()
 	if session != 0 {
-		data, err := NetPackResponse(s.packBuffer[:], s.codec, s.handle, session, source, req.Method, rsp, rpcErr)
-		if err != nil {
-			s.log.Errorf("netpack rsp err:[%v]", err)
-			return
-		}
-		err = s.server.sidecar.Send(cluster, data)
-		if err != nil {
-			s.log.Errorf("reply cluster rpc err:[%v]", err)
-		}
+		s.replyCluster(req.wireVersion, source, session, req.Method, rsp, rpcErr)
 	}
 }
 
-func (s *Service) onRecvClusterRsp(source SVC_HANDLE, session uint32, msg interface{}) {
+// 返回是否唤醒了让出执行权等待中的rpc
+func (s *Service) onRecvClusterRsp(source SVC_HANDLE, session uint32, msg interface{}) bool {
 	// 根据session唤醒:如果成功, 这里不需要唤醒suspend chan, 等发起rpc的goroutine处理完自己唤醒
+	method := ""
+	defer func(start time.Time) {
+		s.server.metrics.observeDispatch(s.metricLabel, MSG_TYPE_CLUSTER_RSP, method, start)
+	}(time.Now())
 	rsp := msg.(*SvcResponse)
 	if rsp.Err == nil {
 		body := rsp.Body.(*ClusterRspBody)
+		method = body.Method
 		arg, err := s.codec.Unmarshal(MSG_TYPE_CLUSTER_RSP, body.Method, body.Body)
 		if err != nil {
 			s.log.Errorf("codec.Unmarshal cluster rsp err:%v", err)
-			return
+			rsp.Body = nil
+			rsp.Err = fmt.Errorf("%w: %s %v", RPC_CODEC_ERR, body.Method, err)
+		} else {
+			rsp.Body = arg
 		}
-		rsp.Body = arg
 	}
-	err := s.sessionStore.WakeUp(session, rsp)
+	yielded, err := s.sessionStore.WakeUp(session, rsp)
 	if err != nil {
+		// 不是本端发起的rpc, method由对端任意指定
+		method = METRIC_UNKNOWN_METHOD
 		s.log.Errorf("wakeup cluster Session %d from %d err: %v", session, source, err)
+		return false
 	}
+	return yielded
 }
 
 func (s *Service) rawSend(ctx context.Context, dh SVC_HANDLE, msgType MsgType, session uint32, msg interface{}) error {
 	ds := s.server.GetService(dh)
 	if ds == nil {
-		return fmt.Errorf("unknown dst svc handle %d", dh)
+		return NewError(ErrCode_SvcNotFound, "unknown dst svc handle %d", dh)
 	}
-	ds.pushMsg(ctx, s.handle, msgType, session, msg)
-	return nil
+	return ds.pushMsg(ctx, s.handle, msgType, session, msg)
 }
 
 // 节点内Notify
 func (s *Service) Send(ctx context.Context, svcName string, svcID uint32, method string, arg interface{}) error {
 	dh := SVC_HANDLE(utils.MakeServiceHandle(s.server.ClusterName(), svcName, svcID))
+	info := &RpcInfo{Method: method, Source: s.handle, Destination: dh, Cluster: s.server.ClusterName(), Notify: true}
+	_, err := s.invoke(ctx, info, arg, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, s.send(ctx, dh, svcName, svcID, method, arg)
+	})
+	return err
+}
+
+func (s *Service) send(ctx context.Context, dh SVC_HANDLE, svcName string, svcID uint32, method string, arg interface{}) error {
+	ds := s.server.GetService(dh)
+	if ds == nil {
+		return NewError(ErrCode_SvcNotFound, "unknown dst svc %s-%d", svcName, svcID)
+	}
+	if err := ds.checkReqType(method, arg); err != nil {
+		return err
+	}
 	req := &SvcRequest{
-		Method: method,
-		Body:   arg,
+		Method:   method,
+		Body:     arg,
+		Metadata: s.outgoingMetadata(ctx),
+	}
+	return ds.pushMsg(valueOnlyCtx{ctx}, s.handle, MSG_TYPE_SVC_REQ, 0, req)
+}
+
+// rpc超时优先级: WithTimeout > ctx中的CtxKeyRpcTimeoutMS > Server默认超时
+func (s *Service) rpcTimeout(ctx context.Context, opts []CallOption) time.Duration {
+	co := defaultCallOptions()
+	for _, opt := range opts {
+		opt.apply(&co)
+	}
+	if co.timeout != 0 {
+		return co.timeout
+	}
+	if timeout, ok := ctx.Value(CtxKeyRpcTimeoutMS).(time.Duration); ok && timeout > 0 {
+		return timeout
 	}
-	return s.rawSend(ctx, dh, MSG_TYPE_SVC_REQ, 0, req)
+	return s.server.RpcTimeout()
+}
+
+// 取ctx剩余时间与rpc超时中的较小值, 随跨节点请求传递给远端, 0表示不限
+func remainingTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		remain := time.Until(deadline)
+		if remain <= 0 {
+			remain = time.Millisecond
+		}
+		if timeout <= 0 || remain < timeout {
+			return remain
+		}
+	}
+	return timeout
 }
 
 // 节点内Rpc
-func (s *Service) Call(ctx context.Context, svcName string, svcID uint32, method string, arg interface{}) (rsp interface{}, err error) {
+func (s *Service) Call(ctx context.Context, svcName string, svcID uint32, method string, arg interface{}, opts ...CallOption) (rsp interface{}, err error) {
 	dh := SVC_HANDLE(utils.MakeServiceHandle(s.server.ClusterName(), svcName, svcID))
+	info := &RpcInfo{Method: method, Source: s.handle, Destination: dh, Cluster: s.server.ClusterName()}
+	rsp, err = s.invoke(ctx, info, arg, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return s.call(ctx, dh, svcName, svcID, method, arg, opts)
+	})
+	s.server.metrics.incRpc(s.metricLabel, "client", method, err)
+	return rsp, err
+}
+
+func (s *Service) call(ctx context.Context, dh SVC_HANDLE, svcName string, svcID uint32, method string, arg interface{}, opts []CallOption) (rsp interface{}, err error) {
 	ds := s.server.GetService(dh)
 	if ds == nil {
-		return nil, fmt.Errorf("unknown dst svc %d", dh)
+		return nil, NewError(ErrCode_SvcNotFound, "unknown dst svc %s-%d", svcName, svcID)
+	}
+	if err := ds.checkReqType(method, arg); err != nil {
+		return nil, err
 	}
 	req := &SvcRequest{
-		Method: method,
-		Body:   arg,
+		Method:   method,
+		Body:     arg,
+		Metadata: s.outgoingMetadata(ctx),
+	}
+	timeout := s.rpcTimeout(ctx, opts)
+	if timeout > 0 {
+		req.Deadline = time.Now().Add(timeout)
 	}
 	session := s.sessionStore.NewSessionID()
 	onWait := func() error {
-		ds.pushMsg(ctx, s.handle, MSG_TYPE_SVC_REQ, session, req)
-		return nil
+		return ds.pushMsg(ctx, s.handle, MSG_TYPE_SVC_REQ, session, req)
 	}
-	return s.sessionStore.Wait(ctx, session, s, onWait)
+	return s.sessionStore.Wait(ctx, session, s, timeout, onWait)
 }
 
 // 跨节点Notify
 func (s *Service) SendCluster(ctx context.Context, clusterName, svcName string, svcID uint32, method string, arg interface{}) error {
 	dh := SVC_HANDLE(utils.MakeServiceHandle(clusterName, svcName, svcID))
-	data, err := NetPackRequest(s.packBuffer[:], s.codec, s.handle, 0, dh, method, arg)
+	info := &RpcInfo{Method: method, Source: s.handle, Destination: dh, Cluster: clusterName, Notify: true}
+	_, err := s.invoke(ctx, info, arg, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, s.sendCluster(ctx, clusterName, dh, method, arg)
+	})
+	return err
+}
+
+func (s *Service) sendCluster(ctx context.Context, clusterName string, dh SVC_HANDLE, method string, arg interface{}) error {
+	buf := getPackBuffer()
+	data, err := NetPackRequest(*buf, s.codec, s.server.WireVersion(), s.handle, 0, dh, method, arg, remainingTimeout(ctx, 0), s.outgoingMetadata(ctx))
+	defer putPackBuffer(buf, data)
+	if err != nil {
+		return err
+	}
+	err = checkMsgSize(data, s.server.MaxMsgSize())
 	if err != nil {
 		return err
 	}
@@ -280,35 +570,75 @@ func (s *Service) SendCluster(ctx context.Context, clusterName, svcName string,
 }
 
 // 跨节点Rpc
-func (s *Service) CallCluster(ctx context.Context, clusterName, svcName string, svcID uint32, method string, arg interface{}) (rsp interface{}, err error) {
+func (s *Service) CallCluster(ctx context.Context, clusterName, svcName string, svcID uint32, method string, arg interface{}, opts ...CallOption) (rsp interface{}, err error) {
 	dh := SVC_HANDLE(utils.MakeServiceHandle(clusterName, svcName, svcID))
+	info := &RpcInfo{Method: method, Source: s.handle, Destination: dh, Cluster: clusterName}
+	rsp, err = s.invoke(ctx, info, arg, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return s.callCluster(ctx, clusterName, dh, method, arg, opts)
+	})
+	s.server.metrics.incRpc(s.metricLabel, "client", method, err)
+	return rsp, err
+}
+
+func (s *Service) callCluster(ctx context.Context, clusterName string, dh SVC_HANDLE, method string, arg interface{}, opts []CallOption) (rsp interface{}, err error) {
 	session := s.sessionStore.NewSessionID()
-	data, err := NetPackRequest(s.packBuffer[:], s.codec, s.handle, session, dh, method, arg)
+	if ctx.Err() != nil {
+		return nil, rpcCtxError(ctx, session)
+	}
+	timeout := s.rpcTimeout(ctx, opts)
+	buf := getPackBuffer()
+	data, err := NetPackRequest(*buf, s.codec, s.server.WireVersion(), s.handle, session, dh, method, arg, remainingTimeout(ctx, timeout), s.outgoingMetadata(ctx))
+	if err == nil {
+		err = checkMsgSize(data, s.server.MaxMsgSize())
+	}
 	if err != nil {
+		putPackBuffer(buf, data)
 		return nil, err
 	}
+	// 发送时Conn已拷贝数据, 缓冲区无需等到rpc返回再归还
 	onWait := func() error {
+		defer putPackBuffer(buf, data)
 		return s.server.sidecar.Send(clusterName, data)
 	}
-	return s.sessionStore.Wait(ctx, session, s, onWait)
+	return s.sessionStore.Wait(ctx, session, s, timeout, onWait)
 }
 
-func (s *Service) pushMsg(ctx context.Context, source SVC_HANDLE, msgType MsgType, session uint32, data interface{}) {
-	wakeUp := s.mqueue.Push(source, msgType, session, data)
+// 只有请求可能因邮箱达到上限返回错误
+func (s *Service) pushMsg(ctx context.Context, source SVC_HANDLE, msgType MsgType, session uint32, data interface{}) error {
+	wakeUp, err := s.mqueue.Push(ctx, source, msgType, session, data)
+	if err != nil {
+		return err
+	}
 	if wakeUp {
 		select {
 		case s.msgNotify <- struct{}{}:
 		default:
 		}
 	}
+	return nil
+}
+
+func copyBytes(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
 }
 
-func (s *Service) pushClusterRequest(ctx context.Context, head *ClusterReqHead, body []byte) {
+func (s *Service) pushClusterRequest(ctx context.Context, head *ClusterReqHead, version uint8, md Metadata, body []byte) error {
+	// body引用连接读缓冲区, 入队前需拷贝
 	req := &SvcRequest{
-		Method: head.Method(),
-		Body:   body,
+		Method:      head.Method(),
+		Body:        copyBytes(body),
+		Metadata:    md,
+		wireVersion: version,
+	}
+	if timeout := head.Timeout(); timeout > 0 {
+		req.Deadline = time.Now().Add(timeout)
 	}
-	s.pushMsg(ctx, SVC_HANDLE(head.source), MSG_TYPE_CLUSTER_REQ, head.session, req)
+	return s.pushMsg(ctx, SVC_HANDLE(head.source), MSG_TYPE_CLUSTER_REQ, head.session, req)
 }
 
 func (s *Service) pushClusterResponse(ctx context.Context, head *ClusterRspHead, body []byte) {
@@ -316,19 +646,62 @@ func (s *Service) pushClusterResponse(ctx context.Context, head *ClusterRspHead,
 		rsp := &SvcResponse{
 			Body: &ClusterRspBody{
 				Method: head.Method(),
-				Body:   body,
+				Body:   copyBytes(body),
 			},
 		}
 		s.pushMsg(ctx, SVC_HANDLE(head.source), MSG_TYPE_CLUSTER_RSP, head.session, rsp)
 	} else {
 		rsp := &SvcResponse{
-			Err: errors.New(head.ErrMsg()),
+			Err: &Error{
+				Code:    head.errCode,
+				Message: head.ErrMsg(),
+				Details: copyBytes(body),
+			},
 		}
 		s.pushMsg(ctx, SVC_HANDLE(head.source), MSG_TYPE_CLUSTER_RSP, head.session, rsp)
 	}
 }
 
-func (s *Service) dispatchMsg(source SVC_HANDLE, msgType MsgType, session uint32, msg interface{}) {
+// 真并发模式: 请求和定时消息由worker goroutine并发处理, 回包只做唤醒直接在Serve goroutine处理
+func (s *Service) dispatchParallel(ctx context.Context, source SVC_HANDLE, msgType MsgType, session uint32, msg interface{}) {
+	if msgType == MSG_TYPE_SVC_RSP {
+		s.onRecvSvcRsp(source, session, msg)
+		return
+	}
+	if msgType == MSG_TYPE_CLUSTER_RSP {
+		s.onRecvClusterRsp(source, session, msg)
+		return
+	}
+	if msgType != MSG_TYPE_TIMER && msgType != MSG_TYPE_STOP && msgType != MSG_TYPE_SVC_REQ && msgType != MSG_TYPE_CLUSTER_REQ && msgType != MSG_TYPE_STREAM_OPEN {
+		return
+	}
+	s.workers <- struct{}{}
+	atomic.AddInt32(&s.busy, 1)
+	go func() {
+		e := &svcExec{svc: s, holding: 1}
+		ctx := withExec(ctx, e)
+		defer func() {
+			// 等待回包时已归还名额
+			if e.finish() {
+				<-s.workers
+			}
+			atomic.AddInt32(&s.busy, -1)
+		}()
+		if msgType == MSG_TYPE_TIMER {
+			s.onSvcTimer(e, session)
+		} else if msgType == MSG_TYPE_STOP {
+			s.onStop(ctx, msg)
+		} else if msgType == MSG_TYPE_SVC_REQ {
+			s.onRecvSvcReq(ctx, source, session, msg)
+		} else if msgType == MSG_TYPE_CLUSTER_REQ {
+			s.onRecvClusterReq(ctx, source, session, msg)
+		} else {
+			s.onRecvStreamOpen(ctx, source, session, msg)
+		}
+	}()
+}
+
+func (s *Service) dispatchMsg(r *svcRunner, ctx context.Context, source SVC_HANDLE, msgType MsgType, session uint32, msg interface{}) {
 	if msgType.IsClusterMsg() {
 		cluster, _ := s.server.sidecar.GetClusterName(source)
 		s.log.Debugf("%s dispatch %s start from %s", s, msgType, cluster)
@@ -336,43 +709,95 @@ func (s *Service) dispatchMsg(source SVC_HANDLE, msgType MsgType, session uint32
 		s.log.Debugf("%s dispatch %s start from %s", s, msgType, s.server.GetService(source))
 	}
 
+	if s.rejectAborted(source, msgType, session, msg) {
+		return
+	}
+
+	if s.isParallel() {
+		s.dispatchParallel(ctx, source, msgType, session, msg)
+		return
+	}
+
+	if msgType == MSG_TYPE_SVC_RSP {
+		// 回包只做唤醒, 唤醒失败(如已超时)或等待方未持有执行权时没有goroutine交还执行权, 无需等待
+		if !s.onRecvSvcRsp(source, session, msg) {
+			return
+		}
+		<-s.suspend
+	} else if msgType == MSG_TYPE_CLUSTER_RSP {
+		if !s.onRecvClusterRsp(source, session, msg) {
+			return
+		}
+		<-s.suspend
+	} else if !s.runInline(r, ctx, source, msgType, session, msg) {
+		return
+	}
+
+	s.log.Debugf("%s dispatch %s done from %s", s, msgType, s.server.GetService(source))
+	if r.detached {
+		// 分发循环已由其他goroutine接替, 执行完后交还执行权
+		s.resume()
+	}
+}
+
+// 伪并发模式下在分发goroutine上直接执行handler, 无需为每条消息创建goroutine和交接执行权.
+// handler阻塞在rpc时分发循环交给新的goroutine(见yield), 本goroutine被回包唤醒执行完后退出
+func (s *Service) runInline(r *svcRunner, ctx context.Context, source SVC_HANDLE, msgType MsgType, session uint32, msg interface{}) bool {
+	e := &svcExec{svc: s, runner: r, holding: 1}
+	defer e.finish()
+	ctx = withExec(ctx, e)
 	if msgType == MSG_TYPE_TIMER {
-		go s.onSvcTimer(session)
+		s.onSvcTimer(e, session)
+	} else if msgType == MSG_TYPE_STOP {
+		s.onStop(ctx, msg)
 	} else if msgType == MSG_TYPE_SVC_REQ {
-		go s.onRecvSvcReq(source, session, msg)
-	} else if msgType == MSG_TYPE_SVC_RSP {
-		go s.onRecvSvcRsp(source, session, msg)
+		s.onRecvSvcReq(ctx, source, session, msg)
 	} else if msgType == MSG_TYPE_CLUSTER_REQ {
-		go s.onRecvClusterReq(source, session, msg)
-	} else if msgType == MSG_TYPE_CLUSTER_RSP {
-		go s.onRecvClusterRsp(source, session, msg)
+		s.onRecvClusterReq(ctx, source, session, msg)
+	} else if msgType == MSG_TYPE_STREAM_OPEN {
+		s.onRecvStreamOpen(ctx, source, session, msg)
 	} else {
-		return
+		return false
 	}
+	return true
+}
 
-	<-s.suspend
-	s.log.Debugf("%s dispatch %s done from %s", s, msgType, s.server.GetService(source))
+func (s *Service) newMailbox() Mailbox {
+	if s.opts.mailboxKind == MAILBOX_MPSC {
+		return NewMPSCQueue()
+	}
+	mq := NewMQueue(DEFAULT_MQ_SIZE)
+	if s.opts.mailboxSize > 0 {
+		blockTimeout := s.opts.blockTimeout
+		if blockTimeout <= 0 {
+			blockTimeout = DEFAULT_MQ_BLOCK_MS * time.Millisecond
+		}
+		mq.SetLimit(s.opts.mailboxSize, s.opts.overflowPolicy, blockTimeout)
+	}
+	if s.opts.priority {
+		mq.SetPriority(s.opts.starveLimit)
+	}
+	return mq
 }
 
 func (s *Service) Serve() {
 	s.log.Infof("cluster %s new service %s handle:%d", s.server.ClusterName(), s, s.handle)
+	s.serve()
+}
+
+// 分发循环, 伪并发模式下handler阻塞在rpc时由新的goroutine接替执行
+func (s *Service) serve() {
+	r := &svcRunner{}
 	for {
+		// 接替者启动时邮箱中可能还有消息, 先处理完再等待唤醒
+		if s.drain(r) {
+			return
+		}
 		select {
 		case <-s.msgNotify:
-			for {
-				empty, source, msgType, session, data := s.mqueue.Pop()
-				if empty {
-					break
-				}
-				s.dispatchMsg(source, msgType, session, data)
-			}
 		case <-s.exitNotify.Done():
-			for {
-				empty, source, msgType, session, data := s.mqueue.Pop()
-				if empty {
-					break
-				}
-				s.dispatchMsg(source, msgType, session, data)
+			if s.drain(r) {
+				return
 			}
 			s.exitDone.Fire()
 			return
@@ -380,8 +805,31 @@ func (s *Service) Serve() {
 	}
 }
 
+// 处理邮箱中的全部消息, 返回分发循环是否已交给其他goroutine
+func (s *Service) drain(r *svcRunner) bool {
+	for {
+		// 出队前计数, 避免Shutdown在出队和开始处理之间误判服务空闲
+		atomic.AddInt32(&s.busy, 1)
+		empty, ctx, source, msgType, session, data := s.mqueue.Pop()
+		if empty {
+			atomic.AddInt32(&s.busy, -1)
+			return false
+		}
+		s.dispatchMsg(r, ctx, source, msgType, session, data)
+		atomic.AddInt32(&s.busy, -1)
+		if r.detached {
+			return true
+		}
+	}
+}
+
+// 停止服务, 邮箱中的消息照常处理完再退出, 最长等待StopTimeoutMs, 超时后剩余请求返回RPC_SHUTDOWN_ERR
 func (s *Service) Exit() {
-	if s.exitNotify.Fire() {
-		<-s.exitDone.Done()
+	timeout := s.server.stopTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err != nil {
+		s.log.Warningf("%s exit not finished in %v: %v", s, timeout, err)
 	}
 }
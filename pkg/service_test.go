@@ -0,0 +1,976 @@
+package saber
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xingshuo/saber/common/log"
+)
+
+func newTestServer(t testing.TB, config ServerConfig) *Server {
+	data, err := json.Marshal(&config)
+	assert.Nil(t, err)
+	f, err := ioutil.TempFile("", "saber_config_*.json")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	f.Close()
+	assert.Nil(t, err)
+	s := &Server{}
+	err = s.Init(f.Name())
+	assert.Nil(t, err)
+	// 等待gate开始监听
+	for i := 0; i < 100 && !strings.HasSuffix(config.LocalAddr, ":0"); i++ {
+		conn, err := net.Dial("tcp", config.LocalAddr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s
+}
+
+// 统计handler的最大同时执行数
+func runConcurrentHandlers(t *testing.T, s *Server, svcID uint32, opts ...SvcOption) int32 {
+	const reqNum = 8
+	svc, err := s.NewServiceWithOptions("worker", svcID, opts...)
+	assert.Nil(t, err)
+	var running, maxRunning int32
+	done := make(chan struct{}, reqNum)
+	svc.RegisterSvcHandler("Work", func(ctx context.Context, req interface{}) (interface{}, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		done <- struct{}{}
+		return nil, nil
+	})
+	client, err := s.NewService("client", svcID)
+	assert.Nil(t, err)
+	for i := 0; i < reqNum; i++ {
+		err = client.Send(context.Background(), "worker", svcID, "Work", i)
+		assert.Nil(t, err)
+	}
+	for i := 0; i < reqNum; i++ {
+		<-done
+	}
+	return atomic.LoadInt32(&maxRunning)
+}
+
+func TestParallelService(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_parallel",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	assert.Equal(t, int32(1), runConcurrentHandlers(t, s, 1))
+	assert.Equal(t, int32(4), runConcurrentHandlers(t, s, 2, WithParallel(4)))
+}
+
+func TestParallelServiceCall(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_parallel_call",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	echo, err := s.NewService("echo", 1)
+	assert.Nil(t, err)
+	echo.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	})
+	proxy, err := s.NewServiceWithOptions("proxy", 1, WithParallel(4))
+	assert.Nil(t, err)
+	proxy.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+		return GetSvcFromCtx(ctx).Call(ctx, "echo", 1, "Echo", req)
+	})
+	client, err := s.NewServiceWithOptions("client", 1, WithParallel(16))
+	assert.Nil(t, err)
+	const reqNum = 16
+	results := make(chan int, reqNum)
+	for i := 0; i < reqNum; i++ {
+		i := i
+		client.RegisterTimer(func() {
+			rsp, err := client.Call(context.Background(), "proxy", 1, "Echo", i)
+			assert.Nil(t, err)
+			results <- rsp.(int)
+		}, 0, 1)
+	}
+	sum := 0
+	for i := 0; i < reqNum; i++ {
+		sum += <-results
+	}
+	assert.Equal(t, reqNum*(reqNum-1)/2, sum)
+}
+
+// 非worker goroutine通过真并发服务发起rpc, 不占用也不归还worker名额
+func TestParallelForeignCall(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_parallel_foreign",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	echo, err := s.NewService("echo", 1)
+	assert.Nil(t, err)
+	echo.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return req, nil
+	})
+	const parallel, reqNum = 2, 4
+	svc, err := s.NewServiceWithOptions("worker", 1, WithParallel(parallel))
+	assert.Nil(t, err)
+	var running, maxRunning int32
+	release := make(chan struct{})
+	done := make(chan struct{}, reqNum)
+	svc.RegisterSvcHandler("Work", func(ctx context.Context, req interface{}) (interface{}, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		<-release
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		done <- struct{}{}
+		return nil, nil
+	})
+	for i := 0; i < reqNum; i++ {
+		assert.Nil(t, svc.Send(context.Background(), "worker", 1, "Work", i))
+	}
+	for atomic.LoadInt32(&running) < parallel {
+		time.Sleep(time.Millisecond)
+	}
+	called := make(chan error, 1)
+	go func() {
+		_, err := svc.Call(context.Background(), "echo", 1, "Echo", "foreign")
+		called <- err
+	}()
+	// 回包排在等待名额的请求之后, 名额释放前其余请求不会开始执行
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(parallel), atomic.LoadInt32(&maxRunning))
+	close(release)
+	assert.Nil(t, <-called)
+	for i := 0; i < reqNum; i++ {
+		<-done
+	}
+	assert.Equal(t, int32(parallel), atomic.LoadInt32(&maxRunning))
+
+	// handler返回后, 其创建的goroutine仍使用handler的ctx发起rpc, 名额不重复归还也不泄漏
+	entered := make(chan struct{})
+	echo.RegisterSvcHandler("Enter", func(ctx context.Context, req interface{}) (interface{}, error) {
+		entered <- struct{}{}
+		time.Sleep(50 * time.Millisecond)
+		return req, nil
+	})
+	spawned := make(chan error, reqNum)
+	svc.RegisterSvcHandler("Spawn", func(ctx context.Context, req interface{}) (interface{}, error) {
+		go func() {
+			_, err := svc.Call(ctx, "echo", 1, "Enter", req)
+			spawned <- err
+		}()
+		// 返回时该rpc仍在等待回包
+		<-entered
+		time.Sleep(5 * time.Millisecond)
+		return nil, nil
+	})
+	for i := 0; i < reqNum; i++ {
+		assert.Nil(t, svc.Send(context.Background(), "worker", 1, "Spawn", i))
+	}
+	for i := 0; i < reqNum; i++ {
+		assert.Nil(t, <-spawned)
+	}
+	atomic.StoreInt32(&maxRunning, 0)
+	for i := 0; i < reqNum; i++ {
+		assert.Nil(t, svc.Send(context.Background(), "worker", 1, "Work", i))
+	}
+	for i := 0; i < reqNum; i++ {
+		<-done
+	}
+	assert.Equal(t, int32(parallel), atomic.LoadInt32(&maxRunning))
+}
+
+func TestTypedHandler(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_typed",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	lobby, err := s.NewService("lobby", 1)
+	assert.Nil(t, err)
+	err = lobby.RegisterTypedHandler("ReqLogin", func(ctx context.Context, req *testReqLogin) (*testReqLogin, error) {
+		return &testReqLogin{Gid: req.Gid + 1, Name: req.Name}, nil
+	})
+	assert.Nil(t, err)
+	err = lobby.RegisterTypedHandler("Kick", func(ctx context.Context, req *testReqLogin) (*testReqLogin, error) {
+		return nil, NewError(ErrCode_Usr+1, "gid %d not online", req.Gid)
+	})
+	assert.Nil(t, err)
+	err = lobby.RegisterTypedHandler("Bad", func(req *testReqLogin) error { return nil })
+	assert.True(t, errors.Is(err, RPC_HANDLER_TYPE_ERR))
+	err = lobby.RegisterTypedHandler("Bad", func(ctx context.Context, req *testReqLogin) *testReqLogin { return nil })
+	assert.True(t, errors.Is(err, RPC_RETVALUE_NUM_ERR))
+
+	client, err := s.NewService("client", 1)
+	assert.Nil(t, err)
+	rsp, err := client.Call(context.Background(), "lobby", 1, "ReqLogin", &testReqLogin{Gid: 100, Name: "lilei"})
+	assert.Nil(t, err)
+	assert.Equal(t, &testReqLogin{Gid: 101, Name: "lilei"}, rsp)
+	_, err = client.Call(context.Background(), "lobby", 1, "ReqLogin", testReqLogin{Gid: 100})
+	assert.True(t, errors.Is(err, RPC_REQ_TYPE_ERR))
+	err = client.Send(context.Background(), "lobby", 1, "ReqLogin", "lilei")
+	assert.True(t, errors.Is(err, RPC_REQ_TYPE_ERR))
+	// 返回nil指针时调用方拿到无类型nil
+	rsp, err = client.Call(context.Background(), "lobby", 1, "Kick", &testReqLogin{Gid: 100})
+	assert.Equal(t, ErrCode_Usr+1, ErrorCode(err))
+	assert.True(t, rsp == nil)
+	// 跨节点消息按注册类型解码
+	assert.Equal(t, reflect.TypeOf(&testReqLogin{}), s.GetMsgRegistry().Lookup(MSG_TYPE_CLUSTER_REQ, "ReqLogin"))
+	assert.Equal(t, reflect.TypeOf(&testReqLogin{}), s.GetMsgRegistry().Lookup(MSG_TYPE_CLUSTER_RSP, "ReqLogin"))
+}
+
+// 创建两个互通的测试节点
+func newTestClusterPair(t testing.TB, nameA, nameB string) (*Server, *Server) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	sa := newTestServer(t, ServerConfig{
+		ClusterName:    nameA,
+		LocalAddr:      addrA,
+		RemoteAddrs:    map[string]string{nameB: addrB},
+		TickIntervalMs: 10,
+	})
+	sb := newTestServer(t, ServerConfig{
+		ClusterName:    nameB,
+		LocalAddr:      addrB,
+		RemoteAddrs:    map[string]string{nameA: addrA},
+		TickIntervalMs: 10,
+	})
+	return sa, sb
+}
+
+func TestRpcTimeout(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_timeout",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+		RpcTimeoutMs:   100,
+	})
+	defer s.Exit()
+	slow, err := s.NewService("slow", 1)
+	assert.Nil(t, err)
+	slow.RegisterSvcHandler("Sleep", func(ctx context.Context, req interface{}) (interface{}, error) {
+		time.Sleep(req.(time.Duration))
+		return req, nil
+	})
+	client, err := s.NewService("client", 1)
+	assert.Nil(t, err)
+
+	// WithTimeout优先于ctx中的超时
+	ctx := context.WithValue(context.Background(), CtxKeyRpcTimeoutMS, time.Second)
+	_, err = client.Call(ctx, "slow", 1, "Sleep", 50*time.Millisecond, WithTimeout(10*time.Millisecond))
+	assert.True(t, errors.Is(err, RPC_TIMEOUT_ERR))
+	// 超时后迟到的回包被丢弃, 服务仍可正常处理后续rpc
+	rsp, err := client.Call(context.Background(), "slow", 1, "Sleep", time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Millisecond, rsp)
+
+	// Server默认超时
+	_, err = client.Call(context.Background(), "slow", 1, "Sleep", 200*time.Millisecond)
+	assert.True(t, errors.Is(err, RPC_TIMEOUT_ERR))
+	_, err = client.Call(context.Background(), "slow", 1, "Sleep", 200*time.Millisecond, WithTimeout(-1))
+	assert.Nil(t, err)
+
+	// ctx deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = client.Call(ctx, "slow", 1, "Sleep", 50*time.Millisecond)
+	assert.True(t, errors.Is(err, RPC_TIMEOUT_ERR))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// ctx cancel
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = client.Call(ctx, "slow", 1, "Sleep", 50*time.Millisecond)
+	assert.True(t, errors.Is(err, RPC_CANCELED_ERR))
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, 0, len(client.sessionStore.waitSessions))
+}
+
+func TestClusterRpcTimeout(t *testing.T) {
+	sa, sb := newTestClusterPair(t, "test_timeout_a", "test_timeout_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	slow, err := sb.NewService("slow", 1)
+	assert.Nil(t, err)
+	slow.RegisterSvcHandler("Sleep", func(ctx context.Context, req interface{}) (interface{}, error) {
+		time.Sleep(time.Duration(req.(float64)))
+		return req, nil
+	})
+	client, err := sa.NewServiceWithOptions("client", 1, WithParallel(2))
+	assert.Nil(t, err)
+	_, err = client.CallCluster(context.Background(), "test_timeout_b", "slow", 1, "Sleep", 50*time.Millisecond, WithTimeout(10*time.Millisecond))
+	assert.True(t, errors.Is(err, RPC_TIMEOUT_ERR))
+	rsp, err := client.CallCluster(context.Background(), "test_timeout_b", "slow", 1, "Sleep", time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(time.Millisecond), rsp)
+	assert.Equal(t, 0, len(client.sessionStore.waitSessions))
+}
+
+func TestClusterDeadlinePropagation(t *testing.T) {
+	sa, sb := newTestClusterPair(t, "test_deadline_a", "test_deadline_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	echo, err := sa.NewService("echo", 1)
+	assert.Nil(t, err)
+	echo.RegisterSvcHandler("Sleep", func(ctx context.Context, req interface{}) (interface{}, error) {
+		time.Sleep(time.Duration(req.(float64)) * time.Millisecond)
+		return req, nil
+	})
+	var invoked int32
+	downstreamErrs := make(chan error, 1)
+	lobby, err := sb.NewService("lobby", 1)
+	assert.Nil(t, err)
+	lobby.RegisterSvcHandler("Sleep", func(ctx context.Context, req interface{}) (interface{}, error) {
+		time.Sleep(time.Duration(req.(float64)) * time.Millisecond)
+		return req, nil
+	})
+	lobby.RegisterSvcHandler("Deadline", func(ctx context.Context, req interface{}) (interface{}, error) {
+		atomic.AddInt32(&invoked, 1)
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return nil, errors.New("no deadline")
+		}
+		return float64(time.Until(deadline) / time.Millisecond), nil
+	})
+	lobby.RegisterSvcHandler("Proxy", func(ctx context.Context, req interface{}) (interface{}, error) {
+		rsp, err := GetSvcFromCtx(ctx).CallCluster(ctx, "test_deadline_a", "echo", 1, "Sleep", req)
+		downstreamErrs <- err
+		return rsp, err
+	})
+	client, err := sa.NewService("client", 1)
+	assert.Nil(t, err)
+
+	rsp, err := client.CallCluster(context.Background(), "test_deadline_b", "lobby", 1, "Deadline", nil, WithTimeout(time.Second))
+	assert.Nil(t, err)
+	assert.True(t, rsp.(float64) > 0 && rsp.(float64) <= 1000)
+
+	// 下游rpc继承剩余超时
+	_, err = client.CallCluster(context.Background(), "test_deadline_b", "lobby", 1, "Proxy", 200, WithTimeout(50*time.Millisecond))
+	assert.True(t, errors.Is(err, RPC_TIMEOUT_ERR))
+	err = <-downstreamErrs
+	assert.True(t, errors.Is(err, RPC_TIMEOUT_ERR))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// 排队期间已超时的请求不再执行handler
+	atomic.StoreInt32(&invoked, 0)
+	err = client.SendCluster(context.Background(), "test_deadline_b", "lobby", 1, "Sleep", 100)
+	assert.Nil(t, err)
+	_, err = client.CallCluster(context.Background(), "test_deadline_b", "lobby", 1, "Deadline", nil, WithTimeout(20*time.Millisecond))
+	assert.True(t, errors.Is(err, RPC_TIMEOUT_ERR))
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&invoked))
+}
+
+func TestClusterMetadataCompat(t *testing.T) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	// a节点以兼容模式发送旧版本协议
+	sa := newTestServer(t, ServerConfig{
+		ClusterName:    "test_compat_a",
+		LocalAddr:      addrA,
+		RemoteAddrs:    map[string]string{"test_compat_b": addrB},
+		TickIntervalMs: 10,
+		WireCompat:     true,
+	})
+	defer sa.Exit()
+	sb := newTestServer(t, ServerConfig{
+		ClusterName:    "test_compat_b",
+		LocalAddr:      addrB,
+		RemoteAddrs:    map[string]string{"test_compat_a": addrA},
+		TickIntervalMs: 10,
+	})
+	defer sb.Exit()
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		_, hasDeadline := ctx.Deadline()
+		return map[string]interface{}{
+			"trace_id": MetadataFromCtx(ctx)["trace_id"],
+			"deadline": hasDeadline,
+		}, nil
+	}
+	for _, s := range []*Server{sa, sb} {
+		svc, err := s.NewService("lobby", 1)
+		assert.Nil(t, err)
+		svc.RegisterSvcHandler("Info", handler)
+	}
+	clientA, err := sa.NewService("client", 1)
+	assert.Nil(t, err)
+	clientB, err := sb.NewService("client", 1)
+	assert.Nil(t, err)
+	ctx := WithOutgoingMetadata(context.Background(), Metadata{"trace_id": "abc123"})
+
+	rsp, err := clientB.CallCluster(ctx, "test_compat_a", "lobby", 1, "Info", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"trace_id": "abc123", "deadline": true}, rsp)
+	// 旧版本协议不携带metadata和超时
+	rsp, err = clientA.CallCluster(ctx, "test_compat_b", "lobby", 1, "Info", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"trace_id": "", "deadline": false}, rsp)
+	// 节点内rpc同样传递metadata
+	rsp, err = clientA.Call(ctx, "lobby", 1, "Info", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc123", rsp.(map[string]interface{})["trace_id"])
+
+	sa.setWireCompat(false)
+	rsp, err = clientA.CallCluster(ctx, "test_compat_b", "lobby", 1, "Info", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"trace_id": "abc123", "deadline": true}, rsp)
+}
+
+func TestClusterLargeMsg(t *testing.T) {
+	sa, sb := newTestClusterPair(t, "test_large_a", "test_large_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	const limit = 32 << 10
+	sa.setMaxMsgSize(limit)
+	for _, s := range []*Server{sa, sb} {
+		svc, err := s.NewService("echo", 1)
+		assert.Nil(t, err)
+		svc.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+			return req, nil
+		})
+		svc.RegisterSvcHandler("Big", func(ctx context.Context, req interface{}) (interface{}, error) {
+			return strings.Repeat("b", 2*limit), nil
+		})
+	}
+	clientA, err := sa.NewService("client", 1)
+	assert.Nil(t, err)
+	clientB, err := sb.NewService("client", 1)
+	assert.Nil(t, err)
+
+	// 超过原8KB打包缓冲区
+	payload := strings.Repeat("a", limit/2)
+	rsp, err := clientA.CallCluster(context.Background(), "test_large_b", "echo", 1, "Echo", payload)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, rsp)
+	// 发送方检查
+	_, err = clientA.CallCluster(context.Background(), "test_large_b", "echo", 1, "Echo", strings.Repeat("a", 2*limit))
+	assert.True(t, errors.Is(err, RPC_MSG_TOO_LARGE_ERR))
+	err = clientA.SendCluster(context.Background(), "test_large_b", "echo", 1, "Echo", strings.Repeat("a", 2*limit))
+	assert.True(t, errors.Is(err, RPC_MSG_TOO_LARGE_ERR))
+	// 回包超限时返回错误给调用方
+	_, err = clientB.CallCluster(context.Background(), "test_large_a", "echo", 1, "Big", nil)
+	assert.True(t, errors.Is(err, RPC_MSG_TOO_LARGE_ERR))
+	// 接收方检查: 超限包导致连接断开, 调用方超时
+	_, err = clientA.CallCluster(context.Background(), "test_large_b", "echo", 1, "Big", nil, WithTimeout(300*time.Millisecond))
+	assert.True(t, errors.Is(err, RPC_TIMEOUT_ERR))
+	// 断开后重连恢复
+	rsp, err = clientA.CallCluster(context.Background(), "test_large_b", "echo", 1, "Echo", payload)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, rsp)
+}
+
+// 定时器回调与handler同时发起跨节点rpc, 打包互不覆盖
+func TestClusterPackConcurrent(t *testing.T) {
+	t.Run("parallel", func(t *testing.T) {
+		testClusterPackConcurrent(t, "test_pack_a", "test_pack_b", WithParallel(16))
+	})
+	// 伪并发模式下handler阻塞在rpc时分发循环由新的goroutine接替, 被唤醒的handler与接替者交错打包
+	t.Run("pseudo", func(t *testing.T) {
+		testClusterPackConcurrent(t, "test_pack_pseudo_a", "test_pack_pseudo_b")
+	})
+}
+
+func testClusterPackConcurrent(t *testing.T, nameA, nameB string, opts ...SvcOption) {
+	sa, sb := newTestClusterPair(t, nameA, nameB)
+	defer sa.Exit()
+	defer sb.Exit()
+	echo, err := sb.NewServiceWithOptions("echo", 1, WithParallel(8))
+	assert.Nil(t, err)
+	echo.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	})
+	client, err := sa.NewServiceWithOptions("client", 1, opts...)
+	assert.Nil(t, err)
+	// 同时等待回包的Relay数, 大于1说明前一个handler阻塞期间已开始处理后续请求
+	var inflight, maxInflight int32
+	client.RegisterSvcHandler("Relay", func(ctx context.Context, req interface{}) (interface{}, error) {
+		svc := GetSvcFromCtx(ctx)
+		err := svc.SendCluster(ctx, nameB, "echo", 1, "Echo", req)
+		if err != nil {
+			return nil, err
+		}
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			cur := atomic.LoadInt32(&maxInflight)
+			if n <= cur || atomic.CompareAndSwapInt32(&maxInflight, cur, n) {
+				break
+			}
+		}
+		return svc.CallCluster(ctx, nameB, "echo", 1, "Echo", req)
+	})
+	driver, err := sa.NewServiceWithOptions("driver", 1, opts...)
+	assert.Nil(t, err)
+
+	const reqNum = 64
+	payload := func(i int) string {
+		// 部分请求超过初始打包缓冲区大小
+		return strings.Repeat(string(rune('a'+i%26)), 1+i*256)
+	}
+	errs := make(chan error, 2*reqNum)
+	check := func(i int, rsp interface{}, err error) {
+		if err == nil && rsp != payload(i) {
+			err = errors.New("payload mismatch")
+		}
+		errs <- err
+	}
+	for i := 0; i < reqNum; i++ {
+		i := i
+		client.RegisterTimer(func() {
+			rsp, err := client.CallCluster(context.Background(), nameB, "echo", 1, "Echo", payload(i))
+			check(i, rsp, err)
+		}, 0, 1)
+		driver.RegisterTimer(func() {
+			rsp, err := driver.Call(context.Background(), "client", 1, "Relay", payload(i))
+			check(i, rsp, err)
+		}, 0, 1)
+	}
+	for i := 0; i < 2*reqNum; i++ {
+		assert.Nil(t, <-errs)
+	}
+	assert.True(t, atomic.LoadInt32(&maxInflight) > 1)
+}
+
+func TestMailboxOverload(t *testing.T) {
+	sa, sb := newTestClusterPair(t, "test_overload_a", "test_overload_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	block := make(chan struct{})
+	started := make(chan struct{}, 4)
+	slow, err := sb.NewServiceWithOptions("slow", 1, WithMailbox(1, OVERFLOW_REJECT))
+	assert.Nil(t, err)
+	slow.RegisterSvcHandler("Block", func(ctx context.Context, req interface{}) (interface{}, error) {
+		started <- struct{}{}
+		<-block
+		return req, nil
+	})
+	client, err := sb.NewServiceWithOptions("client", 1, WithParallel(4))
+	assert.Nil(t, err)
+	results := make(chan error, 2)
+	call := func() {
+		_, err := client.Call(context.Background(), "slow", 1, "Block", nil)
+		results <- err
+	}
+	// 第一个请求处理中, 第二个请求在邮箱中排队
+	go call()
+	<-started
+	go call()
+	for i := 0; i < 100 && slow.mqueue.Len() != 1; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, 1, slow.mqueue.Len())
+
+	_, err = client.Call(context.Background(), "slow", 1, "Block", nil)
+	assert.True(t, errors.Is(err, RPC_OVERLOAD_ERR))
+	assert.Equal(t, ErrCode_Overload, ErrorCode(err))
+	err = client.Send(context.Background(), "slow", 1, "Block", nil)
+	assert.True(t, errors.Is(err, RPC_OVERLOAD_ERR))
+	// 跨节点请求由gate回复过载错误
+	remote, err := sa.NewService("remote", 1)
+	assert.Nil(t, err)
+	_, err = remote.CallCluster(context.Background(), "test_overload_b", "slow", 1, "Block", nil)
+	assert.Equal(t, ErrCode_Overload, ErrorCode(err))
+
+	close(block)
+	assert.Nil(t, <-results)
+	assert.Nil(t, <-results)
+	_, err = client.Call(context.Background(), "slow", 1, "Block", nil)
+	assert.Nil(t, err)
+	sample := findSample(sb.Metrics().Gather(), METRIC_MAILBOX_OVERFLOW, "slow-1", "reject")
+	assert.Equal(t, float64(3), sample.Value)
+}
+
+// 伪并发模式下handler内联执行, 阻塞在rpc时交出分发循环, 其他消息照常处理且handler之间仍串行
+func TestInlineDispatch(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_inline",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	block := make(chan struct{})
+	echo, err := s.NewServiceWithOptions("echo", 1, WithParallel(4))
+	assert.Nil(t, err)
+	echo.RegisterSvcHandler("Block", func(ctx context.Context, req interface{}) (interface{}, error) {
+		<-block
+		return req, nil
+	})
+	echo.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	})
+	lobby, err := s.NewService("lobby", 1)
+	assert.Nil(t, err)
+	var running, maxRunning, fast int32
+	enter := func() {
+		if n := atomic.AddInt32(&running, 1); n > atomic.LoadInt32(&maxRunning) {
+			atomic.StoreInt32(&maxRunning, n)
+		}
+	}
+	leave := func() {
+		atomic.AddInt32(&running, -1)
+	}
+	lobby.RegisterSvcHandler("Slow", func(ctx context.Context, req interface{}) (interface{}, error) {
+		enter()
+		defer leave()
+		// 被唤醒后再次发起rpc
+		for _, method := range []string{"Block", "Echo", "Echo"} {
+			leave()
+			_, err := lobby.Call(ctx, "echo", 1, method, req)
+			enter()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return atomic.LoadInt32(&fast), nil
+	})
+	lobby.RegisterSvcHandler("Fast", func(ctx context.Context, req interface{}) (interface{}, error) {
+		enter()
+		defer leave()
+		return atomic.AddInt32(&fast, 1), nil
+	})
+	fired := make(chan struct{}, 1)
+	lobby.RegisterTimer(func() {
+		enter()
+		defer leave()
+		select {
+		case fired <- struct{}{}:
+		default:
+		}
+	}, 10, 1)
+
+	client, err := s.NewServiceWithOptions("client", 1, WithParallel(4))
+	assert.Nil(t, err)
+	results := make(chan interface{}, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			rsp, err := client.Call(context.Background(), "lobby", 1, "Slow", nil)
+			assert.Nil(t, err)
+			results <- rsp
+		}()
+	}
+	// Slow阻塞期间Fast和定时器不受影响
+	for i := 1; i <= 10; i++ {
+		rsp, err := client.Call(context.Background(), "lobby", 1, "Fast", nil)
+		assert.Nil(t, err)
+		assert.Equal(t, int32(i), rsp)
+	}
+	<-fired
+	assert.Equal(t, 0, len(results))
+	close(block)
+	assert.Equal(t, int32(10), <-results)
+	assert.Equal(t, int32(10), <-results)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxRunning))
+	rsp, err := client.Call(context.Background(), "lobby", 1, "Fast", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(11), rsp)
+}
+
+// 非handler goroutine(如main, 测试goroutine)通过伪并发服务发起rpc, 不交接执行权, 正在内联执行的handler不受影响
+func TestForeignCall(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_foreign_call",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	block := make(chan struct{})
+	echo, err := s.NewServiceWithOptions("echo", 1, WithParallel(4))
+	assert.Nil(t, err)
+	echo.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	})
+	echo.RegisterSvcHandler("Block", func(ctx context.Context, req interface{}) (interface{}, error) {
+		<-block
+		return req, nil
+	})
+	lobby, err := s.NewService("lobby", 1)
+	assert.Nil(t, err)
+	var running, maxRunning int32
+	enter := func() {
+		if n := atomic.AddInt32(&running, 1); n > atomic.LoadInt32(&maxRunning) {
+			atomic.StoreInt32(&maxRunning, n)
+		}
+	}
+	leave := func() {
+		atomic.AddInt32(&running, -1)
+	}
+	lobby.RegisterSvcHandler("Slow", func(ctx context.Context, req interface{}) (interface{}, error) {
+		enter()
+		time.Sleep(20 * time.Millisecond)
+		leave()
+		_, err := lobby.Call(ctx, "echo", 1, "Echo", req)
+		enter()
+		defer leave()
+		time.Sleep(20 * time.Millisecond)
+		return req, err
+	})
+
+	// 定时器回调没有handler的ctx, 同样需要在等待回包时让出执行权
+	timerStarted := make(chan struct{})
+	timerDone := make(chan error, 1)
+	lobby.RegisterTimer(func() {
+		close(timerStarted)
+		_, err := lobby.Call(context.Background(), "echo", 1, "Block", nil)
+		timerDone <- err
+	}, 10, 1)
+	<-timerStarted
+
+	client, err := s.NewServiceWithOptions("client", 1, WithParallel(4))
+	assert.Nil(t, err)
+	const slowNum = 4
+	results := make(chan error, slowNum)
+	for i := 0; i < slowNum; i++ {
+		go func(i int) {
+			_, err := client.Call(context.Background(), "lobby", 1, "Slow", i)
+			results <- err
+		}(i)
+	}
+	// handler内联执行或被回包唤醒期间, 测试goroutine直接使用lobby发起rpc
+	for i := 0; i < 20; i++ {
+		rsp, err := lobby.Call(context.Background(), "echo", 1, "Echo", i)
+		assert.Nil(t, err)
+		assert.Equal(t, i, rsp)
+		time.Sleep(2 * time.Millisecond)
+	}
+	// 超时直接返回, 不经由lobby的消息队列交还执行权
+	_, err = lobby.Call(context.Background(), "echo", 1, "Block", nil, WithTimeout(20*time.Millisecond))
+	assert.Equal(t, ErrCode_Timeout, ErrorCode(err))
+	for i := 0; i < slowNum; i++ {
+		assert.Nil(t, <-results)
+	}
+	close(block)
+	assert.Nil(t, <-timerDone)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxRunning))
+	rsp, err := client.Call(context.Background(), "lobby", 1, "Slow", "again")
+	assert.Nil(t, err)
+	assert.Equal(t, "again", rsp)
+}
+
+func TestMPSCMailbox(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_mpsc",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	_, err := s.NewServiceWithOptions("hub", 2, WithMailboxKind(MAILBOX_MPSC), WithMailbox(8, OVERFLOW_REJECT))
+	assert.Equal(t, MAILBOX_OPTION_ERR, err)
+	_, err = s.NewServiceWithOptions("hub", 2, WithMailboxKind(MAILBOX_MPSC), WithPriority(0))
+	assert.Equal(t, MAILBOX_OPTION_ERR, err)
+
+	hub, err := s.NewServiceWithOptions("hub", 1, WithMailboxKind(MAILBOX_MPSC))
+	assert.Nil(t, err)
+	var count int
+	hub.RegisterSvcHandler("Add", func(ctx context.Context, req interface{}) (interface{}, error) {
+		// 伪并发模式下handler串行执行
+		count++
+		return count, nil
+	})
+	const clientNum, reqNum = 16, 50
+	results := make(chan error, clientNum)
+	for i := 0; i < clientNum; i++ {
+		client, err := s.NewService("client", uint32(i))
+		assert.Nil(t, err)
+		go func() {
+			for j := 0; j < reqNum; j++ {
+				if j%2 == 0 {
+					_, err = client.Call(context.Background(), "hub", 1, "Add", nil)
+				} else {
+					err = client.Send(context.Background(), "hub", 1, "Add", nil)
+				}
+				if err != nil {
+					break
+				}
+			}
+			results <- err
+		}()
+	}
+	for i := 0; i < clientNum; i++ {
+		assert.Nil(t, <-results)
+	}
+	client, err := s.NewService("client", clientNum)
+	assert.Nil(t, err)
+	rsp, err := client.Call(context.Background(), "hub", 1, "Add", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, clientNum*reqNum+1, rsp)
+	assert.Equal(t, 0, hub.mqueue.Len())
+}
+
+// notify洪峰下在途rpc的回包延迟: relay处理请求时调用echo, 回包到达relay邮箱时前面已排着大量notify
+func benchmarkFloodRpcLatency(b *testing.B, opts ...SvcOption) {
+	const floodNum = 50
+	s := newTestServer(b, ServerConfig{
+		ClusterName:    "bench_flood",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+		LogLevel:       "warning",
+	})
+	defer s.Exit()
+	echo, _ := s.NewService("echo", 1)
+	echo.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+		// 保证回包到达前洪峰已全部入队
+		time.Sleep(time.Millisecond)
+		return req, nil
+	})
+	relay, _ := s.NewServiceWithOptions("relay", 1, opts...)
+	relay.RegisterSvcHandler("Flood", func(ctx context.Context, req interface{}) (interface{}, error) {
+		// 模拟少量阻塞io, 不占用cpu以免单核下拖慢echo
+		time.Sleep(50 * time.Microsecond)
+		return nil, nil
+	})
+	latencies := make(chan time.Duration, 1)
+	relay.RegisterSvcHandler("Relay", func(ctx context.Context, req interface{}) (interface{}, error) {
+		start := time.Now()
+		_, err := relay.Call(ctx, "echo", 1, "Echo", req)
+		latencies <- time.Since(start)
+		return nil, err
+	})
+	client, _ := s.NewService("client", 1)
+	ctx := context.Background()
+	samples := make([]time.Duration, 0, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client.Send(ctx, "relay", 1, "Relay", i)
+		for j := 0; j < floodNum; j++ {
+			client.Send(ctx, "relay", 1, "Flood", nil)
+		}
+		samples = append(samples, <-latencies)
+		// 等待洪峰处理完, 各轮互不影响
+		for relay.mqueue.Len() > 0 {
+			time.Sleep(100 * time.Microsecond)
+		}
+	}
+	b.StopTimer()
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+	b.ReportMetric(float64(samples[len(samples)/2].Microseconds()), "p50-us")
+	b.ReportMetric(float64(samples[len(samples)*99/100].Microseconds()), "p99-us")
+}
+
+func BenchmarkFloodRpcLatency(b *testing.B) {
+	b.Run("fifo", func(b *testing.B) {
+		benchmarkFloodRpcLatency(b)
+	})
+	b.Run("priority", func(b *testing.B) {
+		benchmarkFloodRpcLatency(b, WithPriority(0))
+	})
+}
+
+// concurrency个调用方服务并发发起共b.N次rpc, 报告qps
+func benchmarkCalls(b *testing.B, s *Server, concurrency int, call func(client *Service, i int) error) {
+	clients := make([]*Service, concurrency)
+	for i := range clients {
+		client, err := s.NewService("bench_client", uint32(i))
+		assert.Nil(b, err)
+		clients[i] = client
+	}
+	var next int64 = -1
+	var wg sync.WaitGroup
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Service) {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= b.N {
+					return
+				}
+				if err := call(client, i); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(client)
+	}
+	wg.Wait()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "qps")
+}
+
+// 节点内rpc吞吐, nested: handler内再发起一次rpc
+func BenchmarkSvcCall(b *testing.B) {
+	for _, nested := range []bool{false, true} {
+		name := "direct"
+		if nested {
+			name = "nested"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := newTestServer(b, ServerConfig{
+				ClusterName:    "bench_call",
+				LocalAddr:      "127.0.0.1:0",
+				TickIntervalMs: 10,
+				LogLevel:       "warning",
+			})
+			defer s.Exit()
+			echo, _ := s.NewService("echo", 1)
+			echo.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+				return req, nil
+			})
+			lobby, _ := s.NewService("lobby", 1)
+			lobby.RegisterSvcHandler("Login", func(ctx context.Context, req interface{}) (interface{}, error) {
+				if nested {
+					return lobby.Call(ctx, "echo", 1, "Echo", req)
+				}
+				return req, nil
+			})
+			benchmarkCalls(b, s, 200, func(client *Service, i int) error {
+				_, err := client.Call(context.Background(), "lobby", 1, "Login", i)
+				return err
+			})
+		})
+	}
+}
+
+// 对应test/stress/helloworld的跨节点压测: 200个调用方, 4个伪并发lobby服务, 取模hash分发
+func BenchmarkClusterCall(b *testing.B) {
+	const svcNum = 4
+	sa, sb := newTestClusterPair(b, "bench_cluster_a", "bench_cluster_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	sa.GetLogSystem().SetLevel(log.LevelWarning)
+	sb.GetLogSystem().SetLevel(log.LevelWarning)
+	for i := 0; i < svcNum; i++ {
+		lobby, _ := sb.NewService("lobby", uint32(i))
+		lobby.RegisterTypedHandler("ReqLogin", func(ctx context.Context, req *testReqLogin) (*testReqLogin, error) {
+			return req, nil
+		})
+	}
+	sa.RegisterMsgType(MSG_TYPE_CLUSTER_RSP, "ReqLogin", (*testReqLogin)(nil))
+	benchmarkCalls(b, sa, 200, func(client *Service, i int) error {
+		_, err := client.CallCluster(context.Background(), "bench_cluster_b", "lobby", client.instID%svcNum, "ReqLogin", &testReqLogin{Gid: uint64(i), Name: "bench"})
+		return err
+	})
+}
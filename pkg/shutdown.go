@@ -0,0 +1,206 @@
+package saber
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// 服务停止回调, ctx为Shutdown传入的ctx
+type SvcStopFunc func(ctx context.Context)
+
+// 注册停止回调: Shutdown/Exit时按注册顺序执行, 与handler一样经由服务消息队列调度,
+// 回调中可以访问服务状态和发起rpc, 其发起的rpc同样计入Shutdown的等待.
+// 回调执行完后仍未结束的流以RPC_SHUTDOWN_ERR中断, 需要正常结束的流应在回调中关闭
+func (s *Service) OnStop(f SvcStopFunc) {
+	s.rwMu.Lock()
+	s.stopHooks = append(s.stopHooks, f)
+	s.rwMu.Unlock()
+}
+
+func (s *Service) onStop(ctx context.Context, msg interface{}) {
+	defer s.server.metrics.observeDispatch(s.metricLabel, MSG_TYPE_STOP, "", time.Now())
+	for _, f := range msg.([]SvcStopFunc) {
+		s.callStopHook(ctx, f)
+	}
+	// 空闲的流会一直阻塞在Recv, 不主动结束时Shutdown只能等到超时
+	s.closeStreams(RPC_SHUTDOWN_ERR)
+}
+
+// 结束全部未结束的流, 对端收到err
+func (s *Service) closeStreams(err error) {
+	s.streamMu.Lock()
+	streams := make([]*Stream, 0, len(s.streams))
+	for _, st := range s.streams {
+		streams = append(streams, st)
+	}
+	s.streamMu.Unlock()
+	for _, st := range streams {
+		if ferr := st.finish(err); ferr != nil {
+			s.log.Errorf("%s finish stream %s err:%v", s, st.method, ferr)
+		}
+	}
+}
+
+func (s *Service) callStopHook(ctx context.Context, f SvcStopFunc) {
+	defer func() {
+		if e := recover(); e != nil {
+			s.log.Errorf("%s panic occurred on stop hook: %v\n%s", s, e, debug.Stack())
+		}
+	}()
+	f(ctx)
+}
+
+// 投递停止消息, 只执行一次: 执行停止回调并结束未结束的流
+func (s *Service) stop(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		return
+	}
+	s.rwMu.Lock()
+	hooks := s.stopHooks
+	s.stopHooks = nil
+	s.rwMu.Unlock()
+	s.pushMsg(ctx, s.handle, MSG_TYPE_STOP, 0, hooks)
+}
+
+func (s *Service) isStopped() bool {
+	return atomic.LoadInt32(&s.stopped) == 1
+}
+
+func (s *Service) isAborted() bool {
+	return atomic.LoadInt32(&s.aborted) == 1
+}
+
+// 放弃等待: 在途rpc经由消息队列返回RPC_SHUTDOWN_ERR, 之后邮箱中的请求不再执行, 新发起的rpc直接失败
+func (s *Service) abort() {
+	if !atomic.CompareAndSwapInt32(&s.aborted, 0, 1) {
+		return
+	}
+	for _, session := range s.sessionStore.pendingSessions() {
+		s.pushMsg(context.Background(), s.handle, MSG_TYPE_SVC_RSP, session, &SvcResponse{Err: RPC_SHUTDOWN_ERR})
+	}
+}
+
+// abort后给请求方回复RPC_SHUTDOWN_ERR, 流以同样错误结束, 定时器丢弃. 返回消息是否已处理
+func (s *Service) rejectAborted(source SVC_HANDLE, msgType MsgType, session uint32, msg interface{}) bool {
+	if !s.isAborted() {
+		return false
+	}
+	switch msgType {
+	case MSG_TYPE_SVC_REQ:
+		if session != 0 {
+			s.replySvc(source, session, msg.(*SvcRequest).Method, nil, RPC_SHUTDOWN_ERR)
+		}
+	case MSG_TYPE_CLUSTER_REQ:
+		if session != 0 {
+			req := msg.(*SvcRequest)
+			s.replyCluster(req.wireVersion, source, session, req.Method, nil, RPC_SHUTDOWN_ERR)
+		}
+	case MSG_TYPE_STREAM_OPEN:
+		st := msg.(*Stream)
+		if err := st.finish(RPC_SHUTDOWN_ERR); err != nil {
+			s.log.Errorf("%s finish stream %s err:%v", s, st.method, err)
+		}
+	case MSG_TYPE_TIMER:
+	default:
+		return false
+	}
+	return true
+}
+
+// 邮箱为空, 没有正在处理的消息且没有等待回包的rpc
+func (s *Service) idle() bool {
+	return atomic.LoadInt32(&s.busy) == 0 && s.mqueue.Len() == 0 && s.sessionStore.pending() == 0
+}
+
+// 等待服务处理完邮箱中的消息和在途rpc, ctx结束时返回ctx.Err()
+func waitIdle(ctx context.Context, svcs []*Service) error {
+	ticker := time.NewTicker(SHUTDOWN_POLL_MS * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		idle := true
+		for _, svc := range svcs {
+			if !svc.idle() {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// 停止服务: 执行OnStop回调并中断未结束的流, 等待邮箱中的消息和在途rpc处理完; ctx结束时仍未完成的部分返回RPC_SHUTDOWN_ERR.
+// 处理完返回nil, 否则返回ctx.Err()
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.stop(ctx)
+	err := waitIdle(ctx, []*Service{s})
+	s.abort()
+	s.exit()
+	return err
+}
+
+// 处理完邮箱中剩余消息后退出分发循环
+func (s *Service) exit() {
+	if s.exitNotify.Fire() {
+		<-s.exitDone.Done()
+	}
+}
+
+func (s *Server) isShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) == 1
+}
+
+// 有序停止节点:
+// 1. gate不再接收新的跨节点请求和流, 直接回复ErrCode_Shutdown
+// 2. 执行各服务OnStop回调并中断未结束的流, 等待服务处理完邮箱中的消息和在途rpc(包括跨节点rpc的回包)
+// 3. ctx结束时仍在等待的rpc和邮箱中剩余的请求返回RPC_SHUTDOWN_ERR
+// 4. 退出各服务, 关闭远端连接, gate监听和管理端, 日志落盘
+// 在ctx结束前处理完返回nil, 否则返回ctx.Err(). 重复调用直接返回nil
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.shuttingDown, 0, 1) {
+		return nil
+	}
+	s.log.Infof("cluster %s shutting down", s.ClusterName())
+	s.rwMu.RLock()
+	svcs := make([]*Service, 0, len(s.services))
+	for _, svc := range s.services {
+		svcs = append(svcs, svc)
+	}
+	s.rwMu.RUnlock()
+	for _, svc := range svcs {
+		svc.stop(ctx)
+	}
+	err := waitIdle(ctx, svcs)
+	if err != nil {
+		s.log.Warningf("cluster %s shutdown wait services err:%v", s.ClusterName(), err)
+	}
+	// 先全部abort再逐个退出, 避免在途rpc一直等待先退出的服务回包
+	for _, svc := range svcs {
+		svc.abort()
+	}
+	for _, svc := range svcs {
+		svc.exit()
+	}
+	s.sidecar.Exit()
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	ferr := s.log.Flush()
+	if ferr != nil {
+		fmt.Fprintf(os.Stderr, "flush log err:%v\n", ferr)
+	}
+	if s.fileLogger != nil {
+		s.fileLogger.Close()
+	}
+	return err
+}
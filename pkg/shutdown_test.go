@@ -0,0 +1,265 @@
+package saber
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	sa, sb := newTestClusterPair(t, "test_shutdown_a", "test_shutdown_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	slow, err := sb.NewService("slow", 1)
+	assert.Nil(t, err)
+	slow.RegisterSvcHandler("Work", func(ctx context.Context, req interface{}) (interface{}, error) {
+		started <- struct{}{}
+		<-release
+		// 停止期间仍可向远端发起rpc
+		return slow.CallCluster(ctx, "test_shutdown_a", "echo", 1, "Echo", req)
+	})
+	var stopped []string
+	slow.OnStop(func(ctx context.Context) {
+		_, ok := ctx.Deadline()
+		assert.True(t, ok)
+		stopped = append(stopped, "hook1")
+	})
+	slow.OnStop(func(ctx context.Context) {
+		stopped = append(stopped, "hook2")
+	})
+	echo, err := sa.NewService("echo", 1)
+	assert.Nil(t, err)
+	echo.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	})
+	client, err := sa.NewServiceWithOptions("client", 1, WithParallel(2))
+	assert.Nil(t, err)
+	results := make(chan interface{}, 1)
+	go func() {
+		rsp, err := client.CallCluster(context.Background(), "test_shutdown_b", "slow", 1, "Work", "hello")
+		assert.Nil(t, err)
+		results <- rsp
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- sb.Shutdown(ctx)
+	}()
+	for !sb.isShuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+	// 新的跨节点请求被gate拒绝
+	_, err = client.CallCluster(context.Background(), "test_shutdown_b", "slow", 1, "Work", "world")
+	assert.True(t, errors.Is(err, RPC_SHUTDOWN_ERR))
+	assert.Equal(t, ErrCode_Shutdown, ErrorCode(err))
+	assert.Equal(t, 0, len(done))
+
+	// 处理中的请求完成后才退出
+	close(release)
+	assert.Equal(t, "hello", <-results)
+	assert.Nil(t, <-done)
+	assert.Equal(t, []string{"hook1", "hook2"}, stopped)
+	assert.Nil(t, sb.Shutdown(ctx))
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	sa, sb := newTestClusterPair(t, "test_shutdown_timeout_a", "test_shutdown_timeout_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	block := make(chan struct{})
+	defer close(block)
+	remote, err := sa.NewService("remote", 1)
+	assert.Nil(t, err)
+	remote.RegisterSvcHandler("Block", func(ctx context.Context, req interface{}) (interface{}, error) {
+		<-block
+		return nil, nil
+	})
+	started := make(chan struct{}, 1)
+	proxy, err := sb.NewService("proxy", 1)
+	assert.Nil(t, err)
+	proxy.RegisterSvcHandler("Forward", func(ctx context.Context, req interface{}) (interface{}, error) {
+		started <- struct{}{}
+		return proxy.CallCluster(ctx, "test_shutdown_timeout_a", "remote", 1, "Block", req)
+	})
+	client, err := sa.NewService("client", 1)
+	assert.Nil(t, err)
+	results := make(chan error, 1)
+	go func() {
+		_, err := client.CallCluster(context.Background(), "test_shutdown_timeout_b", "proxy", 1, "Forward", nil)
+		results <- err
+	}()
+	<-started
+
+	// 等待超时后在途rpc返回RPC_SHUTDOWN_ERR, 经由handler回复给远端调用方
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = sb.Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	err = <-results
+	assert.Equal(t, ErrCode_Shutdown, ErrorCode(err))
+}
+
+func TestServiceShutdown(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_svc_shutdown",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	busy, err := s.NewService("busy", 1)
+	assert.Nil(t, err)
+	busy.RegisterSvcHandler("Block", func(ctx context.Context, req interface{}) (interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return req, nil
+	})
+	client, err := s.NewServiceWithOptions("client", 1, WithParallel(4))
+	assert.Nil(t, err)
+	results := make(chan error, 3)
+	call := func() {
+		_, err := client.Call(context.Background(), "busy", 1, "Block", nil)
+		results <- err
+	}
+	go call()
+	<-started
+	// 排在邮箱中的请求
+	go call()
+	go call()
+	for i := 0; i < 100 && busy.mqueue.Len() != 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, 2, busy.mqueue.Len())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	go func() {
+		// 超时放弃等待后再放行处理中的请求
+		for !busy.isAborted() {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+	}()
+	err = busy.Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	// 处理中的请求正常完成, 超时后邮箱中剩余的请求被拒绝
+	var succeed, rejected int
+	for i := 0; i < 3; i++ {
+		err := <-results
+		if err == nil {
+			succeed++
+		} else if errors.Is(err, RPC_SHUTDOWN_ERR) {
+			rejected++
+		}
+	}
+	assert.Equal(t, 1, succeed)
+	assert.Equal(t, 2, rejected)
+	// 已停止服务的rpc直接失败
+	_, err = busy.Call(context.Background(), "client", 1, "Any", nil)
+	assert.True(t, errors.Is(err, RPC_SHUTDOWN_ERR))
+}
+
+func TestServiceExit(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_svc_exit",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	busy, err := s.NewService("busy", 1)
+	assert.Nil(t, err)
+	busy.RegisterSvcHandler("Block", func(ctx context.Context, req interface{}) (interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return req, nil
+	})
+	stopped := make(chan bool, 1)
+	busy.OnStop(func(ctx context.Context) {
+		stopped <- ctx.Err() == nil
+	})
+	client, err := s.NewServiceWithOptions("client", 1, WithParallel(4))
+	assert.Nil(t, err)
+	results := make(chan error, 3)
+	call := func() {
+		_, err := client.Call(context.Background(), "busy", 1, "Block", nil)
+		results <- err
+	}
+	go call()
+	<-started
+	go call()
+	go call()
+	for i := 0; i < 100 && busy.mqueue.Len() != 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, 2, busy.mqueue.Len())
+
+	exited := make(chan struct{})
+	go func() {
+		s.DelService("busy", 1)
+		close(exited)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// 邮箱中的请求处理完前不退出
+	assert.Equal(t, 0, len(exited))
+	close(release)
+	<-exited
+	// 邮箱中的请求照常处理, 停止回调拿到的ctx未结束
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, <-results)
+	}
+	assert.True(t, <-stopped)
+}
+
+func TestShutdownStream(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_shutdown_stream",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	aborted := make(chan error, 1)
+	replay, err := s.NewService("replay", 1)
+	assert.Nil(t, err)
+	replay.RegisterStreamHandler("Hold", func(ctx context.Context, st *Stream) error {
+		_, err := st.Recv()
+		aborted <- err
+		return err
+	})
+	client, err := s.NewService("client", 1)
+	assert.Nil(t, err)
+	st, err := client.OpenStream(context.Background(), "test_shutdown_stream", "replay", 1, "Hold")
+	assert.Nil(t, err)
+	// 等待handler阻塞在Recv
+	for i := 0; i < 100 && replay.sessionStore.pending() == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// 空闲的流被中断, 不必等到超时
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	begin := time.Now()
+	assert.Nil(t, replay.Shutdown(ctx))
+	assert.True(t, time.Since(begin) < time.Second)
+	assert.Equal(t, STREAM_CLOSED_ERR, <-aborted)
+	_, err = st.Recv()
+	assert.Equal(t, ErrCode_Shutdown, ErrorCode(err))
+	// 已停止的服务不再接收新的流, 发起方立即收到错误
+	st, err = client.OpenStream(context.Background(), "test_shutdown_stream", "replay", 1, "Hold")
+	assert.Nil(t, err)
+	_, err = st.Recv()
+	assert.Equal(t, ErrCode_Shutdown, ErrorCode(err))
+	replay.streamMu.Lock()
+	assert.Equal(t, 0, len(replay.streams))
+	replay.streamMu.Unlock()
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sort"
 	"sync"
 
 	"github.com/xingshuo/saber/common/netframe"
@@ -11,47 +12,81 @@ import (
 )
 
 type ClusterProxy struct {
-	// 不加锁应该没问题
 	rmtClusters map[string]string           // clustername: address
 	hashToNames map[uint32]string           // hashID : clustername
 	dialers     map[string]*netframe.Dialer // clustername: dialer
 	rwMu        sync.RWMutex
+	onClosed    func(cluster string) // 到远端节点的连接断开
 }
 
+// 到远端节点的连接只处理发包, 断开时通知ClusterProxy
+type dialReceiver struct {
+	netframe.DefaultReceiver
+	cluster  string
+	onClosed func(cluster string)
+}
+
+func (r *dialReceiver) OnClosed(s netframe.Sender) error {
+	if r.onClosed != nil {
+		r.onClosed(r.cluster)
+	}
+	return nil
+}
+
+// 按全量地址表更新远端节点: 地址变化或被移除的节点关闭旧Dialer, 下次发包时按新地址重连
 func (p *ClusterProxy) Reload(clusterAddrs map[string]string) {
+	clusterAddrs = copyClusterAddrs(clusterAddrs)
+	// 重新生成hash表
+	hashs := make(map[uint32]string)
+	for name := range clusterAddrs {
+		hashs[utils.ClusterNameToHash(name)] = name
+	}
+	var expired []*netframe.Dialer
+	p.rwMu.Lock()
 	for name, addr := range p.rmtClusters {
 		// 移除失效的Dialer
 		if clusterAddrs[name] != addr {
-			p.rwMu.Lock()
-			d := p.dialers[name]
-			delete(p.dialers, name)
-			p.rwMu.Unlock()
-			if d != nil {
-				d.Shutdown()
+			if d := p.dialers[name]; d != nil {
+				expired = append(expired, d)
 			}
+			delete(p.dialers, name)
 		}
 	}
 	p.rmtClusters = clusterAddrs
-	// 重新生成hash表
-	hashs := make(map[uint32]string)
-	for name := range clusterAddrs {
-		hashs[utils.ClusterNameToHash(name)] = name
-	}
 	p.hashToNames = hashs
+	p.rwMu.Unlock()
+	for _, d := range expired {
+		d.Shutdown()
+	}
+}
+
+func (p *ClusterProxy) GetClusterName(hashID uint32) (string, bool) {
+	p.rwMu.RLock()
+	defer p.rwMu.RUnlock()
+	cluster, ok := p.hashToNames[hashID]
+	return cluster, ok
 }
 
 func (p *ClusterProxy) GetDialer(clusterName string) (*netframe.Dialer, error) {
+	p.rwMu.RLock()
+	d := p.dialers[clusterName]
+	p.rwMu.RUnlock()
+	if d != nil {
+		return d, nil
+	}
+	p.rwMu.Lock()
+	defer p.rwMu.Unlock()
 	addr, ok := p.rmtClusters[clusterName]
 	if !ok {
 		return nil, fmt.Errorf("no such cluster %s", clusterName)
 	}
-	p.rwMu.Lock()
-	defer p.rwMu.Unlock()
 	if p.dialers == nil {
 		p.dialers = make(map[string]*netframe.Dialer)
 	}
 	if p.dialers[clusterName] == nil {
-		d, err := netframe.NewDialer(addr, nil)
+		d, err := netframe.NewDialer(addr, func() netframe.Receiver {
+			return &dialReceiver{cluster: clusterName, onClosed: p.onClosed}
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -64,19 +99,114 @@ func (p *ClusterProxy) GetDialer(clusterName string) (*netframe.Dialer, error) {
 	return p.dialers[clusterName], nil
 }
 
+// 远端节点地址及连接状态, 尚未发包的节点为IDLE
+func (p *ClusterProxy) status() []*ClusterStatus {
+	p.rwMu.RLock()
+	clusters := make([]*ClusterStatus, 0, len(p.rmtClusters))
+	for name, addr := range p.rmtClusters {
+		state := netframe.Idle
+		if d := p.dialers[name]; d != nil {
+			state = d.State()
+		}
+		clusters = append(clusters, &ClusterStatus{Name: name, Address: addr, State: state.String()})
+	}
+	p.rwMu.RUnlock()
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Name < clusters[j].Name
+	})
+	return clusters
+}
+
+// 关闭全部Dialer, 等待已发出的包写完
 func (p *ClusterProxy) Exit() {
 	p.rwMu.Lock()
-	defer p.rwMu.Unlock()
-	for _, d := range p.dialers {
-		go d.Shutdown()
-	}
+	dialers := p.dialers
 	p.dialers = nil
+	p.rwMu.Unlock()
+	var wg sync.WaitGroup
+	for _, d := range dialers {
+		wg.Add(1)
+		go func(d *netframe.Dialer) {
+			defer wg.Done()
+			d.Shutdown()
+		}(d)
+	}
+	wg.Wait()
 }
 
 type GateReceiver struct {
 	server        *Server
+	frameBuffer   WireFrame
 	reqHeadBuffer ClusterReqHead
 	rspHeadBuffer ClusterRspHead
+	stmHeadBuffer ClusterStreamHead
+	mu            sync.Mutex
+	peer          string // 经由该连接收到过流帧的对端节点, 断开时中断该节点的流
+}
+
+// 请求无法投递到目标服务时, 由gate直接给发起方回复错误, 避免远端rpc一直等待
+func (r *GateReceiver) replyError(version uint8, head *ClusterReqHead, rpcErr error) error {
+	if head.session == 0 {
+		return nil
+	}
+	source := SVC_HANDLE(head.source)
+	cluster, ok := r.server.sidecar.GetClusterName(source)
+	if !ok {
+		return fmt.Errorf("reply %v to unknown cluster, dst svc %d", rpcErr, source)
+	}
+	buf := getPackBuffer()
+	data, err := NetPackResponse(*buf, r.server.codec, replyWireVersion(version), SVC_HANDLE(head.destination), head.session, source, head.Method(), nil, rpcErr)
+	defer putPackBuffer(buf, data)
+	if err != nil {
+		return err
+	}
+	return r.server.sidecar.Send(cluster, data)
+}
+
+// 流的目标服务不存在时, 由gate直接通知发起方中断
+func (r *GateReceiver) replyStreamError(head *ClusterStreamHead, rpcErr error) error {
+	source := SVC_HANDLE(head.source)
+	cluster, ok := r.server.sidecar.GetClusterName(source)
+	if !ok {
+		return fmt.Errorf("reply %v to unknown cluster, dst svc %d", rpcErr, source)
+	}
+	flags := STREAM_FLAG_FIN
+	if head.flags&STREAM_FLAG_INITIATOR == 0 {
+		flags |= STREAM_FLAG_INITIATOR
+	}
+	e := toError(rpcErr)
+	reply := &ClusterStreamHead{}
+	err := reply.Init(SVC_HANDLE(head.destination), head.session, source, "", flags, e.Code, truncateErrMsg(e.Message))
+	if err != nil {
+		return err
+	}
+	buf := getPackBuffer()
+	data, err := NetPackStream(*buf, MSG_TYPE_STREAM_CLOSE, reply, nil)
+	defer putPackBuffer(buf, data)
+	if err != nil {
+		return err
+	}
+	return r.server.sidecar.Send(cluster, data)
+}
+
+// 按发送方所在节点统计收包, 未知节点记为unknown
+func (r *GateReceiver) addRecvMetrics(source uint64, n int) {
+	cluster, _ := r.server.sidecar.GetClusterName(SVC_HANDLE(source))
+	r.server.metrics.addClusterRecv(cluster, n)
+}
+
+// 同一连接只承载一个对端节点的帧, 只在首次收到流帧时记录
+func (r *GateReceiver) setPeer(source uint64) {
+	if r.peer != "" {
+		return
+	}
+	cluster, ok := r.server.sidecar.GetClusterName(SVC_HANDLE(source))
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	r.peer = cluster
+	r.mu.Unlock()
 }
 
 func (r *GateReceiver) OnConnected(s netframe.Sender) error {
@@ -84,45 +214,95 @@ func (r *GateReceiver) OnConnected(s netframe.Sender) error {
 }
 
 func (r *GateReceiver) OnMessage(s netframe.Sender, b []byte) (int, error) {
-	n, data := NetUnpack(b)
+	n, data, err := NetUnpack(b, r.server.MaxMsgSize())
+	if err != nil { // 包长超限, 返回n == 0由Conn断开连接
+		return 0, err
+	}
 	if n == 0 { // 没解够长度
 		return n, nil
 	}
 	if len(data) == 0 { // 几乎不可能发生
 		return n, fmt.Errorf("data is nil")
 	}
-	msgType := MsgType(data[0])
-	// 剔除msgType
-	data = data[1:]
+	frame := &r.frameBuffer
+	err = frame.Unpack(data)
+	if err != nil {
+		return n, err
+	}
+	msgType := frame.MsgType
 	if msgType == MSG_TYPE_CLUSTER_REQ {
 		head := &r.reqHeadBuffer
-		pos, err := head.Unpack(data)
+		body, err := NetUnpackRequest(frame, head)
 		if err != nil {
 			return n, err
 		}
+		r.addRecvMetrics(head.source, n)
 		dstSvc := r.server.GetService(SVC_HANDLE(head.destination))
-		if dstSvc != nil {
-			dstSvc.pushClusterRequest(context.Background(), head, data[pos:])
+		if r.server.isShuttingDown() {
+			err = NewError(ErrCode_Shutdown, "cluster %s shutting down", r.server.ClusterName())
+		} else if dstSvc != nil {
+			err = dstSvc.pushClusterRequest(context.Background(), head, frame.Version, frame.Metadata, body)
 		} else {
-			return n, fmt.Errorf("%s not find dst svc %d", msgType, head.destination)
+			err = NewError(ErrCode_SvcNotFound, "cluster %s not find dst svc %d", r.server.ClusterName(), head.destination)
+		}
+		// 节点正在停止, 目标服务不存在或邮箱过载
+		if err != nil {
+			if rerr := r.replyError(frame.Version, head, err); rerr != nil {
+				return n, fmt.Errorf("%s %v, reply err:%v", msgType, err, rerr)
+			}
+			return n, fmt.Errorf("%s %v", msgType, err)
 		}
 	} else if msgType == MSG_TYPE_CLUSTER_RSP {
 		head := &r.rspHeadBuffer
-		pos, err := head.Unpack(data)
+		body, err := NetUnpackResponse(frame, head)
 		if err != nil {
 			return n, err
 		}
+		r.addRecvMetrics(head.source, n)
 		dstSvc := r.server.GetService(SVC_HANDLE(head.destination))
 		if dstSvc != nil {
-			dstSvc.pushClusterResponse(context.Background(), head, data[pos:])
+			dstSvc.pushClusterResponse(context.Background(), head, body)
 		} else {
 			return n, fmt.Errorf("%s not find dst svc %d", msgType, head.destination)
 		}
+	} else if msgType.IsStreamMsg() {
+		head := &r.stmHeadBuffer
+		_, err := head.Unpack(frame.Head)
+		if err != nil {
+			return n, err
+		}
+		r.addRecvMetrics(head.source, n)
+		r.setPeer(head.source)
+		dstSvc := r.server.GetService(SVC_HANDLE(head.destination))
+		if msgType == MSG_TYPE_STREAM_OPEN && r.server.isShuttingDown() {
+			// 节点正在停止, 不再接收新的流
+			dstSvc, err = nil, NewError(ErrCode_Shutdown, "cluster %s shutting down", r.server.ClusterName())
+		}
+		if dstSvc != nil {
+			// body引用连接读缓冲区, 需拷贝后交给流
+			dstSvc.onStreamFrame(msgType, head, copyBytes(frame.Body), false)
+		} else {
+			if err == nil {
+				err = NewError(ErrCode_SvcNotFound, "cluster %s not find dst svc %d", r.server.ClusterName(), head.destination)
+			}
+			if msgType != MSG_TYPE_STREAM_CLOSE {
+				if rerr := r.replyStreamError(head, err); rerr != nil {
+					return n, fmt.Errorf("%s %v, reply err:%v", msgType, err, rerr)
+				}
+			}
+			return n, fmt.Errorf("%s %v", msgType, err)
+		}
 	}
 	return n, nil
 }
 
 func (r *GateReceiver) OnClosed(s netframe.Sender) error {
+	r.mu.Lock()
+	cluster := r.peer
+	r.mu.Unlock()
+	if cluster != "" {
+		r.server.onClusterDisconnected(cluster)
+	}
 	return nil
 }
 
@@ -131,13 +311,20 @@ type Sidecar struct {
 	clusterName  string
 	gateListener *netframe.Listener
 	clusterProxy *ClusterProxy
+	discovery    Discovery
+	static       *MemoryDiscovery // 基于配置RemoteAddrs的默认服务发现
+	discoveryMu  sync.Mutex
 }
 
 func (sc *Sidecar) Init() error {
 	sc.clusterName = sc.server.config.ClusterName
-	// 从配置中读取clustername表
-	sc.clusterProxy = &ClusterProxy{}
-	sc.clusterProxy.Reload(sc.server.config.RemoteAddrs)
+	// 默认从配置中读取clustername表
+	sc.clusterProxy = &ClusterProxy{onClosed: sc.server.onClusterDisconnected}
+	sc.static = NewMemoryDiscovery(sc.server.config.RemoteAddrs)
+	err := sc.SetDiscovery(sc.static)
+	if err != nil {
+		return err
+	}
 	// 绑定本地端口
 	l, err := netframe.NewListener(sc.server.config.LocalAddr, func() netframe.Receiver {
 		return &GateReceiver{server: sc.server}
@@ -157,14 +344,39 @@ func (sc *Sidecar) Init() error {
 	return nil
 }
 
-// 更新cluster节点信息
-func (sc *Sidecar) Reload() {
-	sc.clusterProxy.Reload(sc.server.config.RemoteAddrs)
+// 按配置更新cluster节点信息, 已切换为自定义服务发现时忽略配置
+func (sc *Sidecar) Reload(addrs map[string]string) {
+	sc.discoveryMu.Lock()
+	defer sc.discoveryMu.Unlock()
+	if sc.discovery != Discovery(sc.static) {
+		sc.server.log.Warningf("cluster %s remote clusters managed by discovery, ignore config RemoteAddrs", sc.clusterName)
+		return
+	}
+	sc.static.Set(addrs)
+}
+
+// 切换服务发现, 后续远端节点表由discovery推送的变更驱动更新
+func (sc *Sidecar) SetDiscovery(d Discovery) error {
+	sc.discoveryMu.Lock()
+	defer sc.discoveryMu.Unlock()
+	if sc.discovery != nil {
+		sc.discovery.Close()
+	}
+	sc.discovery = d
+	if l, ok := d.(discoveryLogSetter); ok {
+		l.SetLogSystem(sc.server.log)
+	}
+	return d.Watch(sc.onDiscoveryUpdate)
+}
+
+func (sc *Sidecar) onDiscoveryUpdate(clusterAddrs map[string]string) {
+	sc.server.log.Infof("cluster %s reload remote clusters: %v", sc.clusterName, clusterAddrs)
+	sc.clusterProxy.Reload(clusterAddrs)
 }
 
 func (sc *Sidecar) GetClusterName(handle SVC_HANDLE) (string, bool) {
 	hashID := uint32(handle >> 32)
-	cluster, ok := sc.clusterProxy.hashToNames[hashID]
+	cluster, ok := sc.clusterProxy.GetClusterName(hashID)
 	if !ok {
 		return "unknown", false
 	}
@@ -176,10 +388,20 @@ func (sc *Sidecar) Send(clusterName string, data []byte) error {
 	if err != nil {
 		return err
 	}
-	return d.Send(data)
+	err = d.Send(data)
+	if err != nil {
+		return err
+	}
+	sc.server.metrics.addClusterSent(clusterName, len(data))
+	return nil
 }
 
 func (sc *Sidecar) Exit() {
+	sc.discoveryMu.Lock()
+	if sc.discovery != nil {
+		sc.discovery.Close()
+	}
+	sc.discoveryMu.Unlock()
 	sc.clusterProxy.Exit()
 	sc.gateListener.GracefulStop()
 }
@@ -0,0 +1,528 @@
+package saber
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/xingshuo/saber/common/utils"
+)
+
+// 流式传输: 发起方OpenStream, 接收方RegisterStreamHandler
+// 消息按STREAM_CHUNK_SIZE分片发送, 接收方Recv时重新拼装; 每个方向按STREAM_WINDOW_SIZE做流控,
+// 接收方读取超过半个窗口后通告发送方, 发送方窗口耗尽时阻塞(让出服务执行权)
+// 发起方CloseSend结束发送, 接收方handler返回即结束整个流, 返回的error会传递给发起方Recv
+
+const (
+	STREAM_CHUNK_SIZE  = 32 << 10  // 单个数据帧最大负载:字节
+	STREAM_WINDOW_SIZE = 256 << 10 // 单方向流控窗口:字节
+)
+
+const (
+	STREAM_FLAG_INITIATOR uint8 = 1 << 0 // 由发起方发出
+	STREAM_FLAG_LAST      uint8 = 1 << 1 // DATA: 消息最后一个分片
+	STREAM_FLAG_FIN       uint8 = 1 << 2 // CLOSE: 发送方已结束整个流, 不再读取
+)
+
+var (
+	STREAM_CLOSED_ERR      = fmt.Errorf("stream closed")
+	STREAM_SEND_CLOSED_ERR = fmt.Errorf("stream send closed")
+	STREAM_REPEAT_ERR      = fmt.Errorf("stream repeat")
+	STREAM_COMPAT_ERR      = fmt.Errorf("stream unsupported in wire compat mode")
+)
+
+type StreamHandlerFunc func(ctx context.Context, st *Stream) error
+
+type streamKey struct {
+	peer      SVC_HANDLE
+	id        uint32
+	initiator bool // 本端是否为发起方
+}
+
+type streamChunk struct {
+	data []byte
+	last bool
+}
+
+// 同一Stream只能由一个goroutine使用(流handler, OpenStream所在的handler或其他单个goroutine), handler中Send/Recv阻塞时让出服务执行权.
+// 与对端节点的连接断开时流以ErrCode_ConnClosed中断
+type Stream struct {
+	svc     *Service
+	ctx     context.Context
+	cancel  context.CancelFunc
+	key     streamKey
+	cluster string // 对端所在节点
+	method  string
+	local   bool // 对端与本端在同一节点, 帧直接投递不经过网络
+
+	mu         sync.Mutex
+	recvQueue  []streamChunk
+	recvClosed bool  // 对端已结束发送
+	recvErr    error // 对端异常中断
+	peerDone   bool  // 对端已结束整个流
+	sendClosed bool
+	done       bool // 本端已结束整个流
+	sendWindow int
+	consumed   int    // 已读取未通告的字节数
+	recvWait   uint32 // 阻塞在Recv的session
+	sendWait   uint32 // 阻塞在Send的session
+}
+
+func newStream(ctx context.Context, svc *Service, key streamKey, cluster, method string, local bool) *Stream {
+	st := &Stream{
+		svc:        svc,
+		key:        key,
+		cluster:    cluster,
+		method:     method,
+		local:      local,
+		sendWindow: STREAM_WINDOW_SIZE,
+	}
+	st.ctx, st.cancel = context.WithCancel(ctx)
+	return st
+}
+
+func (st *Stream) Method() string {
+	return st.method
+}
+
+func (st *Stream) Context() context.Context {
+	return st.ctx
+}
+
+func (st *Stream) sendFrame(msgType MsgType, flags uint8, arg uint32, errMsg string, body []byte) error {
+	if st.key.initiator {
+		flags |= STREAM_FLAG_INITIATOR
+	}
+	method := ""
+	if msgType == MSG_TYPE_STREAM_OPEN {
+		method = st.method
+	}
+	head := &ClusterStreamHead{}
+	err := head.Init(st.svc.handle, st.key.id, st.key.peer, method, flags, arg, errMsg)
+	if err != nil {
+		return err
+	}
+	if st.local {
+		dst := st.svc.server.GetService(st.key.peer)
+		if dst == nil {
+			return fmt.Errorf("%w: %d", RPC_SVC_NOT_FOUND_ERR, st.key.peer)
+		}
+		dst.onStreamFrame(msgType, head, copyBytes(body), true)
+		return nil
+	}
+	buf := getPackBuffer()
+	data, err := NetPackStream(*buf, msgType, head, body)
+	defer putPackBuffer(buf, data)
+	if err != nil {
+		return err
+	}
+	return st.svc.server.sidecar.Send(st.cluster, data)
+}
+
+// 唤醒阻塞中的Send/Recv, 经由服务消息队列交还执行权
+func (st *Stream) notifyLocked(waitSession *uint32) {
+	session := *waitSession
+	if session == 0 {
+		return
+	}
+	*waitSession = 0
+	st.svc.pushMsg(context.Background(), st.svc.handle, MSG_TYPE_SVC_RSP, session, &SvcResponse{})
+}
+
+// 阻塞直到ready返回true(调用时持有st.mu), 期间让出服务执行权
+func (st *Stream) wait(waitSession *uint32, ready func() bool) error {
+	session := st.svc.sessionStore.NewSessionID()
+	onWait := func() error {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		*waitSession = session
+		if ready() {
+			st.notifyLocked(waitSession)
+		}
+		return nil
+	}
+	_, err := st.svc.sessionStore.Wait(st.ctx, session, st.svc, 0, onWait)
+	st.mu.Lock()
+	if *waitSession == session {
+		*waitSession = 0
+	}
+	st.mu.Unlock()
+	return err
+}
+
+func (st *Stream) sendErrLocked() error {
+	if st.recvErr != nil {
+		return st.recvErr
+	}
+	if st.done || st.peerDone {
+		return STREAM_CLOSED_ERR
+	}
+	if st.sendClosed {
+		return STREAM_SEND_CLOSED_ERR
+	}
+	return nil
+}
+
+// 发送一条消息, 超过STREAM_CHUNK_SIZE时自动分片, 窗口不足时阻塞
+func (st *Stream) Send(msg []byte) error {
+	for {
+		st.mu.Lock()
+		if err := st.sendErrLocked(); err != nil {
+			st.mu.Unlock()
+			return err
+		}
+		if len(msg) > 0 && st.sendWindow <= 0 {
+			st.mu.Unlock()
+			err := st.wait(&st.sendWait, func() bool {
+				return st.sendWindow > 0 || st.sendErrLocked() != nil
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		n := len(msg)
+		if n > STREAM_CHUNK_SIZE {
+			n = STREAM_CHUNK_SIZE
+		}
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		st.sendWindow -= n
+		st.mu.Unlock()
+		var flags uint8
+		last := n == len(msg)
+		if last {
+			flags |= STREAM_FLAG_LAST
+		}
+		err := st.sendFrame(MSG_TYPE_STREAM_DATA, flags, 0, "", msg[:n])
+		if err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		msg = msg[n:]
+	}
+}
+
+// 接收一条完整消息, 对端正常结束发送后返回io.EOF, 异常中断时返回对端错误
+func (st *Stream) Recv() ([]byte, error) {
+	var msg []byte
+	for {
+		st.mu.Lock()
+		if len(st.recvQueue) > 0 {
+			c := st.recvQueue[0]
+			st.recvQueue[0] = streamChunk{}
+			st.recvQueue = st.recvQueue[1:]
+			st.consumed += len(c.data)
+			var inc int
+			if st.consumed >= STREAM_WINDOW_SIZE/2 && !st.peerDone {
+				inc = st.consumed
+				st.consumed = 0
+			}
+			st.mu.Unlock()
+			if inc > 0 {
+				err := st.sendFrame(MSG_TYPE_STREAM_WINDOW, 0, uint32(inc), "", nil)
+				if err != nil {
+					st.svc.log.Errorf("%s stream %d send window err:%v", st.svc, st.key.id, err)
+				}
+			}
+			if msg == nil {
+				msg = c.data
+			} else {
+				msg = append(msg, c.data...)
+			}
+			if c.last {
+				if msg == nil {
+					msg = []byte{}
+				}
+				return msg, nil
+			}
+			continue
+		}
+		if st.recvErr != nil {
+			st.mu.Unlock()
+			return nil, st.recvErr
+		}
+		if st.recvClosed {
+			st.mu.Unlock()
+			if msg != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, io.EOF
+		}
+		if st.done {
+			st.mu.Unlock()
+			return nil, STREAM_CLOSED_ERR
+		}
+		st.mu.Unlock()
+		err := st.wait(&st.recvWait, func() bool {
+			return len(st.recvQueue) > 0 || st.recvClosed || st.recvErr != nil || st.done
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// 结束本端发送, 对端Recv读完已发送数据后返回io.EOF
+func (st *Stream) CloseSend() error {
+	st.mu.Lock()
+	if err := st.sendErrLocked(); err != nil {
+		st.mu.Unlock()
+		return err
+	}
+	st.sendClosed = true
+	st.notifyLocked(&st.sendWait)
+	st.mu.Unlock()
+	return st.sendFrame(MSG_TYPE_STREAM_CLOSE, 0, ErrCode_OK, "", nil)
+}
+
+// 中断整个流, 对端收到ErrCode_Canceled错误
+func (st *Stream) Close() error {
+	return st.finish(NewError(ErrCode_Canceled, "stream %s canceled", st.method))
+}
+
+// 结束本端流, err非nil时通知对端异常中断
+func (st *Stream) finish(err error) error {
+	st.mu.Lock()
+	if st.done {
+		st.mu.Unlock()
+		return nil
+	}
+	st.done = true
+	peerDone := st.peerDone
+	st.notifyLocked(&st.recvWait)
+	st.notifyLocked(&st.sendWait)
+	st.mu.Unlock()
+	st.svc.removeStream(st.key)
+	defer st.cancel()
+	if peerDone {
+		return nil
+	}
+	code := ErrCode_OK
+	errMsg := ""
+	var details []byte
+	if err != nil {
+		e := toError(err)
+		code = e.Code
+		errMsg = truncateErrMsg(e.Message)
+		details = e.Details
+	}
+	return st.sendFrame(MSG_TYPE_STREAM_CLOSE, STREAM_FLAG_FIN, code, errMsg, details)
+}
+
+func (st *Stream) onData(data []byte, last bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.done || st.recvClosed || st.recvErr != nil {
+		return
+	}
+	st.recvQueue = append(st.recvQueue, streamChunk{data: data, last: last})
+	st.notifyLocked(&st.recvWait)
+}
+
+func (st *Stream) onWindow(inc uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sendWindow += int(inc)
+	st.notifyLocked(&st.sendWait)
+}
+
+func (st *Stream) onClose(flags uint8, code uint32, errMsg string, details []byte) {
+	st.mu.Lock()
+	st.recvClosed = true
+	if code != ErrCode_OK {
+		st.recvErr = &Error{Code: code, Message: errMsg, Details: details}
+	}
+	if flags&STREAM_FLAG_FIN != 0 || code != ErrCode_OK {
+		st.peerDone = true
+	}
+	peerDone := st.peerDone
+	st.notifyLocked(&st.recvWait)
+	st.notifyLocked(&st.sendWait)
+	st.mu.Unlock()
+	if peerDone {
+		st.svc.removeStream(st.key)
+		if !st.key.initiator {
+			// 发起方已中断, 通知handler
+			st.cancel()
+		}
+	}
+}
+
+// 与对端节点的连接断开后在途帧可能已丢失, 以连接错误中断该节点上的所有流, 不再向对端发送CLOSE
+func (s *Service) failClusterStreams(cluster string) {
+	var sts []*Stream
+	s.streamMu.Lock()
+	for _, st := range s.streams {
+		if !st.local && st.cluster == cluster {
+			sts = append(sts, st)
+		}
+	}
+	s.streamMu.Unlock()
+	for _, st := range sts {
+		st.onClose(STREAM_FLAG_FIN, ErrCode_ConnClosed, fmt.Sprintf("stream %s connection to cluster %s closed", st.method, cluster), nil)
+	}
+}
+
+// 与远端节点的连接(收或发)断开
+func (s *Server) onClusterDisconnected(cluster string) {
+	s.rwMu.RLock()
+	svcs := make([]*Service, 0, len(s.services))
+	for _, svc := range s.services {
+		svcs = append(svcs, svc)
+	}
+	s.rwMu.RUnlock()
+	for _, svc := range svcs {
+		svc.failClusterStreams(cluster)
+	}
+}
+
+// 服务启动时注册
+func (s *Service) RegisterStreamHandler(method string, handler StreamHandlerFunc) {
+	s.rwMu.Lock()
+	defer s.rwMu.Unlock()
+	s.streamHandlers[method] = handler
+}
+
+func (s *Service) getStreamHandler(method string) StreamHandlerFunc {
+	s.rwMu.RLock()
+	defer s.rwMu.RUnlock()
+	return s.streamHandlers[method]
+}
+
+func (s *Service) addStream(st *Stream) error {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	if _, ok := s.streams[st.key]; ok {
+		return STREAM_REPEAT_ERR
+	}
+	s.streams[st.key] = st
+	return nil
+}
+
+func (s *Service) getStream(key streamKey) *Stream {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	return s.streams[key]
+}
+
+func (s *Service) removeStream(key streamKey) {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	delete(s.streams, key)
+}
+
+// 向目标服务发起流, clusterName为本节点时直接投递.
+// WireCompat下对端可能是不支持流的旧版本节点, 跨节点流直接返回STREAM_COMPAT_ERR
+func (s *Service) OpenStream(ctx context.Context, clusterName, svcName string, svcID uint32, method string) (*Stream, error) {
+	local := clusterName == s.server.ClusterName()
+	if !local && s.server.WireVersion() == WIRE_VERSION_LEGACY {
+		return nil, STREAM_COMPAT_ERR
+	}
+	dh := SVC_HANDLE(utils.MakeServiceHandle(clusterName, svcName, svcID))
+	key := streamKey{peer: dh, id: s.sessionStore.NewSessionID(), initiator: true}
+	st := newStream(ctx, s, key, clusterName, method, local)
+	err := s.addStream(st)
+	if err != nil {
+		return nil, err
+	}
+	err = st.sendFrame(MSG_TYPE_STREAM_OPEN, 0, 0, "", nil)
+	if err != nil {
+		s.removeStream(key)
+		st.cancel()
+		return nil, err
+	}
+	return st, nil
+}
+
+// 流帧处理: OPEN经由消息队列启动handler, 其余帧直接更新流状态(由gate或同节点发送方goroutine调用)
+func (s *Service) onStreamFrame(msgType MsgType, head *ClusterStreamHead, body []byte, local bool) {
+	peer := SVC_HANDLE(head.source)
+	key := streamKey{peer: peer, id: head.session, initiator: head.flags&STREAM_FLAG_INITIATOR == 0}
+	if msgType == MSG_TYPE_STREAM_OPEN {
+		cluster := s.server.ClusterName()
+		if !local {
+			var ok bool
+			cluster, ok = s.server.sidecar.GetClusterName(peer)
+			if !ok {
+				s.log.Errorf("%s open stream %s from unknown cluster, src svc %d", s, head.Method(), peer)
+				return
+			}
+		}
+		ctx := context.WithValue(context.Background(), CtxKeyService, s)
+		st := newStream(ctx, s, key, cluster, head.Method(), local)
+		err := s.addStream(st)
+		if err != nil {
+			s.log.Errorf("%s open stream %s from %d err:%v", s, head.Method(), peer, err)
+			return
+		}
+		if s.isStopped() {
+			// 服务正在停止或已退出, 不再经由消息队列启动handler
+			err = RPC_SHUTDOWN_ERR
+		} else {
+			err = s.pushMsg(context.Background(), peer, MSG_TYPE_STREAM_OPEN, head.session, st)
+		}
+		if err != nil {
+			// 结束流会注销并通知发起方, 避免发起方一直等到ctx结束
+			s.log.Errorf("%s open stream %s from %d err:%v", s, head.Method(), peer, err)
+			if ferr := st.finish(err); ferr != nil {
+				s.log.Errorf("%s finish stream %s err:%v", s, st.method, ferr)
+			}
+		}
+		return
+	}
+	st := s.getStream(key)
+	if st == nil {
+		s.log.Debugf("%s recv %s for unknown stream %d from %d", s, msgType, head.session, peer)
+		return
+	}
+	switch msgType {
+	case MSG_TYPE_STREAM_DATA:
+		st.onData(body, head.flags&STREAM_FLAG_LAST != 0)
+	case MSG_TYPE_STREAM_WINDOW:
+		st.onWindow(head.arg)
+	case MSG_TYPE_STREAM_CLOSE:
+		st.onClose(head.flags, head.arg, head.ErrMsg(), body)
+	}
+}
+
+func (s *Service) callStreamHandler(handler StreamHandlerFunc, st *Stream) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			s.log.Errorf("%s panic occurred on handle stream %s: %v\n%s", s, st.method, e, debug.Stack())
+			err = NewError(ErrCode_HandlerPanic, "stream handler %s panic: %v", st.method, e)
+		}
+	}()
+	return handler(st.ctx, st)
+}
+
+func (s *Service) onRecvStreamOpen(ctx context.Context, source SVC_HANDLE, session uint32, msg interface{}) {
+	st := msg.(*Stream)
+	handler := s.getStreamHandler(st.method)
+	label := st.method
+	if handler == nil {
+		label = METRIC_UNKNOWN_METHOD
+	}
+	defer s.server.metrics.observeDispatch(s.metricLabel, MSG_TYPE_STREAM_OPEN, label, time.Now())
+	var err error
+	if s.isStopped() {
+		err = RPC_SHUTDOWN_ERR
+	} else if handler == nil {
+		err = NewError(ErrCode_UnknownMethod, "open unknown stream %s", st.method)
+	} else {
+		// Send/Recv经由st.ctx识别handler的执行权
+		if e, ok := ctx.Value(execCtxKey{}).(*svcExec); ok {
+			st.ctx = withExec(st.ctx, e)
+		}
+		err = s.callStreamHandler(handler, st)
+	}
+	if ferr := st.finish(err); ferr != nil {
+		s.log.Errorf("%s finish stream %s err:%v", s, st.method, ferr)
+	}
+}
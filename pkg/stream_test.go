@@ -0,0 +1,215 @@
+package saber
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPayload(size int, seed byte) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = seed + byte(i%251)
+	}
+	return b
+}
+
+func registerStreamHandlers(svc *Service, aborted chan error, sent *int64) {
+	// 累计收到的字节数, 对端结束发送后回复
+	svc.RegisterStreamHandler("Upload", func(ctx context.Context, st *Stream) error {
+		var total uint64
+		for {
+			msg, err := st.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			total += uint64(len(msg))
+		}
+		var rsp [8]byte
+		binary.BigEndian.PutUint64(rsp[:], total)
+		return st.Send(rsp[:])
+	})
+	svc.RegisterStreamHandler("Download", func(ctx context.Context, st *Stream) error {
+		for i := 0; i < 4; i++ {
+			err := st.Send(testPayload(1<<20, byte(i)))
+			if err != nil {
+				return err
+			}
+			atomic.AddInt64(sent, 1<<20)
+		}
+		return nil
+	})
+	svc.RegisterStreamHandler("Fail", func(ctx context.Context, st *Stream) error {
+		return NewError(ErrCode_Usr+1, "replay not found")
+	})
+	svc.RegisterStreamHandler("Hold", func(ctx context.Context, st *Stream) error {
+		_, err := st.Recv()
+		aborted <- err
+		return err
+	})
+}
+
+func testStream(t *testing.T, client *Service, cluster string, aborted chan error, sent *int64) {
+	ctx := context.Background()
+	// 单条消息超过分片大小和流控窗口
+	st, err := client.OpenStream(ctx, cluster, "replay", 1, "Upload")
+	assert.Nil(t, err)
+	err = st.Send(testPayload(4<<20, 1))
+	assert.Nil(t, err)
+	err = st.Send(nil)
+	assert.Nil(t, err)
+	err = st.Send([]byte("tail"))
+	assert.Nil(t, err)
+	err = st.CloseSend()
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(st.Send([]byte("more")), STREAM_SEND_CLOSED_ERR))
+	rsp, err := st.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4<<20+4), binary.BigEndian.Uint64(rsp))
+	_, err = st.Recv()
+	assert.Equal(t, io.EOF, err)
+
+	// 接收方未读取时发送方受窗口限制
+	atomic.StoreInt64(sent, 0)
+	st, err = client.OpenStream(ctx, cluster, "replay", 1, "Download")
+	assert.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, atomic.LoadInt64(sent) < 2<<20)
+	for i := 0; i < 4; i++ {
+		msg, err := st.Recv()
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(testPayload(1<<20, byte(i)), msg))
+	}
+	_, err = st.Recv()
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, errors.Is(st.Send([]byte("late")), STREAM_CLOSED_ERR))
+
+	// handler返回错误
+	st, err = client.OpenStream(ctx, cluster, "replay", 1, "Fail")
+	assert.Nil(t, err)
+	_, err = st.Recv()
+	assert.True(t, errors.Is(err, NewError(ErrCode_Usr+1, "")))
+	assert.Equal(t, "replay not found", err.(*Error).Message)
+
+	st, err = client.OpenStream(ctx, cluster, "replay", 1, "Unknown")
+	assert.Nil(t, err)
+	_, err = st.Recv()
+	assert.True(t, errors.Is(err, RPC_UNKNOWN_METHOD_ERR))
+
+	// 发起方中断
+	st, err = client.OpenStream(ctx, cluster, "replay", 1, "Hold")
+	assert.Nil(t, err)
+	err = st.Close()
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(<-aborted, RPC_CANCELED_ERR))
+	_, err = st.Recv()
+	assert.True(t, errors.Is(err, STREAM_CLOSED_ERR))
+
+	// Recv遵循ctx超时
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	st, err = client.OpenStream(tctx, cluster, "replay", 1, "Hold")
+	assert.Nil(t, err)
+	_, err = st.Recv()
+	assert.True(t, errors.Is(err, RPC_TIMEOUT_ERR))
+	st.Close()
+	<-aborted
+
+	assert.Equal(t, 0, len(client.streams))
+}
+
+func TestStream(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_stream",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	aborted := make(chan error, 1)
+	var sent int64
+	replay, err := s.NewService("replay", 1)
+	assert.Nil(t, err)
+	registerStreamHandlers(replay, aborted, &sent)
+	client, err := s.NewService("client", 1)
+	assert.Nil(t, err)
+	testStream(t, client, "test_stream", aborted, &sent)
+
+	_, err = client.OpenStream(context.Background(), "test_stream", "nobody", 1, "Upload")
+	assert.True(t, errors.Is(err, RPC_SVC_NOT_FOUND_ERR))
+}
+
+func TestClusterStream(t *testing.T) {
+	sa, sb := newTestClusterPair(t, "test_stream_a", "test_stream_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	aborted := make(chan error, 1)
+	var sent int64
+	replay, err := sb.NewServiceWithOptions("replay", 1, WithParallel(4))
+	assert.Nil(t, err)
+	registerStreamHandlers(replay, aborted, &sent)
+	client, err := sa.NewService("client", 1)
+	assert.Nil(t, err)
+	testStream(t, client, "test_stream_b", aborted, &sent)
+
+	st, err := client.OpenStream(context.Background(), "test_stream_b", "nobody", 1, "Upload")
+	assert.Nil(t, err)
+	_, err = st.Recv()
+	assert.True(t, errors.Is(err, RPC_SVC_NOT_FOUND_ERR))
+
+	// 旧版本协议无法传输流, 直接失败而不是等待永远不会到达的回复
+	sa.setWireCompat(true)
+	_, err = client.OpenStream(context.Background(), "test_stream_b", "replay", 1, "Upload")
+	assert.Equal(t, STREAM_COMPAT_ERR, err)
+	sa.setWireCompat(false)
+}
+
+func TestClusterStreamConnClosed(t *testing.T) {
+	sa, sb := newTestClusterPair(t, "test_stream_conn_a", "test_stream_conn_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	aborted := make(chan error, 1)
+	var sent int64
+	replay, err := sb.NewService("replay", 1)
+	assert.Nil(t, err)
+	registerStreamHandlers(replay, aborted, &sent)
+	client, err := sa.NewService("client", 1)
+	assert.Nil(t, err)
+	st, err := client.OpenStream(context.Background(), "test_stream_conn_b", "replay", 1, "Hold")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		replay.streamMu.Lock()
+		defer replay.streamMu.Unlock()
+		return len(replay.streams) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// 对端不再发送CLOSE, 两端阻塞中的Recv由连接断开中断
+	sb.sidecar.gateListener.GracefulStop()
+	recvErr := make(chan error, 1)
+	go func() {
+		_, err := st.Recv()
+		recvErr <- err
+	}()
+	select {
+	case err = <-recvErr:
+		assert.Equal(t, ErrCode_ConnClosed, toError(err).Code)
+	case <-time.After(3 * time.Second):
+		t.Fatal("client Recv not failed on conn closed")
+	}
+	select {
+	case err = <-aborted:
+		assert.Equal(t, ErrCode_ConnClosed, toError(err).Code)
+	case <-time.After(3 * time.Second):
+		t.Fatal("stream handler Recv not failed on conn closed")
+	}
+	assert.Nil(t, client.getStream(st.key))
+}
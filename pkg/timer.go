@@ -140,6 +140,9 @@ type TimeStore struct {
 	rwMu   sync.RWMutex
 	queue  *Heapq
 	timers map[TimerSeq]*Ticker
+	// 检测间隔:毫秒, 由Start所在goroutine维护
+	interval int64
+	reset    chan int64
 }
 
 func (ts *TimeStore) Init() {
@@ -149,21 +152,37 @@ func (ts *TimeStore) Init() {
 		data: make([]*Ticker, DEFAULT_TIMER_CAP+1),
 	}
 	ts.timers = make(map[TimerSeq]*Ticker)
+	ts.interval = ts.server.config.TickIntervalMs
+	ts.reset = make(chan int64, 1)
 	go ts.Start()
 }
 
-// 阻塞的,需要单独启动一个goroutine调用
-func (ts *TimeStore) Start() {
-	interval := ts.server.config.TickIntervalMs
+func newTickTicker(interval int64) *time.Ticker {
 	if interval < MIN_TICK_INTERVAL_MS {
 		interval = MIN_TICK_INTERVAL_MS
 	}
-	ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
-	for range ticker.C {
-		ts.OnTick(time.Now())
+	return time.NewTicker(time.Duration(interval) * time.Millisecond)
+}
+
+// 阻塞的,需要单独启动一个goroutine调用
+func (ts *TimeStore) Start() {
+	ticker := newTickTicker(ts.interval)
+	for {
+		select {
+		case <-ticker.C:
+			ts.OnTick(time.Now())
+		case ts.interval = <-ts.reset:
+			ticker.Stop()
+			ticker = newTickTicker(ts.interval)
+		}
 	}
 }
 
+// 修改检测间隔(毫秒), 重建Start中的ticker
+func (ts *TimeStore) SetTickInterval(interval int64) {
+	ts.reset <- interval
+}
+
 func (ts *TimeStore) OnTick(now time.Time) {
 	ts.rwMu.Lock()
 	tickSeqs := ts.queue.PopUntil(now)
@@ -0,0 +1,341 @@
+package saber
+
+import (
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 与OpenTelemetry SpanKind取值一致
+type SpanKind int
+
+const (
+	SPAN_KIND_UNSPECIFIED SpanKind = iota
+	SPAN_KIND_INTERNAL
+	SPAN_KIND_SERVER   // 处理rpc请求
+	SPAN_KIND_CLIENT   // 发起rpc
+	SPAN_KIND_PRODUCER // 发起notify
+	SPAN_KIND_CONSUMER // 处理notify
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SPAN_KIND_INTERNAL:
+		return "internal"
+	case SPAN_KIND_SERVER:
+		return "server"
+	case SPAN_KIND_CLIENT:
+		return "client"
+	case SPAN_KIND_PRODUCER:
+		return "producer"
+	case SPAN_KIND_CONSUMER:
+		return "consumer"
+	}
+	return "unspecified"
+}
+
+const (
+	TRACE_FLAG_SAMPLED = 0x01
+	// W3C Trace Context, OpenTelemetry默认的传播格式
+	TRACEPARENT_KEY     = "traceparent"
+	TRACEPARENT_VERSION = "00"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// 跨服务传递的span标识
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+	Remote  bool // 从调用方metadata中解析得到
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&TRACE_FLAG_SAMPLED != 0
+}
+
+type Span interface {
+	SpanContext() SpanContext
+	SetAttribute(key string, value interface{})
+	// 记录错误并将span状态置为失败, err为nil时忽略
+	SetError(err error)
+	End()
+}
+
+// 链路追踪接口, 通过Server.SetTracer接入, 默认不追踪
+type Tracer interface {
+	// 以ctx中的span为父节点创建span, 返回携带新span的ctx
+	StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, Span)
+	// 将ctx中的span写入发出的metadata, 不修改md, 需要写入时返回拷贝
+	Inject(ctx context.Context, md Metadata) Metadata
+	// 从收到的metadata中恢复调用方span
+	Extract(ctx context.Context, md Metadata) context.Context
+}
+
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, CtxKeySpan, span)
+}
+
+// handler中获取当前span, 可追加属性. 未开启追踪时返回空实现
+func SpanFromCtx(ctx context.Context) Span {
+	if span, ok := ctx.Value(CtxKeySpan).(Span); ok {
+		return span
+	}
+	return emptySpan
+}
+
+type noopSpan struct {
+	sc SpanContext
+}
+
+// 预先装箱, 未开启追踪时不产生额外分配
+var emptySpan Span = noopSpan{}
+
+func (s noopSpan) SpanContext() SpanContext                   { return s.sc }
+func (s noopSpan) SetAttribute(key string, value interface{}) {}
+func (s noopSpan) SetError(err error)                         {}
+func (s noopSpan) End()                                       {}
+
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, Span) {
+	return ctx, emptySpan
+}
+
+func (noopTracer) Inject(ctx context.Context, md Metadata) Metadata {
+	return md
+}
+
+func (noopTracer) Extract(ctx context.Context, md Metadata) context.Context {
+	return ctx
+}
+
+func NewNoopTracer() Tracer {
+	return noopTracer{}
+}
+
+// 已结束span的数据, 字段与OpenTelemetry span模型对应
+type SpanData struct {
+	Name          string
+	SpanContext   SpanContext
+	Parent        SpanContext
+	Kind          SpanKind
+	StartTime     time.Time
+	EndTime       time.Time
+	Attributes    map[string]interface{}
+	Failed        bool // 对应OpenTelemetry Status Error
+	StatusMessage string
+}
+
+// W3CTracer采样span的导出接口. 已接入OpenTelemetry SDK时应改用contrib/saberotel, 由TracerProvider导出
+type SpanExporter interface {
+	ExportSpan(span *SpanData)
+}
+
+// 内置的轻量Tracer, 不依赖OpenTelemetry: 使用W3C traceparent跨节点传播,
+// 可与其他支持W3C Trace Context的服务串联为同一条trace
+type W3CTracer struct {
+	exporter SpanExporter
+	mu       sync.Mutex
+	rand     *rand.Rand
+}
+
+func NewW3CTracer(exporter SpanExporter) *W3CTracer {
+	return &W3CTracer{
+		exporter: exporter,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (t *W3CTracer) newIDs(traceID *TraceID, spanID *SpanID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if traceID != nil {
+		for *traceID == (TraceID{}) {
+			t.rand.Read(traceID[:])
+		}
+	}
+	for *spanID == (SpanID{}) {
+		t.rand.Read(spanID[:])
+	}
+}
+
+func (t *W3CTracer) StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, Span) {
+	parent := SpanFromCtx(ctx).SpanContext()
+	span := &w3cSpan{
+		tracer: t,
+		data: SpanData{
+			Name:      name,
+			Parent:    parent,
+			Kind:      kind,
+			StartTime: time.Now(),
+		},
+	}
+	sc := &span.data.SpanContext
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Flags = parent.Flags
+		t.newIDs(nil, &sc.SpanID)
+	} else {
+		sc.Flags = TRACE_FLAG_SAMPLED
+		t.newIDs(&sc.TraceID, &sc.SpanID)
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *W3CTracer) Inject(ctx context.Context, md Metadata) Metadata {
+	sc := SpanFromCtx(ctx).SpanContext()
+	if !sc.IsValid() {
+		return md
+	}
+	c := md.Copy()
+	c[TRACEPARENT_KEY] = FormatTraceparent(sc)
+	return c
+}
+
+func (t *W3CTracer) Extract(ctx context.Context, md Metadata) context.Context {
+	sc, ok := ParseTraceparent(md[TRACEPARENT_KEY])
+	if !ok {
+		return ctx
+	}
+	return ContextWithSpan(ctx, noopSpan{sc: sc})
+}
+
+type w3cSpan struct {
+	tracer *W3CTracer
+	mu     sync.Mutex
+	ended  bool
+	data   SpanData
+}
+
+func (s *w3cSpan) SpanContext() SpanContext {
+	return s.data.SpanContext
+}
+
+func (s *w3cSpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{})
+	}
+	s.data.Attributes[key] = value
+}
+
+func (s *w3cSpan) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Failed = true
+	s.data.StatusMessage = err.Error()
+}
+
+// 重复调用只导出一次
+func (s *w3cSpan) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.EndTime = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	if data.SpanContext.IsSampled() && s.tracer.exporter != nil {
+		s.tracer.exporter.ExportSpan(&data)
+	}
+}
+
+// 格式: version-traceid-spanid-flags, 如: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func FormatTraceparent(sc SpanContext) string {
+	b := make([]byte, 0, 55)
+	b = append(b, TRACEPARENT_VERSION...)
+	b = append(b, '-')
+	b = append(b, sc.TraceID.String()...)
+	b = append(b, '-')
+	b = append(b, sc.SpanID.String()...)
+	b = append(b, '-')
+	b = append(b, hex.EncodeToString([]byte{sc.Flags})...)
+	return string(b)
+}
+
+// 兼容更高版本: 只解析前55个字符
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return sc, false
+	}
+	if s[:2] == "ff" || (s[:2] == TRACEPARENT_VERSION && len(s) != 55) || (len(s) > 55 && s[55] != '-') {
+		return sc, false
+	}
+	var version, flags [1]byte
+	if _, err := hex.Decode(version[:], []byte(s[:2])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(s[3:35])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(s[36:52])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(s[53:55])); err != nil {
+		return sc, false
+	}
+	sc.Flags = flags[0]
+	sc.Remote = true
+	return sc, sc.IsValid()
+}
+
+func (s *Service) outgoingMetadata(ctx context.Context) Metadata {
+	return s.server.Tracer().Inject(ctx, OutgoingMetadataFromCtx(ctx))
+}
+
+// 发起调用的span, 父节点为ctx中的span
+func (s *Service) startClientSpan(ctx context.Context, info *RpcInfo) (context.Context, Span) {
+	kind := SPAN_KIND_CLIENT
+	if info.Notify {
+		kind = SPAN_KIND_PRODUCER
+	}
+	ctx, span := s.server.Tracer().StartSpan(ctx, info.Method, kind)
+	s.setSpanAttributes(span, info)
+	return ctx, span
+}
+
+// 处理请求的span, 父节点为调用方通过metadata传递的span
+func (s *Service) startServerSpan(ctx context.Context, info *RpcInfo, md Metadata) (context.Context, Span) {
+	tracer := s.server.Tracer()
+	kind := SPAN_KIND_SERVER
+	if info.Notify {
+		kind = SPAN_KIND_CONSUMER
+	}
+	ctx, span := tracer.StartSpan(tracer.Extract(ctx, md), info.Method, kind)
+	s.setSpanAttributes(span, info)
+	return ctx, span
+}
+
+func (s *Service) setSpanAttributes(span Span, info *RpcInfo) {
+	if _, ok := span.(noopSpan); ok {
+		return
+	}
+	span.SetAttribute("rpc.system", "saber")
+	span.SetAttribute("rpc.method", info.Method)
+	span.SetAttribute("saber.service", s.metricLabel)
+	span.SetAttribute("saber.peer.cluster", info.Cluster)
+}
@@ -0,0 +1,142 @@
+package saber
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSpanExporter struct {
+	mu    sync.Mutex
+	spans []*SpanData
+}
+
+func (e *testSpanExporter) ExportSpan(span *SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func (e *testSpanExporter) find(name string, kind SpanKind) *SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, span := range e.spans {
+		if span.Name == name && span.Kind == kind {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestTraceparent(t *testing.T) {
+	s := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(s)
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.IsSampled())
+	assert.True(t, sc.Remote)
+	assert.Equal(t, s, FormatTraceparent(sc))
+	// 更高版本可追加字段
+	_, ok = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-ext")
+	assert.True(t, ok)
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-ext",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		_, ok = ParseTraceparent(bad)
+		assert.False(t, ok, bad)
+	}
+}
+
+// lobby -> (跨节点) chat -> (节点内) gate, 整条链路属于同一trace
+func TestClusterTrace(t *testing.T) {
+	sa, sb := newTestClusterPair(t, "test_trace_a", "test_trace_b")
+	defer sa.Exit()
+	defer sb.Exit()
+	exporter := &testSpanExporter{}
+	sa.SetTracer(NewW3CTracer(exporter))
+	sb.SetTracer(NewW3CTracer(exporter))
+
+	notified := make(chan struct{}, 1)
+	gate, err := sb.NewService("gate", 1)
+	assert.Nil(t, err)
+	gate.RegisterSvcHandler("Push", func(ctx context.Context, req interface{}) (interface{}, error) {
+		SpanFromCtx(ctx).SetAttribute("player", req)
+		return "pushed", nil
+	})
+	gate.RegisterSvcHandler("Kick", func(ctx context.Context, req interface{}) (interface{}, error) {
+		notified <- struct{}{}
+		return nil, nil
+	})
+	chat, err := sb.NewService("chat", 1)
+	assert.Nil(t, err)
+	chat.RegisterSvcHandler("Say", func(ctx context.Context, req interface{}) (interface{}, error) {
+		err := chat.Send(ctx, "gate", 1, "Kick", req)
+		if err != nil {
+			return nil, err
+		}
+		return chat.Call(ctx, "gate", 1, "Push", req)
+	})
+	lobby, err := sa.NewService("lobby", 1)
+	assert.Nil(t, err)
+	rsp, err := lobby.CallCluster(context.Background(), "test_trace_b", "chat", 1, "Say", "lilei")
+	assert.Nil(t, err)
+	assert.Equal(t, "pushed", rsp)
+	<-notified
+	_, err = lobby.CallCluster(context.Background(), "test_trace_b", "chat", 1, "Unknown", "lilei")
+	assert.NotNil(t, err)
+
+	root := exporter.find("Say", SPAN_KIND_CLIENT)
+	assert.NotNil(t, root)
+	assert.False(t, root.Parent.IsValid())
+	assert.Equal(t, "test_trace_b", root.Attributes["saber.peer.cluster"])
+	say := exporter.find("Say", SPAN_KIND_SERVER)
+	assert.NotNil(t, say)
+	assert.Equal(t, root.SpanContext.SpanID, say.Parent.SpanID)
+	assert.True(t, say.Parent.Remote)
+	assert.True(t, say.EndTime.Before(root.EndTime))
+	push := exporter.find("Push", SPAN_KIND_CLIENT)
+	assert.Equal(t, say.SpanContext.SpanID, push.Parent.SpanID)
+	pushed := exporter.find("Push", SPAN_KIND_SERVER)
+	assert.Equal(t, push.SpanContext.SpanID, pushed.Parent.SpanID)
+	assert.Equal(t, "lilei", pushed.Attributes["player"])
+	assert.Equal(t, "gate-1", pushed.Attributes["saber.service"])
+	kick := exporter.find("Kick", SPAN_KIND_PRODUCER)
+	assert.Equal(t, say.SpanContext.SpanID, kick.Parent.SpanID)
+	kicked := exporter.find("Kick", SPAN_KIND_CONSUMER)
+	assert.Equal(t, kick.SpanContext.SpanID, kicked.Parent.SpanID)
+	for _, span := range []*SpanData{say, push, pushed, kick, kicked} {
+		assert.Equal(t, root.SpanContext.TraceID, span.SpanContext.TraceID)
+	}
+
+	unknown := exporter.find("Unknown", SPAN_KIND_CLIENT)
+	assert.True(t, unknown.Failed)
+	assert.NotEqual(t, root.SpanContext.TraceID, unknown.SpanContext.TraceID)
+}
+
+func TestNoopTracer(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		ClusterName:    "test_noop_trace",
+		LocalAddr:      "127.0.0.1:0",
+		TickIntervalMs: 10,
+	})
+	defer s.Exit()
+	echo, err := s.NewService("echo", 1)
+	assert.Nil(t, err)
+	echo.RegisterSvcHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+		assert.False(t, SpanFromCtx(ctx).SpanContext().IsValid())
+		return MetadataFromCtx(ctx)[TRACEPARENT_KEY], nil
+	})
+	client, err := s.NewService("client", 1)
+	assert.Nil(t, err)
+	rsp, err := client.Call(context.Background(), "echo", 1, "Echo", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", rsp)
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"log"
 	"net/http"
@@ -39,6 +38,7 @@ type RspLogin struct {
 
 type ReqHandler struct {
 	server    *saber.Server
+	codec     saber.Codec
 	client    *saber.Service
 	svcID     uint32
 	results   chan<- *kite.Response
@@ -47,21 +47,13 @@ type ReqHandler struct {
 
 // impl of saber.Codec.Marshal
 func (rh *ReqHandler) Marshal(msgType saber.MsgType, method string, v interface{}) ([]byte, error) {
-	return json.Marshal(v)
+	return rh.codec.Marshal(msgType, method, v)
 }
 
 // impl of saber.Codec.Unmarshal
 func (rh *ReqHandler) Unmarshal(msgType saber.MsgType, method string, data []byte) (interface{}, error) {
 	rh.recvBytes = uint64(len(data))
-	var v interface{}
-	if msgType == saber.MSG_TYPE_CLUSTER_RSP && method == "ReqLogin" {
-		v = &RspLogin{}
-	}
-	err := json.Unmarshal(data, &v)
-	if err != nil {
-		return nil, err
-	}
-	return v, err
+	return rh.codec.Unmarshal(msgType, method, data)
 }
 
 func (rh *ReqHandler) Init(req *kite.Request, results chan<- *kite.Response) error {
@@ -69,6 +61,7 @@ func (rh *ReqHandler) Init(req *kite.Request, results chan<- *kite.Response) err
 	if err != nil {
 		return err
 	}
+	rh.codec = rh.server.GetCodec()
 	s.SetCodec(rh)
 	rh.results = results
 	rh.client = s
@@ -81,11 +74,10 @@ func (rh *ReqHandler) OnRequest() error {
 	if rpcSvcNum > 0 {
 		svcID += rh.svcID % uint32(rpcSvcNum)
 	}
-	ctx := context.WithValue(context.Background(), saber.CtxKeyRpcTimeoutMS, 3*time.Second)
-	reply, err := rh.client.CallCluster(ctx, "stress_server", "lobby", svcID, "ReqLogin", &ReqLogin{
+	reply, err := rh.client.CallCluster(context.Background(), "stress_server", "lobby", svcID, "ReqLogin", &ReqLogin{
 		Gid:  uint64(10100000 + rh.svcID),
 		Name: uuid.New().String()[:8],
-	})
+	}, saber.WithTimeout(3*time.Second))
 	result := &kite.Response{}
 	result.UseTime = uint64(time.Since(startTime))
 	result.Method = "ReqLogin"
@@ -126,6 +118,10 @@ func main() {
 	if err != nil {
 		log.Fatalf("new server err:%v", err)
 	}
+	err = ss.RegisterMsgType(saber.MSG_TYPE_CLUSTER_RSP, "ReqLogin", (*RspLogin)(nil))
+	if err != nil {
+		log.Fatalf("register msg type err:%v", err)
+	}
 
 	ks := kite.NewServer()
 	_, err = ks.RunWithSimpleArgs("stress_server.lobby.101", concyNum, reqNumPerConcy, func() kite.ReqHandler {
@@ -3,14 +3,12 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
 	"log"
 	"net/http"
 	"syscall"
 
 	_ "net/http/pprof"
 
-	"github.com/goinggo/mapstructure"
 	saber "github.com/xingshuo/saber/pkg"
 )
 
@@ -55,18 +53,16 @@ func main() {
 		if err != nil {
 			log.Fatalf("new lobby service err:%v", err)
 		}
-		lobbySvc.RegisterSvcHandler("ReqLogin", func(ctx context.Context, req interface{}) (interface{}, error) {
-			msg := &ReqLogin{}
-			err := mapstructure.Decode(req, msg)
-			if err != nil {
-				return nil, fmt.Errorf("proto error %w", err)
-			}
+		err = lobbySvc.RegisterTypedHandler("ReqLogin", func(ctx context.Context, msg *ReqLogin) (*RspLogin, error) {
 			if msg.Gid/100000 != 101 {
 				log.Fatalf("gid err %d", msg.Gid)
 			}
 			//fmt.Printf("%s on req login %d", msg.Name, msg.Gid)
 			return &RspLogin{Status: 200}, nil
 		})
+		if err != nil {
+			log.Fatalf("register lobby handler err:%v", err)
+		}
 	}
 	server.WaitExit(syscall.SIGINT)
 }